@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"data_sync/datasync"
+)
+
+type job struct {
+	ID         string     `json:"id"`
+	Config     string     `json:"config"`
+	StartDate  string     `json:"startDate,omitempty"`
+	EndDate    string     `json:"endDate,omitempty"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// finishedJobTTL is how long a finished job can still be looked up.
+const finishedJobTTL = time.Hour
+
+type syncRequest struct {
+	Config    string `json:"config"`
+	StartDate string `json:"startDate"`
+	EndDate   string `json:"endDate"`
+}
+
+type apiServer struct {
+	program *program
+	token   string
+	server  *http.Server
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func (p *program) startAPI(settings Settings) {
+	api := &apiServer{
+		program: p,
+		token:   settings.APIToken,
+		jobs:    make(map[string]*job),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /sync", api.authorized(api.handleSync))
+	mux.HandleFunc("GET /jobs/{id}", api.authorized(api.handleJob))
+	mux.HandleFunc("GET /healthz", api.handleHealth)
+	api.server = &http.Server{Addr: settings.APIAddr, Handler: mux}
+
+	p.mu.Lock()
+	p.api = api
+	p.mu.Unlock()
+
+	go func() {
+		log.Println("API listening on", settings.APIAddr)
+		if err := api.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("API server failed:", err)
+		}
+	}()
+}
+
+func (p *program) stopAPI() {
+	p.mu.Lock()
+	api := p.api
+	p.mu.Unlock()
+	if api == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := api.server.Shutdown(ctx); err != nil {
+		log.Println("Failed to shut down API server:", err)
+	}
+}
+
+func (a *apiServer) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (a *apiServer) handleSync(w http.ResponseWriter, r *http.Request) {
+	var req syncRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body: " + err.Error()})
+		return
+	}
+	if (req.StartDate == "") != (req.EndDate == "") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "startDate and endDate must be given together"})
+		return
+	}
+
+	config, ok := a.program.findConfig(req.Config)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no config named " + req.Config})
+		return
+	}
+	if config.Disabled() {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "config " + req.Config + " is disabled"})
+		return
+	}
+
+	key := config.Key()
+	if !a.program.beginSync(key, true) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "a sync of config " + req.Config + " is already running"})
+		return
+	}
+
+	j := &job{
+		ID:        newJobID(),
+		Config:    req.Config,
+		StartDate: req.StartDate,
+		EndDate:   req.EndDate,
+		Status:    "running",
+		StartedAt: time.Now(),
+	}
+	a.mu.Lock()
+	a.pruneJobs(j.StartedAt)
+	a.jobs[j.ID] = j
+	a.mu.Unlock()
+
+	a.program.triggers.Add(1)
+	go func() {
+		defer a.program.triggers.Done()
+		defer a.program.endSync(key, true)
+		log.Println("API job", j.ID, "syncing folder: ", remoteDirs(config))
+		_, err := syncFolder(a.program.ctx, config, req.StartDate, req.EndDate)
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		finished := time.Now()
+		j.FinishedAt = &finished
+		j.Status = "succeeded"
+		if err != nil {
+			j.Status = "failed"
+			j.Error = err.Error()
+		}
+	}()
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": j.ID})
+}
+
+// pruneJobs forgets the jobs that finished more than finishedJobTTL
+// before now. a.mu must be held.
+func (a *apiServer) pruneJobs(now time.Time) {
+	for id, j := range a.jobs {
+		if j.FinishedAt != nil && now.Sub(*j.FinishedAt) > finishedJobTTL {
+			delete(a.jobs, id)
+		}
+	}
+}
+
+func (a *apiServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	j, ok := a.jobs[r.PathValue("id")]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such job"})
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+type staleConfig struct {
+	Config    string     `json:"config"`
+	LastRun   *time.Time `json:"lastRun,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+	Reason    string     `json:"reason"`
+}
+
+// handleHealth reports healthy when every config's last sync succeeded
+// within twice its cron interval. It is not behind the bearer token so
+// orchestrators can probe it without credentials.
+func (a *apiServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	states, err := loadState()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+
+	a.program.mu.Lock()
+	cfgs, cronFormat := configs, settings.CronFormat
+	a.program.mu.Unlock()
+
+	now := time.Now()
+	stale := []staleConfig{}
+	for _, config := range cfgs {
+		if config.Disabled() {
+			continue
+		}
+		key := config.Key()
+		state, ok := states[key]
+		if !ok {
+			stale = append(stale, staleConfig{Config: key, Reason: "never synced"})
+			continue
+		}
+		lastRun := state.LastRun
+		if state.LastError != "" {
+			stale = append(stale, staleConfig{Config: key, LastRun: &lastRun, LastError: state.LastError, Reason: "last sync failed"})
+			continue
+		}
+		interval, err := cronInterval(cronFormat, config.Cron, now)
+		if err != nil {
+			stale = append(stale, staleConfig{Config: key, LastRun: &lastRun, Reason: err.Error()})
+			continue
+		}
+		if now.Sub(lastRun) > 2*interval {
+			stale = append(stale, staleConfig{Config: key, LastRun: &lastRun, Reason: "last sync older than twice the cron interval"})
+		}
+	}
+
+	if len(stale) > 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "unhealthy", "stale": stale})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// cronInterval estimates a schedule's interval as the gap between its next
+// two activations after now.
+func cronInterval(cronFormat, spec string, now time.Time) (time.Duration, error) {
+	schedule, err := parseCron(cronFormat, spec)
+	if err != nil {
+		return 0, err
+	}
+	next := schedule.Next(now)
+	return schedule.Next(next).Sub(next), nil
+}
+
+func (p *program) findConfig(name string) (datasync.Config, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, config := range configs {
+		if config.Name == name {
+			return config, true
+		}
+	}
+	return datasync.Config{}, false
+}
+
+func newJobID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
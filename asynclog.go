@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// While the service runs, log lines are queued for a goroutine writing
+// them to the log output, so that syncs never wait for a slow sink such as
+// a journal under load or a file on a network drive. Lines that do not fit
+// the queue are dropped and counted, and the count is reported.
+
+// defaultLogBufferLines is the queue length when logBufferLines is unset.
+const defaultLogBufferLines = 4096
+
+// droppedLogInterval is how often the number of dropped lines is logged.
+const droppedLogInterval = 10 * time.Second
+
+// logFlushTimeout bounds how long Close waits for the queued lines to be
+// written, should the output hang.
+const logFlushTimeout = 10 * time.Second
+
+type asyncLog struct {
+	out     io.Writer
+	lines   chan []byte
+	dropped atomic.Int64
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// startAsyncLog moves the standard logger's output behind a queue of size
+// lines and returns it, to be closed once the service stops.
+func startAsyncLog(size int) *asyncLog {
+	if size == 0 {
+		size = defaultLogBufferLines
+	}
+	l := &asyncLog{out: log.Writer(), lines: make(chan []byte, size), stop: make(chan struct{}), done: make(chan struct{})}
+	go l.run()
+	log.SetOutput(l)
+	return l
+}
+
+// Write queues a log line, or drops it when the queue is full.
+func (l *asyncLog) Write(p []byte) (int, error) {
+	// The logger reuses p once Write returns.
+	line := append([]byte(nil), p...)
+	select {
+	case l.lines <- line:
+	default:
+		l.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+func (l *asyncLog) run() {
+	defer close(l.done)
+	notices := log.New(l.out, "", log.Flags())
+	report := func() {
+		if n := l.dropped.Swap(0); n > 0 {
+			notices.Printf("Dropped %d log lines, the log output could not keep up", n)
+		}
+	}
+	ticker := time.NewTicker(droppedLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line := <-l.lines:
+			l.out.Write(line)
+		case <-ticker.C:
+			report()
+		case <-l.stop:
+			for {
+				select {
+				case line := <-l.lines:
+					l.out.Write(line)
+				default:
+					report()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close writes the queued lines and makes the standard logger write to
+// its output directly again.
+func (l *asyncLog) Close() {
+	l.once.Do(func() {
+		log.SetOutput(l.out)
+		close(l.stop)
+		select {
+		case <-l.done:
+		case <-time.After(logFlushTimeout):
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+const (
+	colorReset = "\x1b[0m"
+	colorRed   = "\x1b[31m"
+)
+
+// useColor is set by -color and colors the log lines of the CLI itself.
+var useColor bool
+
+// colorEnabled decides, from the -color flag, whether log output is
+// colored. "auto" colors only a terminal, and respects NO_COLOR.
+func colorEnabled(mode string) (bool, error) {
+	switch mode {
+	case "always":
+		enableVirtualTerminal(os.Stderr)
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		if os.Getenv("NO_COLOR") != "" || !term.IsTerminal(int(os.Stderr.Fd())) {
+			return false, nil
+		}
+		return enableVirtualTerminal(os.Stderr), nil
+	}
+	return false, fmt.Errorf("invalid -color %q: must be auto, always or never", mode)
+}
+
+// red returns s in red when colors are on.
+func red(s string) string {
+	if !useColor {
+		return s
+	}
+	return colorRed + s + colorReset
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"data_sync/datasync"
+)
+
+func printConfigs(w io.Writer, configPath string) error {
+	if configPath == stdinConfig {
+		configPath = "stdin"
+	}
+	fmt.Fprintln(w, "Configs loaded from", configPath)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tNAME\tENABLED\tLOGIN\tPASSWORD\tACTION\tLOCAL DIR\tREMOTE DIR\tCRON\tNEXT RUN")
+	for i, config := range configs {
+		enabled, nextRun := "yes", "invalid cron"
+		if schedule, err := parseCron(settings.CronFormat, config.Cron); err == nil {
+			nextRun = schedule.Next(time.Now()).Format(time.DateTime)
+		}
+		if config.Disabled() {
+			enabled, nextRun = "no", "-"
+		}
+		pairs := config.DirPairs()
+		if len(pairs) == 0 {
+			pairs = []datasync.DirPair{{}}
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s@%s:%d\t%s\t%s\t%s\t%s\t%s\t%s\n", i, config.Name, enabled,
+			config.User, config.SSHHost, config.SSHPort, maskSecret(config.Password),
+			config.Action, pairs[0].LocalDir, pairs[0].RemoteDir, config.Cron, nextRun)
+		for _, pair := range pairs[1:] {
+			fmt.Fprintf(tw, "\t\t\t\t\t\t%s\t%s\t\t\n", pair.LocalDir, pair.RemoteDir)
+		}
+	}
+	return tw.Flush()
+}
+
+// printValidation reports on the configuration, which loadConfig has
+// already validated, and recommends the settings that guard against
+// mistakes in it.
+func printValidation(w io.Writer, configPath string) {
+	if configPath == stdinConfig {
+		configPath = "stdin"
+	}
+	fmt.Fprintln(w, "Configuration", configPath, "is valid:", len(configs), "configs")
+	var readOnly []string
+	for _, config := range configs {
+		if config.ReadOnlyRemote {
+			readOnly = append(readOnly, config.Key())
+		}
+	}
+	if len(readOnly) > 0 {
+		fmt.Fprintln(w, "Never written to, with readOnlyRemote:", strings.Join(readOnly, ", "))
+	}
+	if len(settings.AllowedRemoteRoots) == 0 {
+		fmt.Fprintln(w, "Recommendation: set allowedRemoteRoots to the remote directories configs may sync, so that a mistyped remoteDir such as \"/\" is rejected")
+	}
+}
+
+// remoteDirs lists the remote directories of a config for log messages.
+func remoteDirs(config datasync.Config) string {
+	var dirs []string
+	for _, pair := range config.DirPairs() {
+		dirs = append(dirs, pair.RemoteDir)
+	}
+	return strings.Join(dirs, ", ")
+}
+
+func maskSecret(secret string) string {
+	if secret == "" {
+		return "-"
+	}
+	return "********"
+}
+
+// syncReport is the summary printed by -jsonOutput.
+type syncReport struct {
+	Configs []configReport `json:"configs"`
+}
+
+type configReport struct {
+	Config          string       `json:"config"`
+	Files           int          `json:"files"`
+	Skipped         int          `json:"skipped"`
+	Failed          int          `json:"failed"`
+	Bytes           int64        `json:"bytes"`
+	DurationSeconds float64      `json:"durationSeconds"`
+	Errors          []string     `json:"errors"`
+	Denied          int          `json:"denied"`
+	DeniedPaths     []string     `json:"deniedPaths,omitempty"`
+	Vanished        int          `json:"vanished"`
+	Dates           []dateReport `json:"dates,omitempty"`
+
+	TransferSeconds    float64     `json:"transferSeconds"`
+	AverageBytesPerSec float64     `json:"averageBytesPerSec"`
+	PeakBytesPerSec    float64     `json:"peakBytesPerSec"`
+	SlowestDirs        []dirReport `json:"slowestDirs"`
+
+	// planned is left to -planFile.
+	planned []datasync.PlannedOp
+}
+
+type dirReport struct {
+	Dir     string  `json:"dir"`
+	Seconds float64 `json:"seconds"`
+	Files   int     `json:"files"`
+	Bytes   int64   `json:"bytes"`
+}
+
+type dateReport struct {
+	Date    string `json:"date"`
+	Files   int    `json:"files"`
+	Skipped int    `json:"skipped"`
+	Failed  int    `json:"failed"`
+	Bytes   int64  `json:"bytes"`
+	// AlreadyDone marks dates an earlier run of the range completed.
+	AlreadyDone bool `json:"alreadyDone,omitempty"`
+}
+
+func (r *syncReport) add(config datasync.Config, result datasync.Result) {
+	errs := []string{}
+	for _, err := range result.Errors {
+		errs = append(errs, err.Error())
+	}
+	var dates []dateReport
+	for _, date := range result.Dates {
+		if !date.Synced && !date.Resumed {
+			continue
+		}
+		dates = append(dates, dateReport{date.Date, date.Files, date.Skipped, date.Failed, date.Bytes, !date.Synced})
+	}
+	dirs := []dirReport{}
+	for _, dir := range result.SlowestDirs {
+		dirs = append(dirs, dirReport{dir.Dir, dir.Duration.Seconds(), dir.Files, dir.Bytes})
+	}
+	r.Configs = append(r.Configs, configReport{
+		Config:          config.Key(),
+		Files:           result.Files,
+		Skipped:         result.Skipped,
+		Failed:          result.Failed,
+		Bytes:           result.Bytes,
+		DurationSeconds: result.Duration.Seconds(),
+		Errors:          errs,
+		Denied:          result.Denied,
+		DeniedPaths:     result.DeniedPaths,
+		Vanished:        result.Vanished,
+		Dates:           dates,
+
+		TransferSeconds:    result.TransferTime.Seconds(),
+		AverageBytesPerSec: result.AverageRate(),
+		PeakBytesPerSec:    result.PeakRate,
+		SlowestDirs:        dirs,
+
+		planned: result.Planned,
+	})
+}
+
+func (r *syncReport) write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// logDenied lists the paths of a run that failed for a lack of permission.
+func logDenied(config datasync.Config, result datasync.Result) {
+	if result.Denied == 0 {
+		return
+	}
+	log.Println(red(fmt.Sprintf("Access denied to %d files or directories of %s:", result.Denied, config.Key())))
+	for _, path := range result.DeniedPaths {
+		log.Println("  " + path)
+	}
+	if more := result.Denied - len(result.DeniedPaths); more > 0 {
+		log.Printf("  and %d more", more)
+	}
+}
+
+// logPerformance logs the transfer rates of a run, how much of it was
+// spent transferring, and its slowest directories.
+func logPerformance(config datasync.Config, result datasync.Result) {
+	if result.Files == 0 && len(result.SlowestDirs) == 0 {
+		return
+	}
+	peak := "-"
+	if result.PeakRate > 0 {
+		peak = formatRate(result.PeakRate)
+	}
+	log.Printf("Performance of %s: %s average, %s peak, %s of %s spent transferring",
+		config.Key(), formatRate(result.AverageRate()), peak,
+		result.TransferTime.Round(time.Millisecond), result.Duration.Round(time.Millisecond))
+	if len(result.SlowestDirs) == 0 {
+		return
+	}
+	log.Println("Slowest directories of", config.Key()+":")
+	for _, dir := range result.SlowestDirs {
+		log.Printf("  %s  %s (%d transferred, %d bytes)", dir.Duration.Round(time.Millisecond), dir.Dir, dir.Files, dir.Bytes)
+	}
+}
+
+// formatRate formats bytes per second as MB/s.
+func formatRate(bytesPerSec float64) string {
+	return fmt.Sprintf("%.2f MB/s", bytesPerSec/1e6)
+}
+
+// logDateResults logs a line for every synced date of a date range, with
+// the numbers aligned in columns.
+func logDateResults(config datasync.Config, dates []datasync.DateResult) {
+	var files, bytes, skipped, failed int
+	width := func(w *int, n int64) {
+		*w = max(*w, len(strconv.FormatInt(n, 10)))
+	}
+	for _, date := range dates {
+		width(&files, int64(date.Files))
+		width(&bytes, date.Bytes)
+		width(&skipped, int64(date.Skipped))
+		width(&failed, int64(date.Failed))
+	}
+	for _, date := range dates {
+		if !date.Synced {
+			if date.Resumed {
+				log.Println(config.Key(), date.Date+": already done by an earlier run of this range")
+			}
+			continue
+		}
+		line := fmt.Sprintf("%s %s: %*d transferred (%*d bytes), %*d skipped, %*d failed",
+			config.Key(), date.Date, files, date.Files, bytes, date.Bytes, skipped, date.Skipped, failed, date.Failed)
+		if date.Failed > 0 {
+			line = red(line)
+		}
+		log.Println(line)
+	}
+}
+
+// consoleEvents logs a summary line for every synced directory, for
+// -progress.
+type consoleEvents struct {
+	datasync.NopEvents
+}
+
+func (consoleEvents) OnDirComplete(dir string, stats datasync.DirStats) {
+	log.Printf("Finished %s: %d transferred (%d bytes), %d skipped, %d failed",
+		dir, stats.Files, stats.Bytes, stats.Skipped, stats.Failed)
+}
+
+// testConnectionTimeout bounds the connection test of a single config.
+const testConnectionTimeout = 30 * time.Second
+
+// testConnections connects to the remote side of every selected config and
+// checks its remote directories, without transferring anything.
+func testConnections(ctx context.Context, names []string) int {
+	selected, err := selectConfigs(names)
+	if err != nil {
+		log.Println(err)
+		return exitConfig
+	}
+
+	exitCode := exitOK
+	for _, config := range selected {
+		if ctx.Err() != nil {
+			log.Println("Test interrupted")
+			return exitError
+		}
+		if config.Disabled() && len(names) == 0 {
+			log.Println("Skipping disabled config", config.Key())
+			continue
+		}
+		start := time.Now()
+		testCtx, cancel := context.WithTimeout(ctx, testConnectionTimeout)
+		err := syncer.CheckConnection(testCtx, config)
+		cancel()
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			log.Println(red(fmt.Sprintf("FAILED %s (%s): %v", config.Key(), elapsed, err)))
+			exitCode = exitConnection
+			continue
+		}
+		log.Printf("OK     %s (%s)", config.Key(), elapsed)
+	}
+	return exitCode
+}
+
+// diffReport is the JSON form of the diff command.
+type diffReport struct {
+	Configs []configDiff `json:"configs"`
+}
+
+type configDiff struct {
+	Config string              `json:"config"`
+	Action string              `json:"action"`
+	Pairs  []datasync.PairDiff `json:"pairs"`
+	Error  string              `json:"error,omitempty"`
+}
+
+// diffConfigs prints what syncing the configs named names, or all of them,
+// would change, as text or, with jsonOut, as JSON.
+func diffConfigs(ctx context.Context, w io.Writer, names []string, jsonOut bool) int {
+	exitCode, _ := compareConfigs(ctx, w, names, jsonOut, "Diff", syncer.Diff, diffGroups)
+	return exitCode
+}
+
+// verifyConfigs prints the files that differ between the source and the
+// destination of the configs named names, or all of them, comparing their
+// checksums too with checksum. It fails with exitFailed when any do.
+func verifyConfigs(ctx context.Context, w io.Writer, names []string, checksum, jsonOut bool) int {
+	verify := func(ctx context.Context, config datasync.Config) ([]datasync.PairDiff, error) {
+		return syncer.Verify(ctx, config, checksum)
+	}
+	exitCode, report := compareConfigs(ctx, w, names, jsonOut, "Verify", verify, verifyGroups)
+	mismatched := 0
+	for _, diff := range report.Configs {
+		for _, pair := range diff.Pairs {
+			mismatched += len(pair.SourceOnly) + len(pair.Differing) + len(pair.DestOnly)
+		}
+	}
+	if mismatched > 0 {
+		log.Println(red(fmt.Sprint("Verification failed: ", mismatched, " files missing, extra or differing")))
+		return worseExit(exitCode, exitFailed)
+	}
+	if exitCode == exitOK {
+		log.Println("Verification passed")
+	}
+	return exitCode
+}
+
+// diffGroups and verifyGroups title the groups of a PairDiff, as printed
+// by printDiff: the files only on the source, those differing, those only
+// on the destination, and the count of the rest.
+var (
+	diffGroups   = [4]string{"Only on source, would be transferred", "Differing, would be transferred again", "Only on destination, not on source", "Up to date"}
+	verifyGroups = [4]string{"Missing at destination", "Differing", "Extra at destination", "Matching"}
+)
+
+// compareConfigs prints how the two sides of the configs named names, or
+// all of them, compare through compare, as text under groups or, with
+// jsonOut, as JSON. verb names the comparison in log lines.
+func compareConfigs(ctx context.Context, w io.Writer, names []string, jsonOut bool, verb string,
+	compare func(context.Context, datasync.Config) ([]datasync.PairDiff, error), groups [4]string) (int, diffReport) {
+	report := diffReport{Configs: []configDiff{}}
+	selected, err := selectConfigs(names)
+	if err != nil {
+		log.Println(err)
+		return exitConfig, report
+	}
+
+	exitCode := exitOK
+	for _, config := range selected {
+		if ctx.Err() != nil {
+			log.Println(verb, "interrupted")
+			return exitError, report
+		}
+		if config.Disabled() && len(names) == 0 {
+			log.Println("Skipping disabled config", config.Key())
+			continue
+		}
+		pairs, err := compare(ctx, config)
+		diff := configDiff{Config: config.Key(), Action: config.Action, Pairs: pairs}
+		if err != nil {
+			log.Println(red(fmt.Sprint(verb, " failed for ", config.Key(), " : ", err)))
+			diff.Error = err.Error()
+			exitCode = worseExit(exitCode, syncExitCode(datasync.Result{}, err))
+		}
+		if diff.Pairs == nil {
+			diff.Pairs = []datasync.PairDiff{}
+		}
+		report.Configs = append(report.Configs, diff)
+		if !jsonOut {
+			printDiff(w, diff, groups)
+		}
+	}
+	if jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Println("Failed to write the", strings.ToLower(verb)+":", err)
+			return exitError, report
+		}
+	}
+	return exitCode, report
+}
+
+func printDiff(w io.Writer, diff configDiff, titles [4]string) {
+	for _, pair := range diff.Pairs {
+		from, to := pair.RemoteDir, pair.LocalDir
+		if diff.Action == "push" || diff.Action == "move-push" {
+			from, to = pair.LocalDir, pair.RemoteDir
+		}
+		fmt.Fprintf(w, "%s: %s %s -> %s\n", diff.Config, diff.Action, from, to)
+		groups := []struct {
+			title   string
+			entries []datasync.DiffEntry
+		}{
+			{titles[0], pair.SourceOnly},
+			{titles[1], pair.Differing},
+			{titles[2], pair.DestOnly},
+		}
+		for _, group := range groups {
+			fmt.Fprintf(w, "  %s (%d):\n", group.title, len(group.entries))
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			for _, entry := range group.entries {
+				line := fmt.Sprintf("    %s\t%d bytes\t%s", entry.Path, entry.Size, entry.ModTime.Local().Format(time.DateTime))
+				if entry.Reason != "" {
+					line += "\t" + entry.Reason
+				}
+				fmt.Fprintln(tw, line)
+			}
+			tw.Flush()
+		}
+		fmt.Fprintf(w, "  %s: %d files\n", titles[3], pair.Same)
+	}
+}
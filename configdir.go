@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"data_sync/datasync"
+)
+
+// When the config path is a directory, every *.json file in it is read as
+// a config file of its own, in name order, and their configs are combined.
+// Each file's defaults, defaultCron and baseDir only apply to the configs
+// in it, while the service settings may be set by one file only.
+
+// readConfigDir reads the config files in dir.
+func readConfigDir(dir string) (*configFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config directory: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".json":
+			names = append(names, name)
+		case ".yaml", ".yml":
+			return nil, fmt.Errorf("%s: YAML config files are not supported, convert it to JSON", filepath.Join(dir, name))
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("config directory %s holds no *.json files", dir)
+	}
+	sort.Strings(names)
+
+	merged := &configFile{Configs: []datasync.Config{}}
+	var settingsFrom string
+	owners := make(map[string]string)
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		loaded, err := readConfigFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if !reflect.ValueOf(loaded.serviceSettings()).IsZero() {
+			if settingsFrom != "" {
+				return nil, fmt.Errorf("%s: service settings are already set in %s", path, settingsFrom)
+			}
+			settingsFrom = path
+			merged.Settings = loaded.Settings
+		}
+		for _, config := range loaded.Configs {
+			if config.Name == "" {
+				continue
+			}
+			if owner, ok := owners[config.Name]; ok && owner != path {
+				return nil, fmt.Errorf("%s: config name %q is already used in %s", path, config.Name, owner)
+			}
+			owners[config.Name] = path
+		}
+		merged.Configs = append(merged.Configs, loaded.Configs...)
+	}
+	return merged, nil
+}
+
+// serviceSettings returns the settings that apply to the whole process,
+// without those that only apply to the file's own configs.
+func (f *configFile) serviceSettings() Settings {
+	settings := f.Settings
+	settings.BaseDir, settings.DefaultCron = "", ""
+	return settings
+}
+
+// isConfigEvent reports whether a change of path affects the config at
+// configPath, a file or a directory of them.
+func isConfigEvent(configPath, path string) bool {
+	if info, err := os.Stat(configPath); err == nil && info.IsDir() {
+		return filepath.Dir(filepath.Clean(path)) == filepath.Clean(configPath) &&
+			strings.EqualFold(filepath.Ext(path), ".json") && !strings.HasPrefix(filepath.Base(path), ".")
+	}
+	return filepath.Clean(path) == filepath.Clean(configPath)
+}
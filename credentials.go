@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"data_sync/datasync"
+)
+
+// credentials is one entry of the file named by CREDENTIALS_FILE, which maps
+// the names used in credentialsRef to the secrets of a connection.
+type credentials struct {
+	User           string `json:"user"`
+	Password       string `json:"password"`
+	PrivateKeyPath string `json:"privateKeyPath"`
+	KeyPassphrase  string `json:"keyPassphrase"`
+}
+
+// resolveCredentials fills the connection secrets of every config with a
+// credentialsRef from the credentials file. Values from the file replace
+// those in the config.
+func resolveCredentials(cfgs []datasync.Config) error {
+	var refs bool
+	for _, config := range cfgs {
+		refs = refs || config.CredentialsRef != ""
+	}
+	if !refs {
+		return nil
+	}
+
+	path := os.Getenv("CREDENTIALS_FILE")
+	if path == "" {
+		return fmt.Errorf("credentialsRef is used but CREDENTIALS_FILE is not set")
+	}
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read credentials file: %w", err)
+	}
+	var entries map[string]credentials
+	if err := json.Unmarshal(file, &entries); err != nil {
+		return fmt.Errorf("unable to parse credentials file %s: %w", path, err)
+	}
+
+	for i := range cfgs {
+		config := &cfgs[i]
+		if config.CredentialsRef == "" {
+			continue
+		}
+		creds, ok := entries[config.CredentialsRef]
+		if !ok {
+			return fmt.Errorf("config %d (%s): no credentials named %q in %s", i, config.Key(), config.CredentialsRef, path)
+		}
+		if creds.User != "" {
+			config.User = creds.User
+		}
+		if creds.Password != "" {
+			config.Password = creds.Password
+		}
+		if creds.PrivateKeyPath != "" {
+			config.PrivateKeyPath = creds.PrivateKeyPath
+		}
+		if creds.KeyPassphrase != "" {
+			config.KeyPassphrase = creds.KeyPassphrase
+		}
+	}
+	return nil
+}
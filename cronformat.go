@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/robfig/cron/v3"
+)
+
+// The cronFormat setting selects how every config's cron is parsed: five
+// fields from minutes to weekdays by default, or with a leading seconds
+// field. Descriptors such as @hourly and @every 30s are accepted by both.
+const (
+	cronFormatStandard    = "standard"
+	cronFormatWithSeconds = "withSeconds"
+)
+
+func cronParser(format string) (cron.Parser, error) {
+	fields := cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor
+	switch format {
+	case "", cronFormatStandard:
+		return cron.NewParser(fields), nil
+	case cronFormatWithSeconds:
+		return cron.NewParser(cron.Second | fields), nil
+	}
+	return cron.Parser{}, fmt.Errorf("invalid cronFormat %q, must be %s or %s", format, cronFormatStandard, cronFormatWithSeconds)
+}
+
+// parseCron parses spec in format, which loadConfig has checked.
+func parseCron(format, spec string) (cron.Schedule, error) {
+	parser, err := cronParser(format)
+	if err != nil {
+		return nil, err
+	}
+	return parser.Parse(spec)
+}
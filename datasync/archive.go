@@ -0,0 +1,504 @@
+package datasync
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// With an ArchiveMode a push bundles every synced directory, such as the
+// folder of a date, into a single archive named after the directory, and a
+// pull extracts that archive into the local directory. Archives are
+// streamed, never held in memory; a pulled zip file is the exception and
+// goes through a temporary file, since zip keeps its index at the end.
+
+var archiveExts = map[string]string{
+	"tar.gz": ".tar.gz",
+	"zip":    ".zip",
+}
+
+// archiveMarkerName is the file in an extracted directory recording the
+// archive it came from, so an unchanged archive is not extracted again.
+const archiveMarkerName = ".datasync-archive.json"
+
+type archiveMarker struct {
+	Archive string    `json:"archive"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+func (m archiveMarker) matches(other archiveMarker) bool {
+	return m.Archive == other.Archive && m.Size == other.Size && m.ModTime.Equal(other.ModTime)
+}
+
+// archiveMode returns the ArchiveMode, or "" when directories are synced
+// file by file.
+func (c Config) archiveMode() string {
+	if c.ArchiveMode == "none" {
+		return ""
+	}
+	return c.ArchiveMode
+}
+
+func (c Config) validateArchive() error {
+	if c.ArchiveMode == "" || c.ArchiveMode == "none" {
+		return nil
+	}
+	if _, ok := archiveExts[c.ArchiveMode]; !ok {
+		return fmt.Errorf("invalid archiveMode: %s", c.ArchiveMode)
+	}
+	switch {
+	case c.Action != "push" && c.Action != "pull":
+		return fmt.Errorf("archiveMode requires action push or pull")
+	case c.DeltaTransfer || c.EncryptUploads || c.DecryptionKeyPath != "":
+		return fmt.Errorf("archiveMode cannot be combined with deltaTransfer or encryption")
+	case c.RetentionDays > 0 && c.Action == "push":
+		return fmt.Errorf("retentionDays cannot remove pushed archives")
+	}
+	return nil
+}
+
+// archivePath returns the remote archive of the directory remoteDir.
+func (r *syncRun) archivePath(remoteDir string) string {
+	return path.Clean(remoteDir) + archiveExts[r.config.archiveMode()]
+}
+
+func (r *syncRun) syncArchive(localDir, remoteDir string) error {
+	if r.config.direction() == "push" {
+		return r.pushArchive(localDir, remoteDir)
+	}
+	return r.pullArchive(localDir, remoteDir)
+}
+
+type archiveEntry struct {
+	name string
+	path string
+	info os.FileInfo
+}
+
+// archiveEntries lists the files below localDir that go into its archive,
+// with the newest ModTime among them.
+func (r *syncRun) archiveEntries(localDir string) ([]archiveEntry, time.Time, error) {
+	var entries []archiveEntry
+	var newest time.Time
+	err := filepath.WalkDir(localDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == localDir {
+			return nil
+		}
+		name, err := filepath.Rel(localDir, path)
+		if err != nil {
+			return err
+		}
+		if r.hidden(path, d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if r.depthExceeded(path, strings.Count(name, string(filepath.Separator))+1) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() == manifestName || d.Name() == archiveMarkerName || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if r.excluded(path, info) {
+			return nil
+		}
+		entries = append(entries, archiveEntry{name: filepath.ToSlash(name), path: path, info: info})
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return entries, newest, err
+}
+
+func (r *syncRun) pushArchive(localDir, remoteDir string) error {
+	if r.limitReached() {
+		return nil
+	}
+	defer r.completeDir(localDir, r.startDir())
+	remotePath := r.archivePath(remoteDir)
+	entries, newest, err := r.archiveEntries(localDir)
+	if err != nil {
+		r.fail(localDir, err)
+		return err
+	}
+	if len(entries) == 0 {
+		r.debugf("%s: skip (no files to archive)", localDir)
+		return nil
+	}
+
+	var remoteInfo os.FileInfo
+	err = r.retryOnDisconnect(func() (err error) {
+		remoteInfo, err = r.client.Stat(remotePath)
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		r.errorln("Failed to stat remote file", remotePath, ":", err)
+		r.fail(remotePath, err)
+		return err
+	}
+	if remoteInfo != nil && !r.force() && !newest.After(remoteInfo.ModTime()) {
+		r.debugf("%s: skip (archive up to date: newest file %s, archive %s)", localDir,
+			newest.Format(time.RFC3339), remoteInfo.ModTime().Format(time.RFC3339))
+		r.skip(remotePath, "up to date")
+		return nil
+	}
+	if r.dryRun() {
+		r.planTransfer("archive", localDir, remotePath, nil)
+		return nil
+	}
+
+	err = r.retryOnDisconnect(func() error {
+		return r.mkdirRemote(r.client, path.Dir(remotePath))
+	})
+	if err == nil {
+		ctx, cancel := r.fileContext()
+		err = r.retryOnDisconnect(func() error {
+			return r.uploadArchive(ctx, entries, remotePath)
+		})
+		cancel()
+	}
+	if err != nil {
+		r.errorln("Failed to upload archive of", localDir, ":", err)
+		r.fail(remotePath, err)
+		return err
+	}
+	r.countFile()
+	r.transferln("Uploaded archive of", len(entries), "files in", localDir, "to", remotePath)
+	return nil
+}
+
+// uploadArchive streams the archive of entries to remotePath and checks
+// the uploaded copy against the SHA-256 of what was sent.
+func (r *syncRun) uploadArchive(ctx context.Context, entries []archiveEntry, remotePath string) error {
+	started := time.Now()
+	remoteFile, err := r.client.Create(remotePath)
+	if err != nil {
+		return err
+	}
+	defer remoteFile.Close()
+
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := writeArchive(pw, r.config.archiveMode(), entries)
+		pw.CloseWithError(err)
+		written <- err
+	}()
+	hash := sha256.New()
+	n, err := copyFile(ctx, remoteFile, io.TeeReader(pr, hash), remoteFile, r.transferOptions())
+	pr.CloseWithError(errors.New("upload stopped"))
+	if archiveErr := <-written; archiveErr != nil && err == nil {
+		err = archiveErr
+	}
+	if err == nil {
+		err = remoteFile.Close()
+	}
+	if err != nil {
+		remoteFile.Close()
+		r.client.Remove(remotePath)
+		return err
+	}
+
+	sum, err := r.hashRemoteFile(remotePath)
+	if err != nil {
+		return fmt.Errorf("unable to verify %s: %w", remotePath, err)
+	}
+	if sum != hex.EncodeToString(hash.Sum(nil)) {
+		r.client.Remove(remotePath)
+		return fmt.Errorf("uploaded archive %s does not match what was sent", remotePath)
+	}
+	r.transferred(remotePath, n, time.Since(started))
+	return nil
+}
+
+func writeArchive(w io.Writer, mode string, entries []archiveEntry) error {
+	if mode == "zip" {
+		zw := zip.NewWriter(w)
+		for _, entry := range entries {
+			header, err := zip.FileInfoHeader(entry.info)
+			if err != nil {
+				return err
+			}
+			header.Name, header.Method = entry.name, zip.Deflate
+			dst, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			if err := copyArchiveEntry(dst, entry); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		header, err := tar.FileInfoHeader(entry.info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = entry.name
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := copyArchiveEntry(tw, entry); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// copyArchiveEntry copies exactly the size the entry was listed with, so a
+// file changing while it is archived fails instead of corrupting the
+// archive.
+func copyArchiveEntry(dst io.Writer, entry archiveEntry) error {
+	file, err := os.Open(entry.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.CopyN(dst, file, entry.info.Size()); err != nil {
+		return fmt.Errorf("%s changed while it was archived: %w", entry.path, err)
+	}
+	return nil
+}
+
+func (r *syncRun) pullArchive(localDir, remoteDir string) error {
+	if r.limitReached() {
+		return nil
+	}
+	defer r.completeDir(localDir, r.startDir())
+	remotePath := r.archivePath(remoteDir)
+	var remoteInfo os.FileInfo
+	err := r.retryOnDisconnect(func() (err error) {
+		remoteInfo, err = r.client.Stat(remotePath)
+		return err
+	})
+	if err != nil {
+		r.fail(remotePath, err)
+		return err
+	}
+
+	marker := archiveMarker{Archive: path.Base(remotePath), Size: remoteInfo.Size(), ModTime: remoteInfo.ModTime()}
+	if !r.force() && readArchiveMarker(localDir).matches(marker) {
+		r.debugf("%s: skip (archive unchanged since it was extracted)", remotePath)
+		r.skip(remotePath, "up to date")
+		return nil
+	}
+	if r.dryRun() {
+		r.planTransfer("extract", remotePath, localDir, nil)
+		return nil
+	}
+	if err := r.checkFreeSpace(localDir, remoteInfo.Size()); err != nil {
+		r.errorln("Skipping", remotePath, ":", err)
+		r.fail(remotePath, err)
+		if r.config.AbortOnLowSpace {
+			r.errorln("Aborting the sync")
+			r.abort(err)
+		}
+		return err
+	}
+
+	if err := r.mkdirLocal(localDir); err != nil {
+		r.fail(localDir, err)
+		return err
+	}
+	ctx, cancel := r.fileContext()
+	var files int
+	err = r.retryOnDisconnect(func() (err error) {
+		files, err = r.extractArchive(ctx, remotePath, localDir)
+		return err
+	})
+	cancel()
+	if err == nil {
+		err = writeArchiveMarker(localDir, marker)
+	}
+	if err != nil {
+		r.errorln("Failed to extract archive", remotePath, ":", err)
+		r.fail(remotePath, err)
+		return err
+	}
+	r.countFile()
+	r.transferln("Extracted", files, "files from", remotePath, "to", localDir)
+	return nil
+}
+
+// extractArchive downloads remotePath and extracts it into localDir,
+// returning the number of files extracted.
+func (r *syncRun) extractArchive(ctx context.Context, remotePath, localDir string) (int, error) {
+	started := time.Now()
+	remoteFile, err := r.client.Open(remotePath)
+	if err != nil {
+		return 0, err
+	}
+	defer remoteFile.Close()
+
+	if r.config.archiveMode() == "zip" {
+		tmp, err := r.createPartFile(filepath.Join(localDir, path.Base(remotePath)))
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		n, err := copyFile(ctx, tmp, remoteFile, remoteFile, r.transferOptions())
+		if err != nil {
+			return 0, err
+		}
+		r.transferred(remotePath, n, time.Since(started))
+		zr, err := zip.NewReader(tmp, n)
+		if err != nil {
+			return 0, err
+		}
+		return r.extractZip(zr, localDir)
+	}
+
+	pr, pw := io.Pipe()
+	copied := make(chan int64, 1)
+	go func() {
+		n, err := copyFile(ctx, pw, remoteFile, remoteFile, r.transferOptions())
+		pw.CloseWithError(err)
+		copied <- n
+	}()
+	files, err := r.extractTarGz(pr, localDir)
+	pr.CloseWithError(errors.New("extraction stopped"))
+	n := <-copied
+	if err != nil {
+		return files, err
+	}
+	r.transferred(remotePath, n, time.Since(started))
+	return files, nil
+}
+
+func (r *syncRun) extractTarGz(src io.Reader, localDir string) (int, error) {
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gz)
+	files := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			r.warnln("Skipping", header.Name, "in archive: not a regular file")
+			continue
+		}
+		if err := r.extractFile(localDir, header.Name, header.ModTime, tr); err != nil {
+			return files, err
+		}
+		files++
+	}
+}
+
+func (r *syncRun) extractZip(zr *zip.Reader, localDir string) (int, error) {
+	files := 0
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			r.warnln("Skipping", f.Name, "in archive: not a regular file")
+			continue
+		}
+		src, err := f.Open()
+		if err != nil {
+			return files, err
+		}
+		err = r.extractFile(localDir, f.Name, f.Modified, src)
+		src.Close()
+		if err != nil {
+			return files, err
+		}
+		files++
+	}
+	return files, nil
+}
+
+// extractFile writes one file of an archive below localDir, through a
+// part file like any download. Names escaping localDir are rejected.
+func (r *syncRun) extractFile(localDir, name string, modTime time.Time, src io.Reader) error {
+	name = filepath.FromSlash(name)
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("archive entry %q points outside %s", name, localDir)
+	}
+	path := filepath.Join(localDir, name)
+	if err := r.mkdirLocal(filepath.Dir(path)); err != nil {
+		return err
+	}
+	file, err := r.createPartFile(path)
+	if err != nil {
+		return err
+	}
+	partPath := file.Name()
+	_, err = io.Copy(file, src)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = moveFile(partPath, path, false)
+	}
+	if err != nil {
+		os.Remove(partPath)
+		return err
+	}
+	if !modTime.IsZero() {
+		os.Chtimes(path, modTime, modTime)
+	}
+	return nil
+}
+
+func readArchiveMarker(localDir string) archiveMarker {
+	var marker archiveMarker
+	data, err := os.ReadFile(filepath.Join(localDir, archiveMarkerName))
+	if err == nil {
+		json.Unmarshal(data, &marker)
+	}
+	return marker
+}
+
+func writeArchiveMarker(localDir string, marker archiveMarker) error {
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(localDir, archiveMarkerName), data, 0o644)
+}
@@ -0,0 +1,91 @@
+package datasync
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// With AuditLog every transfer and every source file a move deletes is
+// appended to the file as a JSON line, separate from the log. Each line is
+// synced to disk before the sync goes on, so a crash loses no entries.
+
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	Config     string    `json:"config"`
+	Direction  string    `json:"direction"`
+	Action     string    `json:"action"`
+	LocalPath  string    `json:"localPath"`
+	RemotePath string    `json:"remotePath"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256,omitempty"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+func openAuditLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+// audit records a transfer of the file at localPath and remotePath. size
+// is used when the local copy cannot tell it, e.g. after a failed download.
+func (r *syncRun) audit(action, localPath, remotePath string, size int64, err error) {
+	if r.auditLog == nil {
+		return
+	}
+	record := r.auditRecord(action, localPath, remotePath, size, err)
+	record.Reason = r.reason
+	if err == nil && r.config.direction() != "relay" {
+		if info, err := os.Stat(localPath); err == nil {
+			record.Size = info.Size()
+		}
+		if sum, err := r.localSHA256(localPath); err == nil {
+			record.SHA256 = sum
+		} else {
+			r.warnln("Failed to hash", localPath, "for the audit log:", err)
+		}
+	}
+	r.writeAudit(record)
+}
+
+// auditRemoval records the deletion of the source copy of a moved file,
+// whose copies both had the SHA-256 sum.
+func (r *syncRun) auditRemoval(localPath, remotePath string, size int64, sum string, err error) {
+	if r.auditLog == nil {
+		return
+	}
+	record := r.auditRecord("remove-source", localPath, remotePath, size, err)
+	record.SHA256, record.Reason = sum, "moved, checksums match"
+	r.writeAudit(record)
+}
+
+func (r *syncRun) auditRecord(action, localPath, remotePath string, size int64, err error) auditRecord {
+	record := auditRecord{
+		Time:       time.Now(),
+		Config:     r.config.Key(),
+		Direction:  r.config.direction(),
+		Action:     action,
+		LocalPath:  localPath,
+		RemotePath: remotePath,
+		Size:       size,
+		Result:     "ok",
+	}
+	if err != nil {
+		record.Result, record.Error = "failed", err.Error()
+	}
+	return record
+}
+
+func (r *syncRun) writeAudit(record auditRecord) {
+	line, err := json.Marshal(record)
+	if err == nil {
+		_, err = r.auditLog.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = r.auditLog.Sync()
+	}
+	if err != nil {
+		r.errorln("Failed to write audit log:", err)
+	}
+}
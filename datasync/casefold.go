@@ -0,0 +1,108 @@
+package datasync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A remote directory may hold entries whose names differ only in case,
+// such as Report.txt and report.txt, which a case-insensitive local file
+// system stores as one file. Of each such group the first name in byte
+// order is pulled as usual, and the others are handled by CaseCollisions.
+
+func (c Config) validateCaseCollisions() error {
+	switch c.CaseCollisions {
+	case "", "error", "skip", "rename":
+	default:
+		return fmt.Errorf("invalid caseCollisions: %s", c.CaseCollisions)
+	}
+	if c.CaseCollisions != "" && c.direction() != "pull" {
+		return fmt.Errorf("caseCollisions requires action pull or move-pull")
+	}
+	return nil
+}
+
+// caseCollisions returns the local names of the remote entries of localDir
+// that collide with another one by case. An empty name means the entry is
+// not pulled. It returns nil if there are no collisions, or the local file
+// system tells the names apart.
+func (r *syncRun) caseCollisions(localDir, remoteDir string, remoteFiles []os.FileInfo) map[string]string {
+	groups := make(map[string][]os.FileInfo)
+	taken := make(map[string]bool)
+	for _, file := range remoteFiles {
+		name := strings.ToLower(r.plainName(file.Name(), file.IsDir()))
+		groups[name] = append(groups[name], file)
+		taken[name] = true
+	}
+	var collisions [][]os.FileInfo
+	for _, group := range groups {
+		if len(group) > 1 {
+			collisions = append(collisions, group)
+		}
+	}
+	if len(collisions) == 0 || !caseInsensitive(localDir) {
+		return nil
+	}
+
+	names := make(map[string]string)
+	for _, group := range collisions {
+		sort.Slice(group, func(i, j int) bool { return group[i].Name() < group[j].Name() })
+		kept := r.plainName(group[0].Name(), group[0].IsDir())
+		for _, file := range group[1:] {
+			remoteFilePath := remoteJoin(remoteDir, file.Name())
+			switch r.config.CaseCollisions {
+			case "skip":
+				r.warnln("Skipping", remoteFilePath, ": its name differs only in case from", kept)
+				r.skip(remoteFilePath, "case collision")
+				names[file.Name()] = ""
+			case "rename":
+				name := uniqueCaseName(r.plainName(file.Name(), file.IsDir()), taken)
+				r.warnln("Pulling", remoteFilePath, "as", name, ": its name differs only in case from", kept)
+				names[file.Name()] = name
+			default:
+				err := fmt.Errorf("%s differs only in case from %s, which the local file system cannot tell apart", remoteFilePath, kept)
+				r.errorln("Skipping", remoteFilePath, ":", err)
+				r.fail(remoteFilePath, err)
+				names[file.Name()] = ""
+			}
+		}
+	}
+	return names
+}
+
+// uniqueCaseName appends ~1, ~2 and so on to the stem of name until it does
+// not collide with any name in taken, and adds it there.
+func uniqueCaseName(name string, taken map[string]bool) string {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := stem + "~" + strconv.Itoa(i) + ext
+		if !taken[strings.ToLower(candidate)] {
+			taken[strings.ToLower(candidate)] = true
+			return candidate
+		}
+	}
+}
+
+// caseInsensitive reports whether the file system holding dir treats names
+// differing only in case as the same file. It probes dir with a temporary
+// file, and guesses from the OS if that is not possible.
+func caseInsensitive(dir string) bool {
+	probe, err := os.CreateTemp(dir, ".datasync-case-")
+	if err != nil {
+		return runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+	info, err := os.Stat(probe.Name())
+	if err != nil {
+		return false
+	}
+	upper, err := os.Stat(filepath.Join(dir, strings.ToUpper(filepath.Base(probe.Name()))))
+	return err == nil && os.SameFile(info, upper)
+}
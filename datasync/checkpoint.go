@@ -0,0 +1,144 @@
+package datasync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// With Syncer.CheckpointDir a SyncRange records every date that each
+// directory pair synced without failures in a checkpoint file of its own,
+// one per config and range, so that syncing the same range again, after an
+// interrupted or partly failed run, goes on with the remaining dates. The
+// file is removed once the whole range completed.
+
+// rangeCheckpoint is the checkpoint file of a config and date range.
+type rangeCheckpoint struct {
+	Config    string `json:"config"`
+	StartDate string `json:"startDate"`
+	EndDate   string `json:"endDate"`
+	// Done lists the completed dates by directory pair.
+	Done map[string][]string `json:"done"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// loadCheckpoint opens the checkpoint of the range, which is empty when no
+// earlier run left one.
+func (r *syncRun) loadCheckpoint(startDate, endDate string) (*rangeCheckpoint, error) {
+	key := sha256.Sum256([]byte(r.config.Key() + "\x00" + startDate + "\x00" + endDate))
+	c := &rangeCheckpoint{
+		Config:    r.config.Key(),
+		StartDate: startDate,
+		EndDate:   endDate,
+		Done:      make(map[string][]string),
+		path:      filepath.Join(r.syncer.CheckpointDir, hex.EncodeToString(key[:8])+".json"),
+	}
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if c.Done == nil {
+		c.Done = make(map[string][]string)
+	}
+	return c, nil
+}
+
+// pairKey names the current directory pair in the checkpoint.
+func (r *syncRun) pairKey() string {
+	return r.config.LocalDir + " <-> " + r.config.RemoteDir
+}
+
+// checkpointed reports whether an earlier run of the range completed date
+// for the current pair, and so it is to be skipped.
+func (r *syncRun) checkpointed(date string) bool {
+	if r.checkpoint == nil || r.force() {
+		return false
+	}
+	r.checkpoint.mu.Lock()
+	done := slices.Contains(r.checkpoint.Done[r.pairKey()], date)
+	r.checkpoint.mu.Unlock()
+	if done {
+		r.infoln("Skipping date", date, ": already done by an earlier run of this range")
+	}
+	return done
+}
+
+// markDone records date as completed for the current pair.
+func (r *syncRun) markDone(date string) {
+	if r.checkpoint == nil || r.dryRun() {
+		return
+	}
+	c := r.checkpoint
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := r.pairKey()
+	if !slices.Contains(c.Done[key], date) {
+		c.Done[key] = append(c.Done[key], date)
+		slices.Sort(c.Done[key])
+	}
+	if err := c.save(); err != nil {
+		r.warnln("Failed to save the checkpoint of the date range:", err)
+	}
+}
+
+// save atomically replaces the checkpoint file. c.mu must be held.
+func (c *rangeCheckpoint) save() error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// finishCheckpoint removes the checkpoint once every date of the range has
+// been synced or was done before.
+func (r *syncRun) finishCheckpoint() {
+	if r.checkpoint == nil || r.dryRun() || r.failed > 0 || r.ctx.Err() != nil {
+		return
+	}
+	for _, date := range r.dates {
+		if !date.Synced && !date.Resumed {
+			return
+		}
+	}
+	if err := os.Remove(r.checkpoint.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		r.warnln("Failed to remove the checkpoint of the date range:", err)
+	}
+}
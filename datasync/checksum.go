@@ -0,0 +1,113 @@
+package datasync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The checksum cache remembers the SHA-256 of every file hashed together
+// with its size and ModTime, so a file whose metadata is unchanged is not
+// read again. Like the state DB it is only a cache.
+
+const checksumCacheName = "checksums.db"
+
+var checksumBucket = []byte("sha256")
+
+func (r *syncRun) openChecksumCache() {
+	if r.config.CacheDir == "" || r.dryRun() {
+		return
+	}
+	db, err := openStateDB(filepath.Join(r.config.CacheDir, checksumCacheName))
+	if err != nil {
+		r.errorln("Failed to open checksum cache, hashing every file:", err)
+		return
+	}
+	r.checksumDB = db
+}
+
+// localSHA256 returns the hash of a local file, from the cache when its
+// size and ModTime are unchanged.
+func (r *syncRun) localSHA256(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return r.cachedSHA256("local "+path, info, func() (string, error) {
+		return fileSHA256(path)
+	})
+}
+
+// remoteSHA256 returns the hash of a remote file, from the cache when its
+// size and ModTime are unchanged.
+func (r *syncRun) remoteSHA256(path string) (string, error) {
+	info, err := r.client.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return r.cachedSHA256("remote "+r.config.remoteHost()+":"+path, info, func() (string, error) {
+		return r.hashRemoteFile(path)
+	})
+}
+
+func (r *syncRun) cachedSHA256(key string, info os.FileInfo, hash func() (string, error)) (string, error) {
+	if r.checksumDB == nil {
+		return hash()
+	}
+	state := fileStateOf(info).encode()
+
+	var cached string
+	r.checksumDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(checksumBucket)
+		if bucket == nil {
+			return nil
+		}
+		if value := bucket.Get([]byte(key)); len(value) == len(state)+sha256.Size && bytes.Equal(value[:len(state)], state) {
+			cached = hex.EncodeToString(value[len(state):])
+		}
+		return nil
+	})
+	if cached != "" {
+		return cached, nil
+	}
+
+	sum, err := hash()
+	if err != nil {
+		return "", err
+	}
+	raw, err := hex.DecodeString(sum)
+	if err != nil {
+		return sum, nil
+	}
+	err = r.checksumDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(checksumBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), append(state, raw...))
+	})
+	if err != nil {
+		r.errorln("Failed to update checksum cache:", err)
+	}
+	return sum, nil
+}
+
+func (r *syncRun) hashRemoteFile(remoteFilePath string) (string, error) {
+	remoteFile, err := r.client.Open(remoteFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer remoteFile.Close()
+
+	ctx, cancel := r.fileContext()
+	defer cancel()
+	hash := sha256.New()
+	if _, err := copyFile(ctx, hash, remoteFile, remoteFile, r.copyOptions()); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
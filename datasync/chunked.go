@@ -0,0 +1,109 @@
+package datasync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// With FileChunkConcurrency a remote file of at least FileChunkMinSize
+// bytes is split into that many byte ranges, which are downloaded at once
+// over the same connection and written to their offsets in the part file.
+// This fills long-latency links that a single stream cannot.
+
+const defaultFileChunkMinSize = 64 << 20
+
+// chunkBufferSize is the size of each range's reads. Large reads let the
+// SFTP client keep several requests in flight per range.
+const chunkBufferSize = 1 << 20
+
+// chunkedFile is implemented by remote files that can be read at offsets.
+type chunkedFile interface {
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+func (c Config) validateChunks() error {
+	if c.FileChunkConcurrency < 0 {
+		return fmt.Errorf("fileChunkConcurrency must not be negative")
+	}
+	if c.FileChunkMinSize < 0 {
+		return fmt.Errorf("fileChunkMinSize must not be negative")
+	}
+	if c.FileChunkConcurrency > 1 && c.direction() != "pull" {
+		return fmt.Errorf("fileChunkConcurrency requires action pull or move-pull")
+	}
+	return nil
+}
+
+// chunks returns remoteFile and its size if it is downloaded in ranges.
+// Encrypted and sparse downloads are written front to back, so they never
+// are.
+func (r *syncRun) chunks(remoteFile io.Reader, remoteFilePath string) (chunkedFile, int64, bool) {
+	if r.config.FileChunkConcurrency <= 1 || r.decrypts(remoteFilePath) || r.compressedRemote(remoteFilePath) || r.config.PreserveSparse {
+		return nil, 0, false
+	}
+	file, ok := remoteFile.(chunkedFile)
+	if !ok {
+		return nil, 0, false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, false
+	}
+	minSize := r.config.FileChunkMinSize
+	if minSize == 0 {
+		minSize = defaultFileChunkMinSize
+	}
+	if info.Size() < minSize {
+		return nil, 0, false
+	}
+	return file, info.Size(), true
+}
+
+// copyChunks copies size bytes of src to dst in streams ranges at once.
+// The per-file limit of opts applies to all ranges together. Cancellation,
+// or the first failed range, closes the remote file to stop the others.
+func copyChunks(ctx context.Context, dst io.WriterAt, src io.ReaderAt, size int64, remoteFile io.Closer, opts copyOptions, streams int) (int64, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stop := context.AfterFunc(ctx, func() {
+		remoteFile.Close()
+	})
+	defer stop()
+
+	var limiter *rateLimiter
+	if opts.maxBytesPerSec > 0 {
+		limiter = &rateLimiter{limit: opts.maxBytesPerSec}
+	}
+	chunk := (size + int64(streams) - 1) / int64(streams)
+	var written atomic.Int64
+	var wg sync.WaitGroup
+	for start := int64(0); start < size; start += chunk {
+		length := min(chunk, size-start)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var r io.Reader = io.NewSectionReader(src, start, length)
+			if limiter != nil {
+				r = &sharedThrottledReader{ctx: ctx, r: r, limiter: limiter}
+			}
+			if opts.shared != nil {
+				r = &sharedThrottledReader{ctx: ctx, r: r, limiter: opts.shared}
+			}
+			n, err := io.CopyBuffer(io.NewOffsetWriter(dst, start), r, make([]byte, chunkBufferSize))
+			written.Add(n)
+			if err == nil && n < length {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				cancel(err)
+			}
+		}()
+	}
+	wg.Wait()
+	return written.Load(), context.Cause(ctx)
+}
@@ -0,0 +1,94 @@
+package datasync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Client is the remote side of a sync. The SFTP connection implements it,
+// and tests or embedders can substitute their own implementation through
+// Syncer.Connect.
+type Client interface {
+	ReadDir(path string) ([]os.FileInfo, error)
+	Stat(path string) (os.FileInfo, error)
+	Open(path string) (io.ReadCloser, error)
+	Create(path string) (io.WriteCloser, error)
+	MkdirAll(path string) error
+	Remove(path string) error
+	Close() error
+}
+
+// modTimeClient is implemented by Clients that may be unable to tell
+// modification times, such as FTP servers without MLST or MDTM.
+type modTimeClient interface {
+	SupportsModTime() bool
+}
+
+// ConnectError wraps the error of a sync that could not connect to a
+// server, as opposed to one that failed on single files.
+type ConnectError struct {
+	Err error
+}
+
+func (e *ConnectError) Error() string { return e.Err.Error() }
+func (e *ConnectError) Unwrap() error { return e.Err }
+
+func (s *Syncer) connect(ctx context.Context, config Config) (Client, error) {
+	client, err := s.dial(ctx, config)
+	if err != nil {
+		return nil, &ConnectError{Err: err}
+	}
+	if config.ReadOnlyRemote {
+		return readOnlyClient{client}, nil
+	}
+	return client, nil
+}
+
+func (s *Syncer) dial(ctx context.Context, config Config) (Client, error) {
+	if s.Connect != nil {
+		return s.Connect(ctx, config)
+	}
+	switch config.protocol() {
+	case "local":
+		return localClient{}, nil
+	case "ftp", "ftps":
+		return s.connectToFTPServer(ctx, config)
+	case "s3":
+		return connectToS3(ctx, config)
+	}
+	return s.connectToSFTPServer(ctx, config)
+}
+
+// CheckConnection connects to the remote side of config and checks that
+// its remote directories exist, without syncing anything. A relay also
+// connects to its destination.
+func (s *Syncer) CheckConnection(ctx context.Context, config Config) error {
+	config, err := config.ResolvePaths(time.Now())
+	if err != nil {
+		return err
+	}
+	client, err := s.connect(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	for _, pair := range config.DirPairs() {
+		if hasGlob(pair.RemoteDir) {
+			continue
+		}
+		if _, err := client.Stat(pair.RemoteDir); err != nil {
+			return fmt.Errorf("remote directory %s: %w", pair.RemoteDir, err)
+		}
+	}
+	if config.direction() == "relay" {
+		dest, err := s.connect(ctx, config.destinationConfig())
+		if err != nil {
+			return fmt.Errorf("destination: %w", err)
+		}
+		dest.Close()
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package datasync
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// With MaxClockSkew every sync first writes a probe file to the remote
+// directory and compares the ModTime the server gives it with the local
+// clock, since a skewed clock makes ModTime comparisons re-transfer files
+// over and over or miss updates. The server's timestamps may be truncated
+// to seconds, so the measurement is only accurate to about a second.
+
+func (c Config) validateClockSkew() error {
+	if c.MaxClockSkew < 0 {
+		return fmt.Errorf("maxClockSkew must not be negative")
+	}
+	if c.MaxClockSkew > 0 && c.direction() == "relay" {
+		return fmt.Errorf("maxClockSkew is not supported for action relay")
+	}
+	switch c.OnClockSkew {
+	case "", "warn", "abort", "size", "checksum":
+	default:
+		return fmt.Errorf("invalid onClockSkew: %s", c.OnClockSkew)
+	}
+	if c.OnClockSkew != "" && c.MaxClockSkew == 0 {
+		return fmt.Errorf("onClockSkew requires maxClockSkew")
+	}
+	return nil
+}
+
+// checkClockSkew measures the skew of the server's clock in remoteDir and
+// acts on it as OnClockSkew says. It returns false when the sync is to be
+// skipped.
+func (r *syncRun) checkClockSkew(remoteDir string) bool {
+	if r.config.MaxClockSkew <= 0 || r.config.protocol() == "local" {
+		return true
+	}
+	if c, ok := clientAs[modTimeClient](r.client); ok && !c.SupportsModTime() {
+		return true
+	}
+	// A push creates its remote directory anyway.
+	if r.config.direction() == "push" && !r.dryRun() {
+		r.mkdirRemote(r.client, remoteDir)
+	}
+	skew, err := r.measureClockSkew(remoteDir)
+	if err != nil {
+		r.warnln("Failed to check the clock of", r.config.remoteHost(), ":", err)
+		return true
+	}
+	r.debugf("clock of %s differs from the local one by %s", r.config.remoteHost(), skew)
+	if skew.Abs() <= time.Duration(r.config.MaxClockSkew) {
+		return true
+	}
+	side := "ahead of"
+	if skew < 0 {
+		side, skew = "behind", -skew
+	}
+	msg := fmt.Sprintf("the clock of %s is %s %s the local clock, more than maxClockSkew %s",
+		r.config.remoteHost(), skew.Round(time.Second), side, time.Duration(r.config.MaxClockSkew))
+	switch r.config.OnClockSkew {
+	case "abort":
+		err := fmt.Errorf("skipping sync: %s", msg)
+		r.errorln(err)
+		r.fail("", err)
+		return false
+	case "size", "checksum":
+		r.warnln(fmt.Sprintf("Clock skew detected, comparing files by %s: %s", r.config.OnClockSkew, msg))
+		r.clockSkewMode = r.config.OnClockSkew
+	default:
+		r.warnln("Clock skew detected:", msg)
+	}
+	return true
+}
+
+// measureClockSkew returns how far the server's clock is ahead of the local
+// one, judged by a probe file it creates and removes in remoteDir.
+func (r *syncRun) measureClockSkew(remoteDir string) (time.Duration, error) {
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	probe := remoteJoin(remoteDir, ".datasync-clock-"+hex.EncodeToString(suffix[:]))
+
+	before := time.Now()
+	w, err := r.client.Create(probe)
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write([]byte("clock probe\n"))
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	after := time.Now()
+	defer r.client.Remove(probe)
+	if err != nil {
+		return 0, err
+	}
+	info, err := r.client.Stat(probe)
+	if err != nil {
+		return 0, err
+	}
+	local := before.Add(after.Sub(before) / 2)
+	return info.ModTime().Sub(local), nil
+}
@@ -0,0 +1,98 @@
+package datasync
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With StoreCompressed a push gzips every file on the way and stores it
+// under its name plus compressedSuffix, and a pull of a file carrying the
+// suffix gunzips it into its plain name, so that the files take less space
+// where they are kept. As with encryption, only modification times can
+// compare the two copies, and VerifyChecksum hashes the uncompressed
+// contents of the remote copy.
+
+const compressedSuffix = ".gz"
+
+func (c Config) validateCompression() error {
+	if !c.StoreCompressed {
+		return nil
+	}
+	switch {
+	case c.direction() == "relay":
+		return fmt.Errorf("storeCompressed is not supported for action relay")
+	case c.archiveMode() != "":
+		return fmt.Errorf("storeCompressed cannot be combined with archiveMode")
+	case c.EncryptUploads || c.DecryptionKeyPath != "":
+		return fmt.Errorf("storeCompressed cannot be combined with encryption")
+	case c.CompareMode == "size" || c.CompareMode == "checksum":
+		return fmt.Errorf("compareMode %s cannot compare compressed files", c.CompareMode)
+	case c.ConflictPolicy == "larger":
+		return fmt.Errorf("conflictPolicy larger cannot compare compressed files")
+	case c.UseManifest:
+		return fmt.Errorf("useManifest cannot be combined with storeCompressed")
+	case c.DeltaTransfer:
+		return fmt.Errorf("deltaTransfer cannot be combined with storeCompressed")
+	case c.UseRemoteHash:
+		return fmt.Errorf("useRemoteHash cannot be combined with storeCompressed")
+	}
+	return nil
+}
+
+// compressedRemote reports whether the remote file is stored compressed.
+func (r *syncRun) compressedRemote(remotePath string) bool {
+	return r.config.StoreCompressed && strings.HasSuffix(remotePath, compressedSuffix)
+}
+
+// resized reports whether one side of a transfer holds an encrypted or
+// compressed copy of the other, so their sizes cannot be compared.
+func (r *syncRun) resized(srcPath string) bool {
+	if r.config.StoreCompressed && (r.config.direction() == "push" || r.compressedRemote(srcPath)) {
+		return true
+	}
+	return r.encrypted(srcPath)
+}
+
+// compressTo returns a writer gzipping what is written to it into w. It
+// must be closed before w to write out the end of the stream.
+func (r *syncRun) compressTo(w io.Writer, localFilePath string) (io.WriteCloser, error) {
+	info, err := os.Stat(localFilePath)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(w)
+	gz.Name = filepath.Base(localFilePath)
+	gz.ModTime = info.ModTime()
+	return gz, nil
+}
+
+// hashRemoteContent returns the SHA-256 of the contents of the remote
+// file, uncompressed if it is stored compressed.
+func (r *syncRun) hashRemoteContent(remoteFilePath string) (string, error) {
+	if !r.compressedRemote(remoteFilePath) {
+		return r.hashRemoteFile(remoteFilePath)
+	}
+	remoteFile, err := r.client.Open(remoteFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer remoteFile.Close()
+	gz, err := gzip.NewReader(remoteFile)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := r.fileContext()
+	defer cancel()
+	hash := sha256.New()
+	if _, err := copyFile(ctx, hash, gz, remoteFile, r.copyOptions()); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
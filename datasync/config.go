@@ -0,0 +1,432 @@
+package datasync
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Config describes one sync task: which directories to keep in sync, in
+// which direction, and over which SFTP connection.
+type Config struct {
+	Name      string `json:"name"`
+	SSHHost   string `json:"sshHost"`
+	SSHPort   int    `json:"sshPort"`
+	User      string `json:"user"`
+	Password  string `json:"password"`
+	LocalDir  string `json:"localDir"`
+	RemoteDir string `json:"remoteDir"`
+	Cron      string `json:"cron"`
+	Action    string `json:"action"`
+
+	Protocol           string   `json:"protocol"`
+	FallbackHosts      []string `json:"fallbackHosts"`
+	HTTPProxy          string   `json:"httpProxy"`
+	Bucket             string   `json:"bucket"`
+	Region             string   `json:"region"`
+	AccessKey          string   `json:"accessKey"`
+	SecretKey          string   `json:"secretKey"`
+	PrivateKeyPath     string   `json:"privateKeyPath"`
+	CredentialsRef     string   `json:"credentialsRef"`
+	LocalDirs          []string `json:"localDirs"`
+	RemoteDirs         []string `json:"remoteDirs"`
+	Env                string   `json:"env"`
+	LogLevel           string   `json:"logLevel"`
+	QuietTransfers     bool     `json:"quietTransfers"`
+	AbortOnError       bool     `json:"abortOnError"`
+	SkipLocked         bool     `json:"skipLocked"`
+	UseManifest        bool     `json:"useManifest"`
+	StateDBPath        string   `json:"stateDBPath"`
+	CacheDir           string   `json:"cacheDir"`
+	UseRemoteHash      bool     `json:"useRemoteHash"`
+	TempDir            string   `json:"tempDir"`
+	FileTimeout        int      `json:"fileTimeout"`
+	DialRetries        int      `json:"dialRetries"`
+	DialRetryBackoff   Duration `json:"dialRetryBackoff"`
+	DialRetryJitter    float64  `json:"dialRetryJitter"`
+	MaxDepth           int      `json:"maxDepth"`
+	WalkConcurrency    int      `json:"walkConcurrency"`
+	RecursiveList      bool     `json:"recursiveList"`
+	Dedup              bool     `json:"dedup"`
+	DeltaTransfer      bool     `json:"deltaTransfer"`
+	ArchiveMode        string   `json:"archiveMode"`
+	EncryptUploads     bool     `json:"encryptUploads"`
+	RecipientKeyPath   string   `json:"recipientKeyPath"`
+	DecryptionKeyPath  string   `json:"decryptionKeyPath"`
+	KeyPassphrase      string   `json:"keyPassphrase"`
+	PreserveOwnership  bool     `json:"preserveOwnership"`
+	PreserveSparse     bool     `json:"preserveSparse"`
+	PreserveXattrs     bool     `json:"preserveXattrs"`
+	CaseCollisions     string   `json:"caseCollisions"`
+	VerifyAfterPush    bool     `json:"verifyAfterPush"`
+	VerifyChecksum     bool     `json:"verifyChecksum"`
+	AuditLog           string   `json:"auditLog"`
+	MinSize            int64    `json:"minSize"`
+	MaxSize            int64    `json:"maxSize"`
+	MinAge             Duration `json:"minAge"`
+	MaxAge             Duration `json:"maxAge"`
+	StabilizeDelay     Duration `json:"stabilizeDelay"`
+	AllowExtensions    []string `json:"allowExtensions"`
+	DenyExtensions     []string `json:"denyExtensions"`
+	HostKeyFingerprint string   `json:"hostKeyFingerprint"`
+	Ciphers            []string `json:"ciphers"`
+	KeyExchanges       []string `json:"keyExchanges"`
+	MACs               []string `json:"macs"`
+	CACertPath         string   `json:"caCertPath"`
+	InsecureSkipVerify bool     `json:"insecureSkipVerify"`
+	RemoveEmptyDirs    bool     `json:"removeEmptyDirs"`
+	RetentionDays      int      `json:"retentionDays"`
+	SourceRetention    Duration `json:"sourceRetention"`
+	DryRun             bool     `json:"dryRun"`
+	DateLayout         string   `json:"dateLayout"`
+	PreCommand         string   `json:"preCommand"`
+	PostCommand        string   `json:"postCommand"`
+	HookTimeout        int      `json:"hookTimeout"`
+	PostProcessCommand string   `json:"postProcessCommand"`
+	PostProcessGlob    string   `json:"postProcessGlob"`
+	PostProcessOutput  bool     `json:"postProcessOutput"`
+	PostProcessTimeout int      `json:"postProcessTimeout"`
+	AbortOnPreFailure  bool     `json:"abortOnPreFailure"`
+	ConflictPolicy     string   `json:"conflictPolicy"`
+	NoClobber          bool     `json:"noClobber"`
+	ReadOnlyRemote     bool     `json:"readOnlyRemote"`
+	VersionedPull      bool     `json:"versionedPull"`
+	MaxVersions        int      `json:"maxVersions"`
+	ZeroBytePolicy     string   `json:"zeroBytePolicy"`
+	TypeMismatchPolicy string   `json:"typeMismatchPolicy"`
+	Force              bool     `json:"force"`
+	CompareMode        string   `json:"compareMode"`
+	MaxBytesPerSec     int64    `json:"maxBytesPerSec"`
+	BufferSize         int      `json:"bufferSize"`
+	ConcurrentRequests int      `json:"concurrentRequests"`
+	MaxPacketSize      int      `json:"maxPacketSize"`
+	AbortOnLowSpace    bool     `json:"abortOnLowSpace"`
+	MinFreeInodes      int64    `json:"minFreeInodes"`
+	MaxFilesPerRun     int      `json:"maxFilesPerRun"`
+	MaxDeniedFraction  float64  `json:"maxDeniedFraction"`
+	WatchLocal         bool     `json:"watchLocal"`
+	WatchDelay         Duration `json:"watchDelay"`
+	MaxClockSkew       Duration `json:"maxClockSkew"`
+	OnClockSkew        string   `json:"onClockSkew"`
+	MaxRunDuration     Duration `json:"maxRunDuration"`
+	MaxErrors          int      `json:"maxErrors"`
+	SkipInFlight       bool     `json:"skipInFlight"`
+	StoreCompressed    bool     `json:"storeCompressed"`
+	TracingEndpoint    string   `json:"tracingEndpoint"`
+	TraversalOrder     string   `json:"traversalOrder"`
+
+	MinFreeSpace FreeSpace `json:"minFreeSpace"`
+	DirMode      FileMode  `json:"dirMode"`
+
+	// FileChunkConcurrency downloads files of at least FileChunkMinSize
+	// bytes in that many byte ranges at once.
+	FileChunkConcurrency int   `json:"fileChunkConcurrency"`
+	FileChunkMinSize     int64 `json:"fileChunkMinSize"`
+
+	// ScheduleJitter delays every scheduled run by a random duration up to
+	// this long.
+	ScheduleJitter Duration `json:"scheduleJitter"`
+
+	// IncludeHidden is a pointer so that leaving it out keeps the default
+	// of true.
+	IncludeHidden *bool `json:"includeHidden"`
+
+	// Enabled is a pointer for the same reason; see Disabled.
+	Enabled *bool `json:"enabled"`
+
+	BandwidthSchedule []BandwidthWindow `json:"bandwidthSchedule"`
+
+	// Destination is the server Action "relay" copies to.
+	Destination Endpoint `json:"destination"`
+}
+
+// Key identifies the config in logs and persisted state: its Name when set,
+// otherwise a description of what it syncs.
+func (c Config) Key() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	remoteDir := c.RemoteDir
+	if remoteDir == "" && len(c.RemoteDirs) > 0 {
+		remoteDir = c.RemoteDirs[0]
+	}
+	return fmt.Sprintf("%s %s:%s", c.Action, c.remoteHost(), remoteDir)
+}
+
+// Disabled reports whether the config has been switched off with
+// "enabled": false, and is to be skipped instead of synced.
+func (c Config) Disabled() bool {
+	return c.Enabled != nil && !*c.Enabled
+}
+
+// remoteHost names the remote side in logs and cache keys.
+func (c Config) remoteHost() string {
+	if c.protocol() == "s3" {
+		return "s3://" + c.Bucket
+	}
+	return c.SSHHost
+}
+
+// Validate reports settings that would make every sync of the config fail.
+func (c Config) Validate() error {
+	switch c.protocol() {
+	case "sftp", "ftp", "ftps":
+		if c.SSHHost == "" {
+			return fmt.Errorf("sshHost is required")
+		}
+	case "s3":
+		if c.Bucket == "" {
+			return fmt.Errorf("bucket is required for protocol s3")
+		}
+	case "local":
+	default:
+		return fmt.Errorf("invalid protocol: %s", c.Protocol)
+	}
+	if (c.LocalDir == "") != (c.RemoteDir == "") {
+		return fmt.Errorf("localDir and remoteDir must be set together")
+	}
+	if len(c.LocalDirs) != len(c.RemoteDirs) {
+		return fmt.Errorf("localDirs and remoteDirs must have the same length")
+	}
+	for i := range c.LocalDirs {
+		if c.LocalDirs[i] == "" || c.RemoteDirs[i] == "" {
+			return fmt.Errorf("localDirs and remoteDirs entry %d is empty", i)
+		}
+	}
+	for _, pair := range c.DirPairs() {
+		if hasGlob(pair.RemoteDir) && c.direction() != "pull" {
+			return fmt.Errorf("a glob in remoteDir is only supported for pull")
+		}
+	}
+	if len(c.DirPairs()) == 0 {
+		return fmt.Errorf("localDir and remoteDir, or localDirs and remoteDirs, are required")
+	}
+	switch c.Action {
+	case "pull", "push", "move-pull", "move-push":
+	case "relay":
+		if err := c.validateRelay(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid action: %s", c.Action)
+	}
+	if _, ok := logLevels[c.LogLevel]; c.LogLevel != "" && !ok {
+		return fmt.Errorf("invalid logLevel: %s", c.LogLevel)
+	}
+	switch c.ConflictPolicy {
+	case "", "newer", "larger", "always", "never":
+	default:
+		return fmt.Errorf("invalid conflictPolicy: %s", c.ConflictPolicy)
+	}
+	switch c.ZeroBytePolicy {
+	case "", "transfer", "skip", "skip-if-destination-nonempty":
+	default:
+		return fmt.Errorf("invalid zeroBytePolicy: %s", c.ZeroBytePolicy)
+	}
+	switch c.TypeMismatchPolicy {
+	case "", "error", "skip", "replace":
+	default:
+		return fmt.Errorf("invalid typeMismatchPolicy: %s", c.TypeMismatchPolicy)
+	}
+	switch c.CompareMode {
+	case "", "modtime", "size", "modtime+size", "checksum":
+	default:
+		return fmt.Errorf("invalid compareMode: %s", c.CompareMode)
+	}
+	for i, window := range c.BandwidthSchedule {
+		if err := window.validate(); err != nil {
+			return fmt.Errorf("bandwidthSchedule %d: %w", i, err)
+		}
+	}
+	if c.Dedup && (c.direction() != "pull" || c.StateDBPath == "") {
+		return fmt.Errorf("dedup requires action pull or move-pull and a stateDBPath")
+	}
+	if c.PreserveXattrs && (c.protocol() != "local" || c.direction() == "relay") {
+		return fmt.Errorf("preserveXattrs is only supported for protocol local")
+	}
+	if c.PreserveSparse && c.direction() != "pull" {
+		return fmt.Errorf("preserveSparse requires action pull or move-pull")
+	}
+	if c.MinFreeInodes < 0 {
+		return fmt.Errorf("minFreeInodes must not be negative")
+	}
+	if c.ScheduleJitter < 0 {
+		return fmt.Errorf("scheduleJitter must not be negative")
+	}
+	if c.StabilizeDelay < 0 {
+		return fmt.Errorf("stabilizeDelay must not be negative")
+	}
+	if c.StabilizeDelay > 0 && (c.direction() != "push" || c.archiveMode() != "") {
+		return fmt.Errorf("stabilizeDelay requires action push or move-push without archiveMode")
+	}
+	if c.MaxFilesPerRun < 0 {
+		return fmt.Errorf("maxFilesPerRun must not be negative")
+	}
+	if c.MaxRunDuration < 0 {
+		return fmt.Errorf("maxRunDuration must not be negative")
+	}
+	if c.MaxErrors < 0 {
+		return fmt.Errorf("maxErrors must not be negative")
+	}
+	if err := validateAlgorithms("cipher", c.Ciphers, sshCiphers); err != nil {
+		return err
+	}
+	if err := validateAlgorithms("key exchange", c.KeyExchanges, sshKeyExchanges); err != nil {
+		return err
+	}
+	if err := validateAlgorithms("MAC", c.MACs, sshMACs); err != nil {
+		return err
+	}
+	if len(c.FallbackHosts) > 0 && c.protocol() != "sftp" {
+		return fmt.Errorf("fallbackHosts is only supported for protocol sftp")
+	}
+	if err := c.validateProxy(); err != nil {
+		return err
+	}
+	if c.DialRetries < 0 {
+		return fmt.Errorf("dialRetries must not be negative")
+	}
+	if c.DialRetryJitter < 0 || c.DialRetryJitter > 1 {
+		return fmt.Errorf("dialRetryJitter must be between 0 and 1")
+	}
+	if c.DeltaTransfer && (c.Action != "push" || c.CacheDir == "") {
+		return fmt.Errorf("deltaTransfer requires action push and a cacheDir")
+	}
+	if err := c.validateEncryption(); err != nil {
+		return err
+	}
+	if err := c.validateCompression(); err != nil {
+		return err
+	}
+	if err := c.validateTracing(); err != nil {
+		return err
+	}
+	if err := c.validateTraversalOrder(); err != nil {
+		return err
+	}
+	if err := c.validateArchive(); err != nil {
+		return err
+	}
+	if err := c.validateCaseCollisions(); err != nil {
+		return err
+	}
+	if err := c.validateVerify(); err != nil {
+		return err
+	}
+	if err := c.validateChunks(); err != nil {
+		return err
+	}
+	if err := c.validateRemoteHash(); err != nil {
+		return err
+	}
+	if err := c.validatePostProcess(); err != nil {
+		return err
+	}
+	if err := c.validateClockSkew(); err != nil {
+		return err
+	}
+	if err := c.validateWatch(); err != nil {
+		return err
+	}
+	if err := c.validatePathTemplates(); err != nil {
+		return err
+	}
+	if err := c.validateSourceRetention(); err != nil {
+		return err
+	}
+	if c.MaxDeniedFraction < 0 || c.MaxDeniedFraction > 1 {
+		return fmt.Errorf("maxDeniedFraction must be between 0 and 1")
+	}
+	if c.WalkConcurrency < 0 {
+		return fmt.Errorf("walkConcurrency must not be negative")
+	}
+	if err := c.validatePacketSize(); err != nil {
+		return err
+	}
+	if err := c.validateRecursiveList(); err != nil {
+		return err
+	}
+	if err := c.validateReadOnlyRemote(); err != nil {
+		return err
+	}
+	if err := c.validateVersions(); err != nil {
+		return err
+	}
+	if c.NoClobber && c.ConflictPolicy != "" && c.ConflictPolicy != "never" {
+		return fmt.Errorf("noClobber conflicts with conflictPolicy %s", c.ConflictPolicy)
+	}
+	if c.DateLayout != "" {
+		ref := time.Date(2006, 1, 2, 0, 0, 0, 0, time.UTC)
+		if date, err := time.Parse(c.DateLayout, ref.Format(c.DateLayout)); err != nil || !date.Equal(ref) {
+			return fmt.Errorf("invalid dateLayout %q: it must contain the year, month and day", c.DateLayout)
+		}
+	}
+	return nil
+}
+
+// protocol returns how the remote side is reached: "sftp", "ftp", "ftps",
+// "s3" or "local".
+func (c Config) protocol() string {
+	if c.Protocol == "" {
+		return "sftp"
+	}
+	return c.Protocol
+}
+
+// dateLayout returns the time layout naming the date subfolders.
+func (c Config) dateLayout() string {
+	if c.DateLayout == "" {
+		return "2006-01-02"
+	}
+	return c.DateLayout
+}
+
+// direction returns "pull", "push" or "relay", the way files travel,
+// whether or not the action also moves them.
+func (c Config) direction() string {
+	return strings.TrimPrefix(c.Action, "move-")
+}
+
+// moves reports whether source files are deleted after a verified transfer.
+func (c Config) moves() bool {
+	return strings.HasPrefix(c.Action, "move-")
+}
+
+// conflictPolicy returns the effective ConflictPolicy, taking NoClobber
+// into account.
+func (c Config) conflictPolicy() string {
+	if c.NoClobber {
+		return "never"
+	}
+	if c.ConflictPolicy == "" {
+		return "newer"
+	}
+	return c.ConflictPolicy
+}
+
+func (c Config) compareMode() string {
+	if c.CompareMode == "" {
+		return "modtime+size"
+	}
+	return c.CompareMode
+}
+
+// DirPair is a local directory and the remote directory it is synced with.
+type DirPair struct {
+	LocalDir, RemoteDir string
+}
+
+// DirPairs returns the directory pairs the config syncs: LocalDir and
+// RemoteDir when set, followed by the entries of LocalDirs and RemoteDirs.
+func (c Config) DirPairs() []DirPair {
+	var pairs []DirPair
+	if c.LocalDir != "" && c.RemoteDir != "" {
+		pairs = append(pairs, DirPair{c.LocalDir, c.RemoteDir})
+	}
+	for i := range c.LocalDirs {
+		if i < len(c.RemoteDirs) {
+			pairs = append(pairs, DirPair{c.LocalDirs[i], c.RemoteDirs[i]})
+		}
+	}
+	return pairs
+}
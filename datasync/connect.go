@@ -0,0 +1,358 @@
+package datasync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func createSSHConfig(config Config) (*ssh.ClientConfig, error) {
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if config.HostKeyFingerprint != "" {
+		hostKeyCallback = pinnedHostKey(config.HostKeyFingerprint)
+	}
+
+	var auth []ssh.AuthMethod
+	if config.PrivateKeyPath != "" {
+		key, err := os.ReadFile(config.PrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read private key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse private key %s: %w", config.PrivateKeyPath, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if config.Password != "" || config.PrivateKeyPath == "" {
+		auth = append(auth, ssh.Password(config.Password))
+	}
+
+	return &ssh.ClientConfig{
+		Config: ssh.Config{
+			Ciphers:      config.Ciphers,
+			KeyExchanges: config.KeyExchanges,
+			MACs:         config.MACs,
+		},
+		User:            config.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// pinnedHostKey accepts only a host key whose SHA-256 fingerprint matches
+// the expected one. The "SHA256:" prefix is optional in the expected value.
+func pinnedHostKey(fingerprint string) ssh.HostKeyCallback {
+	expected := "SHA256:" + strings.TrimPrefix(strings.TrimSpace(fingerprint), "SHA256:")
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		actual := ssh.FingerprintSHA256(key)
+		if actual != expected {
+			return fmt.Errorf("host key fingerprint mismatch for %s: got %s, expected %s", hostname, actual, expected)
+		}
+		return nil
+	}
+}
+
+// connectToSSHServer opens the SSH connection, through the config's HTTP
+// proxy if there is one. With a debug logger it also logs the algorithms of
+// the handshake.
+func connectToSSHServer(c Config, host string, port int, config *ssh.ClientConfig, debug *log.Logger) (*ssh.Client, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	tcpConn, err := dialThroughProxy(c, addr, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if debug == nil {
+		conn, chans, reqs, err := ssh.NewClientConn(tcpConn, addr, config)
+		if err != nil {
+			tcpConn.Close()
+			return nil, err
+		}
+		return ssh.NewClient(conn, chans, reqs), nil
+	}
+	sniffer := &kexSniffer{Conn: tcpConn}
+	conn, chans, reqs, err := ssh.NewClientConn(sniffer, addr, config)
+	logAlgorithms(debug, host, sniffer, err)
+	if err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(conn, chans, reqs), nil
+}
+
+func createNewClinet(conn *ssh.Client, config Config) (*sftp.Client, error) {
+	// Uploads remove the remote file on any error, so the out-of-order
+	// writes of concurrent requests can never leave a bad file behind.
+	opts := []sftp.ClientOption{sftp.UseConcurrentWrites(true)}
+	if config.ConcurrentRequests > 0 {
+		opts = append(opts, sftp.MaxConcurrentRequestsPerFile(config.ConcurrentRequests))
+	}
+	if config.MaxPacketSize > 0 {
+		opts = append(opts, sftp.MaxPacketUnchecked(config.MaxPacketSize))
+	}
+	client, err := sftp.NewClient(conn, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// sftpConnection is an SFTP session together with the SSH connection it
+// runs on and the per-host connection slot it holds.
+type sftpConnection struct {
+	*sftp.Client
+	conn    *ssh.Client
+	host    string
+	release func()
+
+	checkFileMu sync.Mutex
+	checkFile   *checkFileSession
+}
+
+// Open and Create return the *sftp.File as an interface so the connection
+// satisfies Client. The returned files still implement io.WriterTo and
+// io.ReaderFrom, which keeps transfers on the pipelined SFTP code paths.
+func (c *sftpConnection) Open(path string) (io.ReadCloser, error) {
+	file, err := c.Client.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (c *sftpConnection) Create(path string) (io.WriteCloser, error) {
+	file, err := c.Client.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (c *sftpConnection) Close() error {
+	if c.checkFile != nil {
+		c.checkFile.Close()
+	}
+	err := c.Client.Close()
+	c.conn.Close()
+	c.release()
+	return err
+}
+
+// connectToSFTPServer connects to SSHHost, or when it cannot be reached,
+// to the first of FallbackHosts that can.
+func (s *Syncer) connectToSFTPServer(ctx context.Context, config Config) (*sftpConnection, error) {
+	logger := newLogger(config)
+	sshConfig, err := createSSHConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	var debug *log.Logger
+	if s.Debug || config.LogLevel == "debug" {
+		debug = logger
+	}
+
+	hosts := append([]string{config.SSHHost}, config.FallbackHosts...)
+	for i, host := range hosts {
+		release, err := s.acquireHostSlot(ctx, host, logger)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := s.dialWithRetries(ctx, config, host, func() (*ssh.Client, error) {
+			return connectToSSHServer(config, host, config.SSHPort, sshConfig, debug)
+		})
+		if err != nil {
+			release()
+			if i+1 < len(hosts) && isDialError(err) {
+				logger.Printf("%s is unreachable, trying %s: %v", host, hosts[i+1], err)
+				continue
+			}
+			return nil, err
+		}
+		if i > 0 {
+			logger.Println("Connected to fallback host", host)
+		}
+		client, err := createNewClinet(conn, config)
+		if err != nil {
+			conn.Close()
+			release()
+			return nil, err
+		}
+		return &sftpConnection{Client: client, conn: conn, host: host, release: release}, nil
+	}
+	panic("unreachable")
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// defaultDialRetryBackoff is the wait before the first dial retry when
+// DialRetries is set without DialRetryBackoff.
+const defaultDialRetryBackoff = 5 * time.Second
+
+// dialWithRetries runs dial, and while it fails because the server cannot
+// be reached, up to DialRetries more times, doubling the wait from
+// DialRetryBackoff each time. DialRetryJitter spreads each wait randomly
+// by up to that fraction of it either way, so that configs whose server
+// went away together do not all come back at the same instant. Failures
+// past the network, such as rejected logins, are returned at once.
+func (s *Syncer) dialWithRetries(ctx context.Context, config Config, host string, dial func() (*ssh.Client, error)) (*ssh.Client, error) {
+	logger := newLogger(config)
+	backoff := time.Duration(config.DialRetryBackoff)
+	if backoff <= 0 {
+		backoff = defaultDialRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		conn, err := s.dialLimited(ctx, config, dial)
+		if err == nil || !isDialError(err) {
+			return conn, err
+		}
+		if attempt == config.DialRetries {
+			if attempt == 0 {
+				return nil, err
+			}
+			return nil, fmt.Errorf("giving up on %s after %d attempts: %w", host, attempt+1, err)
+		}
+		wait := backoff
+		if jitter := config.DialRetryJitter; jitter > 0 {
+			wait = time.Duration(float64(backoff) * (1 - jitter + 2*jitter*rand.Float64())).Round(time.Millisecond)
+			logger.Printf("Dial attempt %d of %d failed, retrying in %s (%s with jitter): %v", attempt+1, config.DialRetries+1, wait, backoff, err)
+		} else {
+			logger.Printf("Dial attempt %d of %d failed, retrying in %s: %v", attempt+1, config.DialRetries+1, backoff, err)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// dialLimited runs dial once fewer than MaxConcurrentDials connection
+// attempts are in progress, and NewSessionsPerSecond allows another one.
+func (s *Syncer) dialLimited(ctx context.Context, config Config, dial func() (*ssh.Client, error)) (*ssh.Client, error) {
+	if err := s.waitNewSession(ctx, config); err != nil {
+		return nil, err
+	}
+	if s.MaxConcurrentDials <= 0 {
+		return dial()
+	}
+	s.mu.Lock()
+	if s.dialSlots == nil {
+		s.dialSlots = make(chan struct{}, s.MaxConcurrentDials)
+	}
+	slots := s.dialSlots
+	s.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		newLogger(config).Printf("Waiting for other connection attempts to finish (maxConcurrentDials %d)", cap(slots))
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	defer func() { <-slots }()
+	return dial()
+}
+
+// sessionLimiter spaces out events by interval, letting one through at
+// once when the last was longer ago.
+type sessionLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// reserve takes the next free turn and returns how long to wait for it.
+func (l *sessionLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	return wait
+}
+
+// waitNewSession blocks until NewSessionsPerSecond allows another
+// connection attempt.
+func (s *Syncer) waitNewSession(ctx context.Context, config Config) error {
+	if s.NewSessionsPerSecond <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = &sessionLimiter{interval: time.Duration(float64(time.Second) / s.NewSessionsPerSecond)}
+	}
+	limiter := s.sessions
+	s.mu.Unlock()
+
+	wait := limiter.reserve()
+	if wait <= 0 {
+		return nil
+	}
+	newLogger(config).Printf("Waiting %s before connecting (newSessionsPerSecond %g)", wait.Round(time.Millisecond), s.NewSessionsPerSecond)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// acquireHostSlot blocks until fewer than MaxConnectionsPerHost connections
+// to host are open across all configs, and returns the function releasing
+// the slot. The limit is read when a host is first connected to.
+func (s *Syncer) acquireHostSlot(ctx context.Context, host string, logger *log.Logger) (func(), error) {
+	if s.MaxConnectionsPerHost <= 0 {
+		return func() {}, nil
+	}
+
+	s.mu.Lock()
+	if s.hostSlots == nil {
+		s.hostSlots = make(map[string]chan struct{})
+	}
+	slots, ok := s.hostSlots[host]
+	if !ok {
+		slots = make(chan struct{}, s.MaxConnectionsPerHost)
+		s.hostSlots[host] = slots
+	}
+	s.mu.Unlock()
+
+	release := func() { <-slots }
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	logger.Printf("Waiting for a free connection to %s (maxConnectionsPerHost %d)", host, cap(slots))
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
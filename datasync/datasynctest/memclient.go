@@ -0,0 +1,294 @@
+// Package datasynctest provides an in-memory datasync.Client for testing
+// sync logic without an SFTP server.
+package datasynctest
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"data_sync/datasync"
+)
+
+var _ datasync.Client = (*MemClient)(nil)
+
+// MemClient is a remote filesystem held in memory. Paths are slash-separated
+// and cleaned, so "/data/" and "/data" name the same directory. The zero
+// value is an empty filesystem containing only the root directory.
+type MemClient struct {
+	// Now returns the ModTime given to files written through Create. It
+	// defaults to time.Now.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	files    map[string]*memFile
+	dirs     map[string]bool
+	failures map[string]error
+	closed   bool
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemClient returns an empty MemClient.
+func NewMemClient() *MemClient {
+	return &MemClient{}
+}
+
+func (c *MemClient) init() {
+	if c.files == nil {
+		c.files = make(map[string]*memFile)
+		c.dirs = map[string]bool{"/": true}
+		c.failures = make(map[string]error)
+	}
+}
+
+func (c *MemClient) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// WriteFile stores a file with the given content and ModTime, creating its
+// parent directories.
+func (c *MemClient) WriteFile(name string, data []byte, modTime time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	name = clean(name)
+	c.mkdirAll(path.Dir(name))
+	c.files[name] = &memFile{data: bytes.Clone(data), modTime: modTime}
+}
+
+// ReadFile returns the content of a file, and false if it does not exist.
+func (c *MemClient) ReadFile(name string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	file, ok := c.files[clean(name)]
+	if !ok {
+		return nil, false
+	}
+	return bytes.Clone(file.data), true
+}
+
+// Fail makes every later call of method op ("ReadDir", "Stat", "Open",
+// "Create", "MkdirAll" or "Remove") on name return err. A nil err removes
+// the failure again.
+func (c *MemClient) Fail(op, name string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	key := op + " " + clean(name)
+	if err == nil {
+		delete(c.failures, key)
+		return
+	}
+	c.failures[key] = err
+}
+
+// Closed reports whether Close was called.
+func (c *MemClient) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *MemClient) failure(op, name string) error {
+	return c.failures[op+" "+name]
+}
+
+func (c *MemClient) ReadDir(name string) ([]os.FileInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	name = clean(name)
+	if err := c.failure("ReadDir", name); err != nil {
+		return nil, err
+	}
+	if !c.dirs[name] {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var infos []os.FileInfo
+	for dir := range c.dirs {
+		if dir != name && path.Dir(dir) == name {
+			infos = append(infos, memFileInfo{name: path.Base(dir), dir: true})
+		}
+	}
+	for filePath, file := range c.files {
+		if path.Dir(filePath) == name {
+			infos = append(infos, memFileInfo{name: path.Base(filePath), size: int64(len(file.data)), modTime: file.modTime})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (c *MemClient) Stat(name string) (os.FileInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	name = clean(name)
+	if err := c.failure("Stat", name); err != nil {
+		return nil, err
+	}
+	if c.dirs[name] {
+		return memFileInfo{name: path.Base(name), dir: true}, nil
+	}
+	file, ok := c.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return memFileInfo{name: path.Base(name), size: int64(len(file.data)), modTime: file.modTime}, nil
+}
+
+func (c *MemClient) Open(name string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	name = clean(name)
+	if err := c.failure("Open", name); err != nil {
+		return nil, err
+	}
+	file, ok := c.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader(bytes.Clone(file.data))), nil
+}
+
+func (c *MemClient) Create(name string) (io.WriteCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	name = clean(name)
+	if err := c.failure("Create", name); err != nil {
+		return nil, err
+	}
+	if !c.dirs[path.Dir(name)] {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrNotExist}
+	}
+	c.files[name] = &memFile{modTime: c.now()}
+	return &memWriter{client: c, name: name}, nil
+}
+
+func (c *MemClient) MkdirAll(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	name = clean(name)
+	if err := c.failure("MkdirAll", name); err != nil {
+		return err
+	}
+	if _, ok := c.files[name]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	c.mkdirAll(name)
+	return nil
+}
+
+func (c *MemClient) mkdirAll(name string) {
+	for ; !c.dirs[name]; name = path.Dir(name) {
+		c.dirs[name] = true
+	}
+}
+
+func (c *MemClient) Remove(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	name = clean(name)
+	if err := c.failure("Remove", name); err != nil {
+		return err
+	}
+	if _, ok := c.files[name]; ok {
+		delete(c.files, name)
+		return nil
+	}
+	if !c.dirs[name] {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	for other := range c.dirs {
+		if other != name && strings.HasPrefix(other, name+"/") {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+		}
+	}
+	for other := range c.files {
+		if strings.HasPrefix(other, name+"/") {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+		}
+	}
+	delete(c.dirs, name)
+	return nil
+}
+
+func (c *MemClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+type memWriter struct {
+	client *MemClient
+	name   string
+	buf    bytes.Buffer
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+// Close stores the written content, so a reader never sees a partial file.
+func (w *memWriter) Close() error {
+	w.client.mu.Lock()
+	defer w.client.mu.Unlock()
+
+	if file, ok := w.client.files[w.name]; ok {
+		file.data = bytes.Clone(w.buf.Bytes())
+	}
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() any           { return nil }
+
+func (i memFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
@@ -0,0 +1,277 @@
+package datasync
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DateResult summarizes the sync of one date of a SyncRange, over all
+// directory pairs of the config.
+type DateResult struct {
+	Date    string
+	Files   int
+	Skipped int
+	Failed  int
+	Bytes   int64
+	// Synced is false for dates skipped because AbortOnError or FailFast
+	// ended the range early.
+	Synced bool
+	// Resumed is true for dates left out because the checkpoint of an
+	// earlier run has them done, for at least one directory pair.
+	Resumed bool
+}
+
+// dateOutcome is what a date of a parallel range counted, kept apart until
+// it is merged into the run in date order.
+type dateOutcome struct {
+	synced      bool
+	resumed     bool
+	stats       DirStats
+	errors      []error
+	lastErr     error
+	denied      int
+	deniedPaths []string
+	vanished    int
+}
+
+func (s *Syncer) dateConcurrency(dates int) int {
+	n := s.DateConcurrency
+	if s.MaxConnectionsPerHost > 0 && n > s.MaxConnectionsPerHost {
+		n = s.MaxConnectionsPerHost
+	}
+	if n > dates {
+		n = dates
+	}
+	return n
+}
+
+// syncDate syncs the folders of one date of the current directory pair.
+// It returns false when the run should stop because of AbortOnError.
+func (r *syncRun) syncDate(date string) bool {
+	remoteDir := remoteJoin(r.config.RemoteDir, date)
+	// A relay's LocalDir is the destination's remote directory.
+	localDir := joinSide(r.config.direction() == "relay", r.config.LocalDir, date)
+	r.infoln("Syncing Date:", date)
+	if r.pairTemplate != nil {
+		// The date goes where the templates put it instead.
+		day, _ := time.Parse(r.config.dateLayout(), date)
+		pair, err := r.config.resolvePair(*r.pairTemplate, day)
+		if err != nil {
+			r.errorln("Failed to resolve the paths of the date:", err)
+			r.fail("", err)
+			return !r.config.AbortOnError
+		}
+		localDir, remoteDir = pair.LocalDir, pair.RemoteDir
+	}
+	if err := r.createDateDir(localDir, remoteDir); err != nil {
+		r.errorln("Failed to create date folder:", err)
+		r.fail(localDir, err)
+		if r.config.AbortOnError {
+			r.errorln("Aborting remaining dates")
+			return false
+		}
+		return true
+	}
+	if err := r.syncData(localDir, remoteDir); err != nil {
+		r.errorln("Failed to sync folder:", err)
+		if r.config.AbortOnError {
+			r.errorln("Aborting remaining dates")
+			return false
+		}
+	}
+	return true
+}
+
+// dateCompleted reports whether the date just synced was gone through
+// entirely, rather than cut short by the run ending, maxFilesPerRun or maxRunDuration.
+func (r *syncRun) dateCompleted() bool {
+	return r.ctx.Err() == nil && !r.limitReached()
+}
+
+// failedFast reports whether FailFast ends the range after date, which
+// failed when failed is true.
+func (r *syncRun) failedFast(date string, failed bool) bool {
+	if !failed || !r.syncer.FailFast {
+		return false
+	}
+	r.errorln("Date", date, "failed, skipping the remaining dates")
+	return true
+}
+
+// addDateResult adds what r counted since before to the result of the
+// i-th date.
+func (r *syncRun) addDateResult(i int, before DirStats) {
+	now := r.stats()
+	d := &r.dates[i]
+	d.Synced = true
+	d.Files += now.Files - before.Files
+	d.Skipped += now.Skipped - before.Skipped
+	d.Failed += now.Failed - before.Failed
+	d.Bytes += now.Bytes - before.Bytes
+}
+
+// syncDatesParallel syncs up to Syncer.DateConcurrency dates at once. The
+// first worker uses the run's connection, the others open their own, and
+// their counts are merged into the run in date order at the end. It
+// returns false when AbortOnError stopped the range.
+func (r *syncRun) syncDatesParallel(dates []string) bool {
+	queue := make(chan int, len(dates))
+	for i := range dates {
+		queue <- i
+	}
+	close(queue)
+
+	// drained stops workers still waiting for a connection once every date
+	// has been taken, so they cannot hold up the range, for instance on a
+	// host slot the run itself occupies.
+	drained, drain := context.WithCancel(r.ctx)
+	defer drain()
+
+	outcomes := make([]dateOutcome, len(dates))
+	var aborted atomic.Bool
+	work := func(w *syncRun) {
+		for i := range queue {
+			if aborted.Load() || r.ctx.Err() != nil || w.limitReached() {
+				continue
+			}
+			if w.checkpointed(dates[i]) {
+				outcomes[i].resumed = true
+				w.dateEvents().OnDateComplete(dates[i], DirStats{}, true)
+				continue
+			}
+			before, errs, denied, deniedPaths, vanished := w.stats(), len(w.errors), w.denied, len(w.deniedPaths), w.vanished
+			w.dateEvents().OnDateStart(dates[i])
+			ok := w.syncDate(dates[i])
+			now := w.stats()
+			if now.Failed == before.Failed && w.dateCompleted() {
+				w.markDone(dates[i])
+			}
+			outcomes[i] = dateOutcome{synced: true, stats: w.statsSince(before), errors: w.errors[errs:], denied: w.denied - denied, deniedPaths: w.deniedPaths[deniedPaths:], vanished: w.vanished - vanished}
+			w.dateEvents().OnDateComplete(dates[i], outcomes[i].stats, false)
+			if now.Failed > before.Failed {
+				outcomes[i].lastErr = w.lastErr
+			}
+			if !ok || w.failedFast(dates[i], now.Failed > before.Failed) {
+				aborted.Store(true)
+			}
+		}
+		drain()
+	}
+
+	first := r.fork()
+	var wg sync.WaitGroup
+	for n := r.syncer.dateConcurrency(len(dates)); n > 1; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Waiting for a connection ends with the queue, but one that
+			// was opened lives as long as the worker.
+			connCtx, cancel := context.WithCancel(r.ctx)
+			defer cancel()
+			stop := context.AfterFunc(drained, cancel)
+			w := r.fork()
+			w.client, w.dest = nil, nil
+			err := w.connectClients(connCtx)
+			if !stop() {
+				w.closeClients()
+				return
+			}
+			if err != nil {
+				w.closeClients()
+				r.warnln("Failed to open another connection for the date range, continuing with fewer:", err)
+				return
+			}
+			defer w.closeClients()
+			work(w)
+		}()
+	}
+	work(first)
+	wg.Wait()
+	// The first worker may have reconnected.
+	r.client, r.dest = first.client, first.dest
+
+	for i, outcome := range outcomes {
+		r.files += outcome.stats.Files
+		r.skipped += outcome.stats.Skipped
+		r.bytes += outcome.stats.Bytes
+		r.failed += outcome.stats.Failed
+		for _, err := range outcome.errors {
+			if len(r.errors) < maxResultErrors {
+				r.errors = append(r.errors, err)
+			}
+		}
+		if outcome.lastErr != nil {
+			r.lastErr = outcome.lastErr
+		}
+		r.denied += outcome.denied
+		r.vanished += outcome.vanished
+		for _, path := range outcome.deniedPaths {
+			if len(r.deniedPaths) < maxResultErrors {
+				r.deniedPaths = append(r.deniedPaths, path)
+			}
+		}
+		d := &r.dates[i]
+		d.Synced = d.Synced || outcome.synced
+		d.Resumed = d.Resumed || outcome.resumed
+		d.Files += outcome.stats.Files
+		d.Skipped += outcome.stats.Skipped
+		d.Failed += outcome.stats.Failed
+		d.Bytes += outcome.stats.Bytes
+	}
+	return !aborted.Load()
+}
+
+// fork returns a run sharing r's connection, config and state but counting
+// on its own.
+func (r *syncRun) fork() *syncRun {
+	return &syncRun{
+		syncer:     r.syncer,
+		ctx:        r.ctx,
+		abort:      r.abort,
+		client:     r.client,
+		dest:       r.dest,
+		config:     r.config,
+		stateDB:    r.stateDB,
+		checksumDB: r.checksumDB,
+		logger:     r.logger,
+		multiPair:  r.multiPair,
+		limit:      r.limit,
+		metrics:    r.metrics,
+		keys:       r.keys,
+		auditLog:   r.auditLog,
+		checkpoint: r.checkpoint,
+
+		clockSkewMode: r.clockSkewMode,
+		tracer:        r.tracer,
+		span:          r.span,
+		plan:          r.plan,
+		pairTemplate:  r.pairTemplate,
+	}
+}
+
+func (r *syncRun) connectClients(ctx context.Context) error {
+	client, err := r.syncer.connect(ctx, r.config)
+	if err != nil {
+		return err
+	}
+	r.client = client
+	if r.config.direction() == "relay" {
+		dest, err := r.syncer.connect(ctx, r.config.destinationConfig())
+		if err != nil {
+			return err
+		}
+		r.dest = dest
+	}
+	return nil
+}
+
+func (r *syncRun) closeClients() {
+	if r.client != nil {
+		r.client.Close()
+	}
+	if r.dest != nil {
+		r.dest.Close()
+	}
+}
@@ -0,0 +1,90 @@
+package datasync
+
+import (
+	"encoding/hex"
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// With Dedup the state DB also maps the SHA-256 of every pulled file to the
+// first local file found with that content. Configs sharing a state DB share
+// the index, so they dedup against each other too.
+
+var dedupBucket = []byte("dedup:sha256")
+
+// dedup replaces a freshly downloaded file with a hardlink to an identical
+// file pulled before, or records it as the copy later files link to.
+func (r *syncRun) dedup(path string) {
+	if !r.config.Dedup || r.stateDB == nil {
+		return
+	}
+	sum, err := r.localSHA256(path)
+	if err != nil {
+		r.warnln("Failed to hash", path, "for dedup:", err)
+		return
+	}
+	raw, err := hex.DecodeString(sum)
+	if err != nil {
+		return
+	}
+
+	if original := r.dedupOriginal(raw); original != "" && original != path && r.sameContent(original, path, sum) {
+		if err := linkOver(original, path); err != nil {
+			r.warnln("Failed to hardlink", path, "to", original, ", keeping the copy:", err)
+			return
+		}
+		r.transferln("Linked", path, "to identical", original)
+		return
+	}
+
+	err = r.stateDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(dedupBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(raw, []byte(path))
+	})
+	if err != nil {
+		r.errorln("Failed to update dedup index:", err)
+	}
+}
+
+func (r *syncRun) dedupOriginal(sum []byte) string {
+	var original string
+	r.stateDB.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(dedupBucket); bucket != nil {
+			original = string(bucket.Get(sum))
+		}
+		return nil
+	})
+	return original
+}
+
+// sameContent reports whether the indexed original still exists with the
+// content sum and is not already the same file as path.
+func (r *syncRun) sameContent(original, path, sum string) bool {
+	originalInfo, err := os.Stat(original)
+	if err != nil {
+		return false
+	}
+	if info, err := os.Stat(path); err == nil && os.SameFile(info, originalInfo) {
+		return false
+	}
+	originalSum, err := r.localSHA256(original)
+	return err == nil && originalSum == sum
+}
+
+// linkOver atomically replaces path with a hardlink to original.
+func linkOver(original, path string) error {
+	tmp := path + ".link"
+	os.Remove(tmp)
+	if err := os.Link(original, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
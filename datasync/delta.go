@@ -0,0 +1,194 @@
+package datasync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// With DeltaTransfer the checksum cache also records, for every pushed
+// file, the SHA-256 of each deltaBlockSize block together with the size and
+// ModTime of the remote copy just written. As long as the remote copy still
+// has that size and ModTime, the next upload compares the local blocks with
+// the recorded ones and writes only those that differ. SFTP cannot move data
+// within a remote file, so blocks are compared at the same offsets: data
+// inserted into the middle of a file rewrites everything after it.
+
+const deltaBlockSize = 1 << 20
+
+var deltaBucket = []byte("delta:sha256")
+
+// updatableFile is a remote file a delta transfer writes into in place.
+type updatableFile interface {
+	io.WriterAt
+	Truncate(size int64) error
+	Close() error
+}
+
+// updateClient is implemented by Clients that can open an existing file for
+// writing at any offset.
+type updateClient interface {
+	OpenForUpdate(path string) (updatableFile, error)
+}
+
+func (c *sftpConnection) OpenForUpdate(path string) (updatableFile, error) {
+	return c.Client.OpenFile(path, os.O_RDWR)
+}
+
+func (localClient) OpenForUpdate(path string) (updatableFile, error) {
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
+
+func (r *syncRun) deltaKey(remoteFilePath string) []byte {
+	return []byte(r.config.remoteHost() + ":" + remoteFilePath)
+}
+
+// uploadDelta updates the remote copy of a file in place. It returns false,
+// having changed nothing, when the file has to be uploaded in full instead.
+func (r *syncRun) uploadDelta(ctx context.Context, localFilePath, remoteFilePath string) (bool, error) {
+	client, ok := r.client.(updateClient)
+	if !ok || r.checksumDB == nil {
+		return false, nil
+	}
+	remoteInfo, err := r.client.Stat(remoteFilePath)
+	if err != nil {
+		return false, nil
+	}
+	blocks := r.loadBlockSums(remoteFilePath, remoteInfo)
+	if blocks == nil {
+		r.debugf("%s: full upload (no block checksums for the remote copy)", localFilePath)
+		return false, nil
+	}
+
+	started := time.Now()
+	localFile, err := os.Open(localFilePath)
+	if err != nil {
+		return true, err
+	}
+	defer localFile.Close()
+	remoteFile, err := client.OpenForUpdate(remoteFilePath)
+	if err != nil {
+		r.debugf("%s: full upload (cannot update the remote copy in place: %v)", localFilePath, err)
+		return false, nil
+	}
+	defer remoteFile.Close()
+
+	var sums []byte
+	var size, written int64
+	buf := make([]byte, deltaBlockSize)
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
+		n, err := io.ReadFull(localFile, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			if len(blocks) < (i+1)*sha256.Size || !bytes.Equal(sum[:], blocks[i*sha256.Size:(i+1)*sha256.Size]) {
+				if _, err := remoteFile.WriteAt(buf[:n], size); err != nil {
+					return true, err
+				}
+				written += int64(n)
+			}
+			sums = append(sums, sum[:]...)
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+	if size < remoteInfo.Size() {
+		if err := remoteFile.Truncate(size); err != nil {
+			return true, err
+		}
+	}
+	if err := remoteFile.Close(); err != nil {
+		return true, err
+	}
+	if err := r.verifyUpload(localFilePath, remoteFilePath); err != nil {
+		r.client.Remove(remoteFilePath)
+		return true, err
+	}
+
+	r.storeBlockSums(remoteFilePath, sums)
+	r.transferred(localFilePath, written, time.Since(started))
+	r.transferln("Uploaded", written, "of", size, "bytes of", localFilePath, "to", remoteFilePath)
+	return true, nil
+}
+
+// recordBlockSums hashes the blocks of a file just uploaded in full, for
+// the next delta transfer.
+func (r *syncRun) recordBlockSums(localFilePath, remoteFilePath string) {
+	if _, ok := r.client.(updateClient); !ok || r.checksumDB == nil {
+		return
+	}
+	file, err := os.Open(localFilePath)
+	if err != nil {
+		r.warnln("Failed to hash blocks of", localFilePath, ":", err)
+		return
+	}
+	defer file.Close()
+	var sums []byte
+	buf := make([]byte, deltaBlockSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			sums = append(sums, sum[:]...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			r.warnln("Failed to hash blocks of", localFilePath, ":", err)
+			return
+		}
+	}
+	r.storeBlockSums(remoteFilePath, sums)
+}
+
+// loadBlockSums returns the recorded block checksums of a remote file, or
+// nil unless they still describe remoteInfo.
+func (r *syncRun) loadBlockSums(remoteFilePath string, remoteInfo os.FileInfo) []byte {
+	state := fileStateOf(remoteInfo).encode()
+	var blocks []byte
+	r.checksumDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deltaBucket)
+		if bucket == nil {
+			return nil
+		}
+		value := bucket.Get(r.deltaKey(remoteFilePath))
+		if len(value) > len(state) && bytes.Equal(value[:len(state)], state) && (len(value)-len(state))%sha256.Size == 0 {
+			blocks = bytes.Clone(value[len(state):])
+		}
+		return nil
+	})
+	return blocks
+}
+
+// storeBlockSums records sums together with the current size and ModTime
+// of the remote file they describe.
+func (r *syncRun) storeBlockSums(remoteFilePath string, sums []byte) {
+	info, err := r.client.Stat(remoteFilePath)
+	if err != nil {
+		r.warnln("Failed to stat", remoteFilePath, "after upload:", err)
+		return
+	}
+	err = r.checksumDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(deltaBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(r.deltaKey(remoteFilePath), append(fileStateOf(info).encode(), sums...))
+	})
+	if err != nil {
+		r.errorln("Failed to update block checksums:", err)
+	}
+}
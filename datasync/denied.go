@@ -0,0 +1,43 @@
+package datasync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/pkg/sftp"
+)
+
+// A file or directory the account may not access fails like any other, but
+// is also counted apart in Result.Denied, since it usually takes a fix on
+// the server rather than another try. With MaxDeniedFraction the run stops
+// once more than that fraction of the files it handled were denied, which
+// points to the account rather than to a few files.
+
+// deniedSample is how many files a run handles before MaxDeniedFraction
+// applies, so that a denied first file does not stop it.
+const deniedSample = 20
+
+func isAccessDenied(err error) bool {
+	if errors.Is(err, os.ErrPermission) {
+		return true
+	}
+	var status *sftp.StatusError
+	return errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxPermissionDenied
+}
+
+// deny counts a failure of path for a lack of permission.
+func (r *syncRun) deny(path string) {
+	r.denied++
+	if len(r.deniedPaths) < maxResultErrors {
+		r.deniedPaths = append(r.deniedPaths, path)
+	}
+	handled := r.files + r.skipped + r.failed
+	if r.config.MaxDeniedFraction == 0 || handled < deniedSample || r.ctx.Err() != nil ||
+		float64(r.denied) <= r.config.MaxDeniedFraction*float64(handled) {
+		return
+	}
+	err := fmt.Errorf("access denied to %d of %d files, more than maxDeniedFraction", r.denied, handled)
+	r.errorln("Aborting the sync:", err)
+	r.abort(err)
+}
@@ -0,0 +1,219 @@
+package datasync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DiffEntry is a file found by Diff.
+type DiffEntry struct {
+	// Path is relative to the directory pair, with forward slashes, and
+	// names the file as it is called on the source side, or for DestOnly
+	// on the destination side.
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// Reason is why a sync would transfer a file of Differing.
+	Reason string `json:"reason,omitempty"`
+}
+
+// PairDiff compares the two sides of one directory pair.
+type PairDiff struct {
+	LocalDir  string `json:"localDir"`
+	RemoteDir string `json:"remoteDir"`
+	// SourceOnly lists the files missing at the destination, which a sync
+	// would transfer.
+	SourceOnly []DiffEntry `json:"sourceOnly"`
+	// DestOnly lists the files only at the destination, which a sync
+	// leaves alone.
+	DestOnly []DiffEntry `json:"destOnly"`
+	// Differing lists the files on both sides that a sync would transfer
+	// again.
+	Differing []DiffEntry `json:"differing"`
+	// Same counts the files on both sides a sync would skip.
+	Same int `json:"same"`
+}
+
+// Diff compares the source and destination directories of a pull or push
+// config without changing anything. Source files are filtered and compared
+// as a sync would, through the config's filters, ignore files, Only and
+// compareMode. Destination files that no source file maps to are listed
+// whatever the filters say.
+func (s *Syncer) Diff(ctx context.Context, config Config) ([]PairDiff, error) {
+	return s.compareTrees(ctx, config, "diff", (*syncRun).shouldTransfer)
+}
+
+// fileComparison reports whether a file on both sides differs, setting
+// r.reason to why.
+type fileComparison func(r *syncRun, srcPath, destPath string, srcInfo, destInfo os.FileInfo) bool
+
+// compareTrees sorts the files of every directory pair of config as Diff
+// describes, comparing those on both sides with differs. command names
+// the caller in errors.
+func (s *Syncer) compareTrees(ctx context.Context, config Config, command string, differs fileComparison) ([]PairDiff, error) {
+	r, done, err := s.listingRun(ctx, config, command)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	config = r.config
+
+	var diffs []PairDiff
+	pairs := r.expandPairs(config.DirPairs())
+	for _, pair := range pairs {
+		r.config.LocalDir, r.config.RemoteDir = pair.LocalDir, pair.RemoteDir
+		srcDir, destDir := pair.RemoteDir, pair.LocalDir
+		if config.direction() == "push" {
+			srcDir, destDir = pair.LocalDir, pair.RemoteDir
+		}
+		r.root = srcDir
+		diff := PairDiff{LocalDir: pair.LocalDir, RemoteDir: pair.RemoteDir, SourceOnly: []DiffEntry{}, DestOnly: []DiffEntry{}, Differing: []DiffEntry{}}
+		dest := make(map[string]os.FileInfo)
+		if err := r.listDest(destDir, "", dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return diffs, fmt.Errorf("unable to list %s: %w", destDir, err)
+		}
+		if err := r.diffDir(srcDir, destDir, "", 0, dest, &diff, differs); err != nil {
+			return diffs, fmt.Errorf("unable to list %s: %w", srcDir, err)
+		}
+		for rel, info := range dest {
+			diff.DestOnly = append(diff.DestOnly, DiffEntry{Path: rel, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		for _, entries := range [][]DiffEntry{diff.SourceOnly, diff.DestOnly, diff.Differing} {
+			sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, r.ctx.Err()
+}
+
+// listingRun connects a run of config that only lists files, for command,
+// which done ends.
+func (s *Syncer) listingRun(ctx context.Context, config Config, command string) (r *syncRun, done func(), err error) {
+	switch {
+	case config.direction() == "relay":
+		return nil, nil, fmt.Errorf("%s is not supported for action relay", command)
+	case config.archiveMode() != "":
+		return nil, nil, fmt.Errorf("%s is not supported with archiveMode", command)
+	}
+	config, err = config.ResolvePaths(time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, abort := context.WithCancelCause(ctx)
+	r = &syncRun{syncer: s, ctx: ctx, abort: abort, config: config, logger: newLogger(config), limit: &fileLimit{}, metrics: &runMetrics{}}
+	client, err := s.connect(ctx, config)
+	if err != nil {
+		abort(nil)
+		return nil, nil, err
+	}
+	r.client = client
+	return r, func() {
+		r.client.Close()
+		abort(nil)
+	}, nil
+}
+
+// readSide lists dir on the remote side when remote is true, and locally
+// otherwise, following symlinks of local files.
+func (r *syncRun) readSide(remote bool, dir string) ([]os.FileInfo, error) {
+	if remote {
+		var infos []os.FileInfo
+		err := r.retryOnDisconnect(func() (err error) {
+			infos, err = r.client.ReadDir(dir)
+			return err
+		})
+		return infos, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := os.Stat(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// listDest adds every file below dir, the destination directory rel below
+// the pair, to files.
+func (r *syncRun) listDest(dir, rel string, files map[string]os.FileInfo) error {
+	infos, err := r.readSide(r.destRemote(), dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Name() == manifestName {
+			continue
+		}
+		name := path.Join(rel, info.Name())
+		if info.IsDir() {
+			if err := r.listDest(joinSide(r.destRemote(), dir, info.Name()), name, files); err != nil {
+				return err
+			}
+			continue
+		}
+		files[name] = info
+	}
+	return r.ctx.Err()
+}
+
+// diffDir sorts the files below the source directory srcDir, rel below the
+// pair, into diff, taking their counterparts out of dest.
+func (r *syncRun) diffDir(srcDir, destDir, rel string, depth int, dest map[string]os.FileInfo, diff *PairDiff, differs fileComparison) error {
+	infos, err := r.readSide(r.srcRemote(), srcDir)
+	if err != nil {
+		return err
+	}
+	defer r.loadIgnoreRules(srcDir)()
+	for _, info := range infos {
+		if info.Name() == manifestName {
+			continue
+		}
+		srcPath := joinSide(r.srcRemote(), srcDir, info.Name())
+		destName := r.plainName(info.Name(), info.IsDir())
+		if r.config.direction() == "push" {
+			destName = r.remoteName(info.Name(), info.IsDir())
+		}
+		destPath := joinSide(r.destRemote(), destDir, destName)
+		if r.hidden(srcPath, info.Name()) || r.ignored(srcPath, info.IsDir()) || !r.within(srcPath, info.IsDir()) {
+			continue
+		}
+		if info.IsDir() {
+			if r.depthExceeded(srcPath, depth+1) {
+				continue
+			}
+			if err := r.diffDir(srcPath, destPath, path.Join(rel, destName), depth+1, dest, diff, differs); err != nil {
+				return err
+			}
+			continue
+		}
+		if r.excluded(srcPath, info) {
+			continue
+		}
+		destRel := path.Join(rel, destName)
+		destInfo, ok := dest[destRel]
+		delete(dest, destRel)
+		entry := DiffEntry{Path: path.Join(rel, info.Name()), Size: info.Size(), ModTime: info.ModTime()}
+		switch {
+		case !ok:
+			diff.SourceOnly = append(diff.SourceOnly, entry)
+		case differs(r, srcPath, destPath, info, destInfo):
+			entry.Reason = r.reason
+			diff.Differing = append(diff.Differing, entry)
+		default:
+			diff.Same++
+		}
+	}
+	return r.ctx.Err()
+}
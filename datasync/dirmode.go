@@ -0,0 +1,95 @@
+package datasync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+)
+
+// defaultDirMode is the mode of the local directories a sync creates when
+// the config sets no DirMode. The umask may restrict it further.
+const defaultDirMode os.FileMode = 0o755
+
+// FileMode is a permission mode read from the config as an octal string
+// such as "0750".
+type FileMode os.FileMode
+
+func (m *FileMode) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("mode must be an octal string such as \"0750\": %w", err)
+	}
+	if s == "" {
+		*m = 0
+		return nil
+	}
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0o777 {
+		return fmt.Errorf("invalid mode %q: must be octal permission bits such as \"0750\"", s)
+	}
+	*m = FileMode(n)
+	return nil
+}
+
+func (m FileMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%04o", uint32(m)))
+}
+
+// dirModeClient is implemented by Clients that can create directories with
+// a given mode.
+type dirModeClient interface {
+	MkdirAllMode(path string, mode os.FileMode) error
+}
+
+// dirMode is the mode of the local directories the sync creates.
+func (r *syncRun) dirMode() os.FileMode {
+	if r.config.DirMode != 0 {
+		return os.FileMode(r.config.DirMode)
+	}
+	return defaultDirMode
+}
+
+// mkdirLocal creates the local directory dir and its parents.
+func (r *syncRun) mkdirLocal(dir string) error {
+	return os.MkdirAll(dir, r.dirMode())
+}
+
+// mkdirRemote creates the directory dir and its parents through client,
+// with DirMode when the config sets one and the client supports it. Else
+// the server's default mode applies.
+func (r *syncRun) mkdirRemote(client Client, dir string) error {
+	if c, ok := client.(dirModeClient); ok && r.config.DirMode != 0 {
+		return c.MkdirAllMode(dir, os.FileMode(r.config.DirMode))
+	}
+	return client.MkdirAll(dir)
+}
+
+// MkdirAllMode creates the directories missing on the way to dir and gives
+// them mode, leaving existing ones alone.
+func (c *sftpConnection) MkdirAllMode(dir string, mode os.FileMode) error {
+	if info, err := c.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err := c.MkdirAllMode(parent, mode); err != nil {
+			return err
+		}
+	}
+	if err := c.Mkdir(dir); err != nil {
+		// Another sync may have created it meanwhile.
+		if info, statErr := c.Stat(dir); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return c.Chmod(dir, mode)
+}
+
+func (localClient) MkdirAllMode(path string, mode os.FileMode) error {
+	return os.MkdirAll(path, mode)
+}
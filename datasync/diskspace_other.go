@@ -0,0 +1,28 @@
+//go:build !windows
+
+package datasync
+
+import "golang.org/x/sys/unix"
+
+// diskSpace returns the bytes available to this process and the total size
+// of the filesystem holding path.
+func diskSpace(path string) (free, total uint64, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
+
+// freeInodes returns the inodes left on the filesystem holding path. ok is
+// false for filesystems that allocate inodes dynamically and report none.
+func freeInodes(path string) (free uint64, ok bool, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, false, err
+	}
+	if st.Files == 0 {
+		return 0, false, nil
+	}
+	return uint64(st.Ffree), true, nil
+}
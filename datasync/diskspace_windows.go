@@ -0,0 +1,23 @@
+//go:build windows
+
+package datasync
+
+import "golang.org/x/sys/windows"
+
+// diskSpace returns the bytes available to this process and the total size
+// of the volume holding path.
+func diskSpace(path string) (free, total uint64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := windows.GetDiskFreeSpaceEx(p, &free, &total, nil); err != nil {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
+
+// freeInodes reports ok false: Windows volumes have no inode limit.
+func freeInodes(path string) (free uint64, ok bool, err error) {
+	return 0, false, nil
+}
@@ -0,0 +1,179 @@
+package datasync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	// OpenPGP falls back to RIPEMD-160 for keys stating no hash preferences.
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+// With EncryptUploads every pushed file is encrypted with OpenPGP to the
+// keys in RecipientKeyPath and stored under its name plus encryptedSuffix.
+// A pull with DecryptionKeyPath decrypts the files carrying the suffix and
+// stores them under their plain name. Encrypted copies never have the size
+// of the plain ones, so only modification times are compared for them.
+
+const encryptedSuffix = ".gpg"
+
+func (c Config) validateEncryption() error {
+	if c.EncryptUploads {
+		if c.Action != "push" {
+			return fmt.Errorf("encryptUploads requires action push")
+		}
+		if c.RecipientKeyPath == "" {
+			return fmt.Errorf("encryptUploads requires a recipientKeyPath")
+		}
+	}
+	if c.DecryptionKeyPath != "" && c.Action != "pull" {
+		return fmt.Errorf("decryptionKeyPath requires action pull")
+	}
+	if !c.EncryptUploads && c.DecryptionKeyPath == "" {
+		return nil
+	}
+	switch {
+	case c.CompareMode == "size" || c.CompareMode == "checksum":
+		return fmt.Errorf("compareMode %s cannot compare encrypted files", c.CompareMode)
+	case c.ConflictPolicy == "larger":
+		return fmt.Errorf("conflictPolicy larger cannot compare encrypted files")
+	case c.UseManifest:
+		return fmt.Errorf("useManifest cannot be combined with encryption")
+	case c.DeltaTransfer:
+		return fmt.Errorf("deltaTransfer cannot be combined with encryptUploads")
+	}
+	return nil
+}
+
+// loadKeys reads the keys the config encrypts to or decrypts with.
+func (r *syncRun) loadKeys() error {
+	switch {
+	case r.config.EncryptUploads:
+		keys, err := readKeyRing(r.config.RecipientKeyPath)
+		if err != nil {
+			return fmt.Errorf("unable to read recipientKeyPath: %w", err)
+		}
+		r.keys = keys
+	case r.config.DecryptionKeyPath != "":
+		keys, err := readKeyRing(r.config.DecryptionKeyPath)
+		if err != nil {
+			return fmt.Errorf("unable to read decryptionKeyPath: %w", err)
+		}
+		if err := unlockKeys(keys, r.config.KeyPassphrase); err != nil {
+			return fmt.Errorf("unable to unlock decryptionKeyPath: %w", err)
+		}
+		r.keys = keys
+	}
+	return nil
+}
+
+// readKeyRing reads an ASCII armored or binary OpenPGP key file.
+func readKeyRing(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", path)
+	}
+	return keys, nil
+}
+
+// unlockKeys decrypts the passphrase protected private keys in keys.
+func unlockKeys(keys openpgp.EntityList, passphrase string) error {
+	var private []*packet.PrivateKey
+	for _, entity := range keys {
+		if entity.PrivateKey != nil {
+			private = append(private, entity.PrivateKey)
+		}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PrivateKey != nil {
+				private = append(private, subkey.PrivateKey)
+			}
+		}
+	}
+	if len(private) == 0 {
+		return fmt.Errorf("no private keys found")
+	}
+	for _, key := range private {
+		if !key.Encrypted {
+			continue
+		}
+		if passphrase == "" {
+			return fmt.Errorf("the key is passphrase protected, but keyPassphrase is not set")
+		}
+		if err := key.Decrypt([]byte(passphrase)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remoteName returns the name a local file or directory is pushed under.
+func (r *syncRun) remoteName(name string, dir bool) string {
+	switch {
+	case dir:
+	case r.config.EncryptUploads:
+		return name + encryptedSuffix
+	case r.config.StoreCompressed:
+		return name + compressedSuffix
+	}
+	return name
+}
+
+// plainName returns the name a remote file or directory is pulled to,
+// without the suffix of a file that is decrypted or decompressed.
+func (r *syncRun) plainName(name string, dir bool) string {
+	switch {
+	case dir:
+	case r.decrypts(name):
+		return strings.TrimSuffix(name, encryptedSuffix)
+	case r.compressedRemote(name):
+		return strings.TrimSuffix(name, compressedSuffix)
+	}
+	return name
+}
+
+// decrypts reports whether the remote file is decrypted when pulled.
+func (r *syncRun) decrypts(remotePath string) bool {
+	return r.config.DecryptionKeyPath != "" && strings.HasSuffix(remotePath, encryptedSuffix)
+}
+
+// encrypted reports whether one side of a transfer holds the encrypted
+// copy of the other, so their sizes cannot be compared.
+func (r *syncRun) encrypted(srcPath string) bool {
+	return r.config.EncryptUploads || r.decrypts(srcPath)
+}
+
+// encryptTo returns a writer encrypting what is written to it into w. It
+// must be closed before w to write out the end of the message.
+func (r *syncRun) encryptTo(w io.Writer, localFilePath string) (io.WriteCloser, error) {
+	info, err := os.Stat(localFilePath)
+	if err != nil {
+		return nil, err
+	}
+	hints := &openpgp.FileHints{IsBinary: true, FileName: filepath.Base(localFilePath), ModTime: info.ModTime()}
+	return openpgp.Encrypt(w, r.keys, nil, hints, nil)
+}
+
+// decryptFrom returns a reader of the decrypted contents of src. Its final
+// Read fails if the message was tampered with.
+func (r *syncRun) decryptFrom(src io.Reader) (io.Reader, error) {
+	md, err := openpgp.ReadMessage(src, r.keys, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return md.UnverifiedBody, nil
+}
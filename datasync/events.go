@@ -0,0 +1,108 @@
+package datasync
+
+import "time"
+
+// Events receives notifications about the progress of a sync, for embedders
+// that drive their own UI or metrics. The methods are called on the
+// goroutine running the sync, so a Syncer running several syncs at once
+// calls them concurrently.
+type Events interface {
+	// OnFileTransferred is called after a file was downloaded or uploaded.
+	// path is the source file and direction "pull" or "push".
+	OnFileTransferred(path string, bytes int64, direction string)
+	// OnFileSkipped is called for a source file that was left as it is.
+	OnFileSkipped(path, reason string)
+	// OnError is called for every error counted in Result.Failed. path is
+	// empty for errors that do not concern a single file or directory.
+	OnError(path string, err error)
+	// OnDirComplete is called after a source directory was synced, with
+	// the counts of the directory and its subdirectories.
+	OnDirComplete(dir string, stats DirStats)
+}
+
+// DateEvents may be implemented by Events to follow the dates of a date
+// range as well, for instance to show its overall progress.
+type DateEvents interface {
+	// OnRangeStart is called before the dates of a config are synced, with
+	// the number of dates times its directory pairs.
+	OnRangeStart(config string, total int)
+	// OnDateStart is called before a date of a directory pair is synced.
+	OnDateStart(date string)
+	// OnDateComplete is called after it was synced, with what was counted
+	// for it, and with resumed set instead for a date the checkpoint of an
+	// earlier run has done.
+	OnDateComplete(date string, stats DirStats, resumed bool)
+}
+
+// DirStats counts the files handled in a directory.
+type DirStats struct {
+	Files   int
+	Skipped int
+	Failed  int
+	Bytes   int64
+}
+
+// NopEvents ignores every event. Embed it to implement only some of the
+// Events methods.
+type NopEvents struct{}
+
+func (NopEvents) OnFileTransferred(path string, bytes int64, direction string) {}
+func (NopEvents) OnFileSkipped(path, reason string)                            {}
+func (NopEvents) OnError(path string, err error)                               {}
+func (NopEvents) OnDirComplete(dir string, stats DirStats)                     {}
+func (NopEvents) OnRangeStart(config string, total int)                        {}
+func (NopEvents) OnDateStart(date string)                                      {}
+func (NopEvents) OnDateComplete(date string, stats DirStats, resumed bool)     {}
+
+func (r *syncRun) events() Events {
+	if r.syncer.Events == nil {
+		return NopEvents{}
+	}
+	return r.syncer.Events
+}
+
+func (r *syncRun) dateEvents() DateEvents {
+	if e, ok := r.syncer.Events.(DateEvents); ok {
+		return e
+	}
+	return NopEvents{}
+}
+
+// transferred counts a file transferred in elapsed.
+func (r *syncRun) transferred(path string, bytes int64, elapsed time.Duration) {
+	r.bytes += bytes
+	r.metrics.addTransfer(bytes, elapsed)
+	r.traceTransfer(path, bytes, elapsed)
+	r.events().OnFileTransferred(path, bytes, r.config.direction())
+}
+
+func (r *syncRun) skip(path, reason string) {
+	r.skipped++
+	r.events().OnFileSkipped(path, reason)
+}
+
+func (r *syncRun) stats() DirStats {
+	return DirStats{Files: r.files, Skipped: r.skipped, Failed: r.failed, Bytes: r.bytes}
+}
+
+// completeDir reports dir as done, with the counts since mark was taken.
+func (r *syncRun) completeDir(dir string, mark dirMark) {
+	timing := r.dirTiming(dir, mark)
+	r.nested.Duration += timing.Duration
+	r.nested.Files += timing.Files
+	r.nested.Bytes += timing.Bytes
+	r.metrics.addDir(timing)
+	r.endDirSpan(dir, mark)
+	r.events().OnDirComplete(dir, r.statsSince(mark.stats))
+}
+
+// statsSince returns what r counted since before was taken.
+func (r *syncRun) statsSince(before DirStats) DirStats {
+	now := r.stats()
+	return DirStats{
+		Files:   now.Files - before.Files,
+		Skipped: now.Skipped - before.Skipped,
+		Failed:  now.Failed - before.Failed,
+		Bytes:   now.Bytes - before.Bytes,
+	}
+}
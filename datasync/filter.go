@@ -0,0 +1,93 @@
+package datasync
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// excluded reports whether the file at path is filtered out of the sync by
+// the config's file filters. Directories are never passed here; they are
+// always recursed.
+func (r *syncRun) excluded(path string, info os.FileInfo) bool {
+	ext := filepath.Ext(r.plainName(info.Name(), false))
+	if len(r.config.AllowExtensions) > 0 && !matchesExtension(ext, r.config.AllowExtensions) {
+		r.debugf("%s: skip (extension %q not in allowExtensions)", path, ext)
+		return true
+	}
+	if matchesExtension(ext, r.config.DenyExtensions) {
+		r.debugf("%s: skip (extension %q in denyExtensions)", path, ext)
+		return true
+	}
+
+	size := info.Size()
+	if r.config.MinSize > 0 && size < r.config.MinSize {
+		r.debugf("%s: skip (size %d below minSize %d)", path, size, r.config.MinSize)
+		return true
+	}
+	if r.config.MaxSize > 0 && size > r.config.MaxSize {
+		r.debugf("%s: skip (size %d above maxSize %d)", path, size, r.config.MaxSize)
+		return true
+	}
+	if r.config.ZeroBytePolicy == "skip" && size == 0 && !r.resized(path) {
+		r.debugf("%s: skip (empty, zeroBytePolicy skip)", path)
+		return true
+	}
+
+	if since := r.syncer.Since; !since.IsZero() && !info.ModTime().After(since) {
+		r.debugf("%s: skip (modified %s, not after -since %s)", path, info.ModTime().Format(time.RFC3339), since.Format(time.RFC3339))
+		return true
+	}
+	age := time.Since(info.ModTime())
+	if r.config.MinAge > 0 && age < time.Duration(r.config.MinAge) {
+		r.debugf("%s: skip (modified %s ago, younger than minAge %s)", path, age.Round(time.Second), time.Duration(r.config.MinAge))
+		return true
+	}
+	if r.config.MaxAge > 0 && age > time.Duration(r.config.MaxAge) {
+		r.debugf("%s: skip (modified %s ago, older than maxAge %s)", path, age.Round(time.Second), time.Duration(r.config.MaxAge))
+		return true
+	}
+	return false
+}
+
+// unsettled reports whether the local file at path was modified within
+// StabilizeDelay, and so may still be written to. Such a file is left for a
+// later run.
+func (r *syncRun) unsettled(path string, info os.FileInfo) bool {
+	delay := time.Duration(r.config.StabilizeDelay)
+	if delay <= 0 {
+		return false
+	}
+	age := time.Since(info.ModTime())
+	if age >= delay {
+		return false
+	}
+	r.debugf("%s: defer (modified %s ago, within stabilizeDelay %s)", path, age.Round(time.Millisecond), delay)
+	r.skip(path, "still being written")
+	return true
+}
+
+// matchesExtension reports whether ext is one of exts, ignoring case and an
+// omitted leading dot in the configured values.
+func matchesExtension(ext string, exts []string) bool {
+	for _, e := range exts {
+		if e != "" && !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		if strings.EqualFold(ext, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// hidden reports whether the entry at path is a dotfile or dot-directory
+// skipped because IncludeHidden is false.
+func (r *syncRun) hidden(path, name string) bool {
+	if r.config.IncludeHidden == nil || *r.config.IncludeHidden || !strings.HasPrefix(name, ".") {
+		return false
+	}
+	r.debugf("%s: skip (hidden)", path)
+	return true
+}
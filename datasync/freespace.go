@@ -0,0 +1,110 @@
+package datasync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	errLowDiskSpace = errors.New("low disk space")
+	errOutOfInodes  = errors.New("out of inodes")
+)
+
+// FreeSpace is an amount of disk space read from the config either as a
+// number of bytes or as a percentage of the filesystem such as "10%".
+type FreeSpace struct {
+	Bytes   int64
+	Percent float64
+}
+
+func (f *FreeSpace) UnmarshalJSON(data []byte) error {
+	var bytes int64
+	if err := json.Unmarshal(data, &bytes); err == nil {
+		*f = FreeSpace{Bytes: bytes}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("free space must be a number of bytes or a percentage such as \"10%%\": %w", err)
+	}
+	if s == "" {
+		*f = FreeSpace{}
+		return nil
+	}
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		n, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+		if err != nil || n < 0 || n >= 100 {
+			return fmt.Errorf("invalid free space %q", s)
+		}
+		*f = FreeSpace{Percent: n}
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid free space %q", s)
+	}
+	*f = FreeSpace{Bytes: n}
+	return nil
+}
+
+func (f FreeSpace) MarshalJSON() ([]byte, error) {
+	if f.Percent > 0 {
+		return json.Marshal(strconv.FormatFloat(f.Percent, 'f', -1, 64) + "%")
+	}
+	return json.Marshal(f.Bytes)
+}
+
+// threshold returns the space to keep free on a filesystem of total bytes.
+func (f FreeSpace) threshold(total uint64) uint64 {
+	if f.Percent > 0 {
+		return uint64(float64(total) * f.Percent / 100)
+	}
+	return uint64(max(f.Bytes, 0))
+}
+
+// checkFreeSpace returns an error wrapping errLowDiskSpace when storing size
+// more bytes in dir would leave less than MinFreeSpace free, or wrapping
+// errOutOfInodes when a new file would leave less than MinFreeInodes. A
+// filesystem whose free space cannot be determined is not checked.
+func (r *syncRun) checkFreeSpace(dir string, size int64) error {
+	if err := r.checkFreeBytes(dir, size); err != nil {
+		return err
+	}
+	return r.checkFreeInodes(dir)
+}
+
+func (r *syncRun) checkFreeBytes(dir string, size int64) error {
+	if r.config.MinFreeSpace == (FreeSpace{}) {
+		return nil
+	}
+	free, total, err := diskSpace(dir)
+	if err != nil {
+		r.warnln("Failed to check free space on", dir, ":", err)
+		return nil
+	}
+	need := uint64(max(size, 0)) + r.config.MinFreeSpace.threshold(total)
+	if free < need {
+		return fmt.Errorf("%w on %s: %d bytes free, %d bytes needed to keep minFreeSpace", errLowDiskSpace, dir, free, need)
+	}
+	return nil
+}
+
+// checkFreeInodes skips filesystems, and platforms such as Windows, that do
+// not count inodes.
+func (r *syncRun) checkFreeInodes(dir string) error {
+	if r.config.MinFreeInodes <= 0 {
+		return nil
+	}
+	free, ok, err := freeInodes(dir)
+	if err != nil {
+		r.warnln("Failed to check free inodes on", dir, ":", err)
+		return nil
+	}
+	if ok && free <= uint64(r.config.MinFreeInodes) {
+		return fmt.Errorf("%w on %s: %d inodes free, minFreeInodes is %d", errOutOfInodes, dir, free, r.config.MinFreeInodes)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package datasync
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpConnection is the Client for Protocols "ftp" and "ftps". A single FTP control
+// connection runs one command at a time, which matches how a sync uses its
+// Client.
+type ftpConnection struct {
+	conn    *ftp.ServerConn
+	home    string
+	release func()
+}
+
+func (s *Syncer) connectToFTPServer(ctx context.Context, config Config) (*ftpConnection, error) {
+	release, err := s.acquireHostSlot(ctx, config.SSHHost, newLogger(config))
+	if err != nil {
+		return nil, err
+	}
+
+	port := config.SSHPort
+	if port == 0 {
+		port = 21
+	}
+	opts := []ftp.DialOption{ftp.DialWithContext(ctx)}
+	if config.protocol() == "ftps" {
+		tlsConfig, err := createTLSConfig(config)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		opts = append(opts, ftp.DialWithExplicitTLS(tlsConfig))
+	}
+	conn, err := ftp.Dial(net.JoinHostPort(config.SSHHost, strconv.Itoa(port)), opts...)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if err := conn.Login(config.User, config.Password); err != nil {
+		conn.Quit()
+		release()
+		return nil, err
+	}
+	home, err := conn.CurrentDir()
+	if err != nil {
+		conn.Quit()
+		release()
+		return nil, err
+	}
+	return &ftpConnection{conn: conn, home: home, release: release}, nil
+}
+
+// createTLSConfig returns the TLS settings for Protocol "ftps", trusting
+// only CACertPath when it is set.
+func createTLSConfig(config Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.SSHHost,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CACertPath != "" {
+		pem, err := os.ReadFile(config.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CACertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// SupportsModTime reports whether the server tells exact modification
+// times, through MLST or MDTM. Without them files are compared by size.
+func (c *ftpConnection) SupportsModTime() bool {
+	return c.conn.IsTimePreciseInList() || c.conn.IsGetTimeSupported()
+}
+
+func (c *ftpConnection) ReadDir(dir string) ([]os.FileInfo, error) {
+	entries, err := c.conn.List(dir)
+	if err != nil {
+		return nil, ftpError("readdir", dir, err)
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		infos = append(infos, newFTPFileInfo(entry.Name, entry))
+	}
+	return infos, nil
+}
+
+func (c *ftpConnection) Stat(name string) (os.FileInfo, error) {
+	entry, err := c.conn.GetEntry(name)
+	if err == nil {
+		return newFTPFileInfo(path.Base(name), entry), nil
+	}
+	if !isFTPCode(err, ftp.StatusNotImplemented) {
+		return nil, ftpError("stat", name, err)
+	}
+
+	// Without MLST, SIZE tells files and CWD directories.
+	size, err := c.conn.FileSize(name)
+	if err != nil {
+		if c.conn.ChangeDir(name) == nil {
+			c.conn.ChangeDir(c.home)
+			return ftpFileInfo{name: path.Base(name), dir: true}, nil
+		}
+		return nil, ftpError("stat", name, err)
+	}
+	info := ftpFileInfo{name: path.Base(name), size: size}
+	if c.conn.IsGetTimeSupported() {
+		if info.modTime, err = c.conn.GetTime(name); err != nil {
+			return nil, ftpError("stat", name, err)
+		}
+	}
+	return info, nil
+}
+
+func (c *ftpConnection) Open(name string) (io.ReadCloser, error) {
+	resp, err := c.conn.Retr(name)
+	if err != nil {
+		return nil, ftpError("open", name, err)
+	}
+	return resp, nil
+}
+
+// Create streams what is written to the file into a STOR command, which
+// completes when the file is closed.
+func (c *ftpConnection) Create(name string) (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := c.conn.Stor(name, r)
+		r.CloseWithError(err)
+		done <- err
+	}()
+	return &ftpWriter{name: name, w: w, done: done}, nil
+}
+
+func (c *ftpConnection) MkdirAll(dir string) error {
+	if c.conn.ChangeDir(dir) == nil {
+		return c.conn.ChangeDir(c.home)
+	}
+	var err error
+	parts := strings.Split(strings.Trim(dir, "/"), "/")
+	for i := range parts {
+		prefix := strings.Join(parts[:i+1], "/")
+		if strings.HasPrefix(dir, "/") {
+			prefix = "/" + prefix
+		}
+		err = c.conn.MakeDir(prefix)
+	}
+	if c.conn.ChangeDir(dir) != nil {
+		return ftpError("mkdir", dir, err)
+	}
+	return c.conn.ChangeDir(c.home)
+}
+
+// Remove deletes a file or an empty directory.
+func (c *ftpConnection) Remove(name string) error {
+	err := c.conn.Delete(name)
+	if err == nil || c.conn.RemoveDir(name) == nil {
+		return nil
+	}
+	return ftpError("remove", name, err)
+}
+
+func (c *ftpConnection) Close() error {
+	err := c.conn.Quit()
+	c.release()
+	return err
+}
+
+type ftpWriter struct {
+	name string
+	w    *io.PipeWriter
+	done chan error
+	once sync.Once
+	err  error
+}
+
+func (f *ftpWriter) Write(p []byte) (int, error) {
+	return f.w.Write(p)
+}
+
+func (f *ftpWriter) Close() error {
+	f.once.Do(func() {
+		f.w.Close()
+		if err := <-f.done; err != nil {
+			f.err = ftpError("create", f.name, err)
+		}
+	})
+	return f.err
+}
+
+type ftpFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func newFTPFileInfo(name string, entry *ftp.Entry) ftpFileInfo {
+	return ftpFileInfo{
+		name:    name,
+		size:    int64(entry.Size),
+		modTime: entry.Time,
+		dir:     entry.Type == ftp.EntryTypeFolder,
+	}
+}
+
+func (i ftpFileInfo) Name() string       { return i.name }
+func (i ftpFileInfo) Size() int64        { return i.size }
+func (i ftpFileInfo) ModTime() time.Time { return i.modTime }
+func (i ftpFileInfo) IsDir() bool        { return i.dir }
+func (i ftpFileInfo) Sys() any           { return nil }
+
+func (i ftpFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+func isFTPCode(err error, code int) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code == code
+}
+
+// ftpError reports a missing file as fs.ErrNotExist and a dropped
+// connection as ErrConnectionLost, as the sync expects.
+func ftpError(op, name string, err error) error {
+	var netErr net.Error
+	switch {
+	case isFTPCode(err, ftp.StatusFileUnavailable):
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	case isFTPCode(err, ftp.StatusNotAvailable), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &netErr):
+		return fmt.Errorf("%s %s: %w: %v", op, name, ErrConnectionLost, err)
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
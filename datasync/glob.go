@@ -0,0 +1,92 @@
+package datasync
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func hasGlob(dir string) bool {
+	return strings.ContainsAny(dir, "*?[")
+}
+
+// expandPairs replaces every pair whose RemoteDir is a glob with one pair
+// per matching remote directory. Each match is synced into the subfolder of
+// LocalDir named by its path below the glob's fixed prefix, so
+// "/data/*/exports" syncs "/data/a/exports" into LocalDir/a/exports.
+func (r *syncRun) expandPairs(pairs []DirPair) []DirPair {
+	var expanded []DirPair
+	for _, pair := range pairs {
+		if !hasGlob(pair.RemoteDir) {
+			expanded = append(expanded, pair)
+			continue
+		}
+
+		prefix, matches, err := r.globRemoteDirs(pair.RemoteDir)
+		if err != nil {
+			r.errorln("Failed to expand remoteDir", pair.RemoteDir, ":", err)
+			r.fail(pair.RemoteDir, err)
+			continue
+		}
+		r.infoln("remoteDir", pair.RemoteDir, "matched", len(matches), "directories")
+		for _, match := range matches {
+			rel := strings.TrimPrefix(strings.TrimPrefix(match, prefix), "/")
+			localDir := filepath.Join(pair.LocalDir, filepath.FromSlash(rel))
+			if !r.dryRun() {
+				if err := r.mkdirLocal(localDir); err != nil {
+					r.errorln("Failed to create local directory", localDir, ":", err)
+					r.fail(localDir, err)
+					continue
+				}
+			}
+			expanded = append(expanded, DirPair{LocalDir: localDir, RemoteDir: match})
+		}
+	}
+	return expanded
+}
+
+// globRemoteDirs returns the remote directories matching pattern, matching
+// one path element at a time with path.Match, together with the part of
+// the pattern before its first wildcard element.
+func (r *syncRun) globRemoteDirs(pattern string) (string, []string, error) {
+	elems := strings.Split(path.Clean(filepath.ToSlash(pattern)), "/")
+	first := 0
+	for first < len(elems) && !hasGlob(elems[first]) {
+		first++
+	}
+	prefix := strings.Join(elems[:first], "/")
+	if prefix == "" {
+		prefix = "/"
+	}
+
+	dirs := []string{prefix}
+	for _, elem := range elems[first:] {
+		var next []string
+		for _, dir := range dirs {
+			if !hasGlob(elem) {
+				if info, err := r.client.Stat(path.Join(dir, elem)); err == nil && info.IsDir() {
+					next = append(next, path.Join(dir, elem))
+				}
+				continue
+			}
+			entries, err := r.client.ReadDir(dir)
+			if err != nil {
+				return "", nil, err
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					continue
+				}
+				matched, err := path.Match(elem, entry.Name())
+				if err != nil {
+					return "", nil, err
+				}
+				if matched {
+					next = append(next, path.Join(dir, entry.Name()))
+				}
+			}
+		}
+		dirs = next
+	}
+	return prefix, dirs, nil
+}
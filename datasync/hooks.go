@@ -0,0 +1,86 @@
+package datasync
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// defaultHookTimeout bounds preCommand and postCommand when the config sets
+// no HookTimeout.
+const defaultHookTimeout = 5 * time.Minute
+
+func (r *syncRun) runPreCommand() error {
+	if r.config.PreCommand == "" {
+		return nil
+	}
+	return r.runHook(r.ctx, "preCommand", r.config.PreCommand, "running")
+}
+
+// runPostCommand runs even when the sync failed or was cancelled, so it is
+// not bound to the sync's context.
+func (r *syncRun) runPostCommand() {
+	if r.config.PostCommand == "" {
+		return
+	}
+	status := "succeeded"
+	if r.failed > 0 {
+		status = "failed"
+	}
+	r.runHook(context.Background(), "postCommand", r.config.PostCommand, status)
+}
+
+func (r *syncRun) runHook(ctx context.Context, name, command, status string) error {
+	if r.dryRun() {
+		r.infoln("Would run", name, ":", command)
+		return nil
+	}
+
+	timeout := defaultHookTimeout
+	if r.config.HookTimeout > 0 {
+		timeout = time.Duration(r.config.HookTimeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, command)
+	var localDirs, remoteDirs []string
+	for _, pair := range r.config.DirPairs() {
+		localDirs = append(localDirs, pair.LocalDir)
+		remoteDirs = append(remoteDirs, pair.RemoteDir)
+	}
+	cmd.Env = append(os.Environ(),
+		"DATASYNC_LOCAL_DIR="+strings.Join(localDirs, string(os.PathListSeparator)),
+		"DATASYNC_REMOTE_DIR="+strings.Join(remoteDirs, string(os.PathListSeparator)),
+		"DATASYNC_STATUS="+status,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if out := strings.TrimSpace(string(output)); out != "" {
+		r.infoln(name, "output:", out)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = ctx.Err()
+	}
+	if err != nil {
+		r.errorln(name, "failed:", err)
+		return err
+	}
+	return nil
+}
+
+// shellCommand returns a command running command in the system's shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	// Children of the shell may keep the output open after it is killed.
+	cmd.WaitDelay = time.Second
+	return cmd
+}
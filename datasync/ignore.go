@@ -0,0 +1,75 @@
+package datasync
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ignore "github.com/sabhiram/go-gitignore"
+)
+
+// ignoreFileName is the per-directory file of gitignore-style patterns
+// excluding source files and directories from the sync. Its patterns apply
+// to the directory it is in and everything below it.
+const ignoreFileName = ".datasyncignore"
+
+type ignoreRules struct {
+	dir     string
+	matcher *ignore.GitIgnore
+}
+
+// loadIgnoreRules reads the ignore file of a source directory, if any, and
+// returns a function dropping its rules again once the directory is done.
+func (r *syncRun) loadIgnoreRules(srcDir string) func() {
+	data, err := r.readSourceFile(joinSide(r.srcRemote(), srcDir, ignoreFileName))
+	if os.IsNotExist(err) {
+		return func() {}
+	}
+	if err != nil {
+		r.warnln("Ignoring", joinSide(r.srcRemote(), srcDir, ignoreFileName), ":", err)
+		return func() {}
+	}
+
+	r.ignores = append(r.ignores, ignoreRules{
+		dir:     srcDir,
+		matcher: ignore.CompileIgnoreLines(strings.Split(string(data), "\n")...),
+	})
+	n := len(r.ignores)
+	return func() {
+		r.ignores = r.ignores[:n-1]
+	}
+}
+
+func (r *syncRun) readSourceFile(path string) ([]byte, error) {
+	if r.config.direction() == "push" {
+		return os.ReadFile(path)
+	}
+	file, err := r.client.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// ignored reports whether a source file or directory matches the rules of
+// an ignore file in one of its parent directories.
+func (r *syncRun) ignored(srcPath string, isDir bool) bool {
+	for _, rules := range r.ignores {
+		rel, err := filepath.Rel(rules.dir, srcPath)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if isDir {
+			// Patterns ending in a slash only match directories.
+			rel += "/"
+		}
+		if rules.matcher.MatchesPath(rel) {
+			r.debugf("%s: skip (matches %s)", srcPath, joinSide(r.srcRemote(), rules.dir, ignoreFileName))
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package datasync
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// PairIndex lists the remote files of one directory pair.
+type PairIndex struct {
+	LocalDir  string `json:"localDir"`
+	RemoteDir string `json:"remoteDir"`
+	// Files are relative to RemoteDir, as for Diff, and have no Reason.
+	Files []DiffEntry `json:"files"`
+	Bytes int64       `json:"bytes"`
+}
+
+// Index lists the remote files a pull of config would consider, with their
+// size and ModTime, through the config's filters, ignore files and Only,
+// without transferring anything or looking at the local side.
+func (s *Syncer) Index(ctx context.Context, config Config) ([]PairIndex, error) {
+	if config.direction() != "pull" {
+		return nil, fmt.Errorf("index requires action pull or move-pull")
+	}
+	r, done, err := s.listingRun(ctx, config, "index")
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var indexes []PairIndex
+	for _, pair := range r.expandPairs(r.config.DirPairs()) {
+		r.config.LocalDir, r.config.RemoteDir = pair.LocalDir, pair.RemoteDir
+		r.root = pair.RemoteDir
+		// With nothing on the destination side every file is SourceOnly.
+		diff := PairDiff{SourceOnly: []DiffEntry{}}
+		if err := r.diffDir(pair.RemoteDir, pair.LocalDir, "", 0, nil, &diff, nil); err != nil {
+			return indexes, fmt.Errorf("unable to list %s: %w", pair.RemoteDir, err)
+		}
+		index := PairIndex{LocalDir: pair.LocalDir, RemoteDir: pair.RemoteDir, Files: diff.SourceOnly}
+		sort.Slice(index.Files, func(i, j int) bool { return index.Files[i].Path < index.Files[j].Path })
+		for _, file := range index.Files {
+			index.Bytes += file.Size
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, r.ctx.Err()
+}
+
+// RemotePath returns the remote path of file, a file of index.
+func (index PairIndex) RemotePath(file DiffEntry) string {
+	return path.Join(index.RemoteDir, file.Path)
+}
@@ -0,0 +1,33 @@
+package datasync
+
+// With SkipInFlight, a file another config of the same Syncer is
+// transferring between the same two paths at that moment is skipped rather
+// than transferred twice, for configs whose trees overlap. The next run
+// finds it up to date.
+
+// claimTransfer registers the transfer of src to dst, and returns the
+// function ending it. It returns false, having skipped src, when another
+// sync is transferring the same file.
+func (r *syncRun) claimTransfer(src, dst string) (func(), bool) {
+	if !r.config.SkipInFlight {
+		return func() {}, true
+	}
+	key := r.config.remoteHost() + "\x00" + src + "\x00" + dst
+	s := r.syncer
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight[key] {
+		r.infoln("Skipping", src, ": already being transferred by another config")
+		r.skip(src, "being transferred by another config")
+		return nil, false
+	}
+	if s.inFlight == nil {
+		s.inFlight = make(map[string]bool)
+	}
+	s.inFlight[key] = true
+	return func() {
+		s.mu.Lock()
+		delete(s.inFlight, key)
+		s.mu.Unlock()
+	}, true
+}
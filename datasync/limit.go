@@ -0,0 +1,101 @@
+package datasync
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTooManyErrors is the cause of a sync that MaxErrors stopped. The error
+// returned for it wraps this.
+var ErrTooManyErrors = errors.New("too many errors")
+
+// fileLimit counts the files a run transferred, including those of the
+// workers of a parallel date range, against MaxFilesPerRun, and their
+// errors against MaxErrors, and holds the deadline MaxRunDuration sets.
+type fileLimit struct {
+	files    atomic.Int64
+	reported atomic.Bool
+	failures atomic.Int64
+	// deadline is zero without MaxRunDuration. timeUp is set once it
+	// passed, and the walk then counts the entries it leaves unvisited in
+	// deferredFiles and deferredDirs.
+	deadline      time.Time
+	timeUp        atomic.Bool
+	deferredFiles atomic.Int64
+	deferredDirs  atomic.Int64
+}
+
+// countFile counts a transferred file, or one a dry run would transfer.
+func (r *syncRun) countFile() {
+	r.files++
+	r.limit.files.Add(1)
+}
+
+// limitReached reports whether MaxFilesPerRun files were transferred or
+// MaxRunDuration is over, so the walk ends and leaves the rest to the next
+// run. A transfer in progress is not interrupted.
+func (r *syncRun) limitReached() bool {
+	if d := r.limit.deadline; !d.IsZero() && !time.Now().Before(d) {
+		if !r.limit.timeUp.Swap(true) {
+			r.warnln("Run time limit reached, finishing transfers in progress and deferring the rest to next run")
+		}
+		return true
+	}
+	max := r.config.MaxFilesPerRun
+	if max <= 0 || r.limit.files.Load() < int64(max) {
+		return false
+	}
+	if !r.limit.reported.Swap(true) {
+		r.infoln("File limit reached, remaining files deferred to next run")
+	}
+	return true
+}
+
+// countFailure counts an error of the run, and stops it once there are
+// MaxErrors of them.
+func (r *syncRun) countFailure() {
+	n := r.limit.failures.Add(1)
+	if r.config.MaxErrors <= 0 || n != int64(r.config.MaxErrors) || r.ctx.Err() != nil {
+		return
+	}
+	err := fmt.Errorf("%w, aborting: %d errors reached maxErrors", ErrTooManyErrors, n)
+	r.errorln(err)
+	r.abort(err)
+}
+
+// deferEntries counts the entries of a directory the walk leaves once the
+// run time limit is over.
+func deferEntries[E interface{ IsDir() bool }](r *syncRun, entries []E) {
+	if !r.limit.timeUp.Load() {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			r.limit.deferredDirs.Add(1)
+		} else {
+			r.limit.deferredFiles.Add(1)
+		}
+	}
+}
+
+// reportDeferred logs what the run left to the next one because
+// MaxRunDuration was over.
+func (r *syncRun) reportDeferred() {
+	if !r.limit.timeUp.Load() {
+		return
+	}
+	msg := fmt.Sprintf("Stopped after maxRunDuration %s: %d files and %d directories not checked",
+		time.Duration(r.config.MaxRunDuration), r.limit.deferredFiles.Load(), r.limit.deferredDirs.Load())
+	var dates int
+	for _, date := range r.dates {
+		if !date.Synced && !date.Resumed {
+			dates++
+		}
+	}
+	if dates > 0 {
+		msg += fmt.Sprintf(", %d dates not started", dates)
+	}
+	r.warnln(msg + ", deferred to next run")
+}
@@ -0,0 +1,54 @@
+package datasync
+
+import (
+	"io"
+	"os"
+)
+
+// localClient is the Client for Protocol "local": the "remote" directory is
+// on a local or mounted filesystem.
+type localClient struct{}
+
+func (localClient) ReadDir(path string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			// Removed since the directory was read.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (localClient) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (localClient) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (localClient) Create(path string) (io.WriteCloser, error) {
+	return os.Create(path)
+}
+
+func (localClient) MkdirAll(path string) error {
+	return os.MkdirAll(path, defaultDirMode)
+}
+
+func (localClient) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (localClient) Close() error {
+	return nil
+}
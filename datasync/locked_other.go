@@ -0,0 +1,9 @@
+//go:build !windows
+
+package datasync
+
+// isFileLocked always reports false: other platforms do not use mandatory
+// file locks that make os.Open fail.
+func isFileLocked(err error) bool {
+	return false
+}
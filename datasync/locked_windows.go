@@ -0,0 +1,15 @@
+//go:build windows
+
+package datasync
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// isFileLocked reports whether err is the sharing or lock violation Windows
+// returns when opening a file another process holds open exclusively.
+func isFileLocked(err error) bool {
+	return errors.Is(err, windows.ERROR_SHARING_VIOLATION) || errors.Is(err, windows.ERROR_LOCK_VIOLATION)
+}
@@ -0,0 +1,93 @@
+package datasync
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Log levels of a config, from most to least verbose. Failures are logged
+// at levelError, conditions worth a look at levelWarn, and progress such as
+// transferred files at levelInfo.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// ANSI colors of the log lines with Syncer.Color.
+const (
+	colorReset  = "\x1b[0m"
+	colorGray   = "\x1b[90m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorRed    = "\x1b[31m"
+)
+
+var levelColors = map[int]string{
+	levelDebug: colorGray,
+	levelWarn:  colorYellow,
+	levelError: colorRed,
+}
+
+var logLevels = map[string]int{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// newLogger returns a logger writing to the standard logger's output with
+// the config's Key in front of every message.
+func newLogger(config Config) *log.Logger {
+	return log.New(log.Writer(), "["+config.Key()+"] ", log.Flags()|log.Lmsgprefix)
+}
+
+func (r *syncRun) level() int {
+	if r.syncer.Debug {
+		return levelDebug
+	}
+	if level, ok := logLevels[r.config.LogLevel]; ok {
+		return level
+	}
+	return levelInfo
+}
+
+// output logs msg, in color when the Syncer asks for it. The color only
+// wraps the message, so the timestamp and the config's prefix stay plain.
+func (r *syncRun) output(color, msg string) {
+	msg = strings.TrimSuffix(msg, "\n")
+	if r.syncer.Color && color != "" {
+		msg = color + msg + colorReset
+	}
+	r.logger.Output(3, msg)
+}
+
+func (r *syncRun) logln(level int, args ...any) {
+	if level >= r.level() {
+		r.output(levelColors[level], fmt.Sprintln(args...))
+	}
+}
+
+func (r *syncRun) infoln(args ...any)  { r.logln(levelInfo, args...) }
+func (r *syncRun) warnln(args ...any)  { r.logln(levelWarn, args...) }
+func (r *syncRun) errorln(args ...any) { r.logln(levelError, args...) }
+
+// transferln logs a completed transfer, at levelInfo but in its own color.
+// With QuietTransfers only debug logging shows them, and the run ends with
+// a summary instead.
+func (r *syncRun) transferln(args ...any) {
+	if r.config.QuietTransfers && r.level() != levelDebug {
+		return
+	}
+	if levelInfo >= r.level() {
+		r.output(colorGreen, fmt.Sprintln(args...))
+	}
+}
+
+func (r *syncRun) debugf(format string, args ...any) {
+	if r.level() == levelDebug {
+		r.output(colorGray, fmt.Sprintf("DEBUG "+format, args...))
+	}
+}
@@ -0,0 +1,174 @@
+package datasync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// manifestName is the per-directory file recording what DataSync
+// transferred. It always lives in the local directory, whichever side is
+// the source, because only local files can be hashed cheaply.
+const manifestName = ".datasync-manifest.json"
+
+type manifestEntry struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+type manifest struct {
+	dir     string
+	entries map[string]manifestEntry
+	dirty   bool
+	hash    func(path string) (string, error)
+}
+
+func loadManifest(dir string) (*manifest, error) {
+	m := &manifest{dir: dir, entries: make(map[string]manifestEntry), hash: fileSHA256}
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &m.entries); err != nil {
+		return nil, fmt.Errorf("unable to parse manifest %s: %w", filepath.Join(dir, manifestName), err)
+	}
+	return m, nil
+}
+
+// record hashes the local copy of name and stores it in the manifest.
+func (m *manifest) record(name string) (manifestEntry, error) {
+	path := filepath.Join(m.dir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	sum, err := m.hash(path)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	entry := manifestEntry{SHA256: sum, Size: info.Size()}
+	m.entries[name] = entry
+	m.dirty = true
+	return entry, nil
+}
+
+// changed reports whether name no longer matches its manifest entry, either
+// because the local file was rewritten without its ModTime changing or
+// because the other side's copy has a different size. A file without an
+// entry is recorded as-is and reported unchanged.
+func (m *manifest) changed(name string, localInfo, otherInfo os.FileInfo) (bool, error) {
+	entry, ok := m.entries[name]
+	if !ok {
+		_, err := m.record(name)
+		return false, err
+	}
+	if entry.Size != localInfo.Size() || entry.Size != otherInfo.Size() {
+		return true, nil
+	}
+	sum, err := m.hash(filepath.Join(m.dir, name))
+	if err != nil {
+		return false, err
+	}
+	return sum != entry.SHA256, nil
+}
+
+// save atomically replaces the manifest file if any entry changed.
+func (m *manifest) save() error {
+	if !m.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(m.entries, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(m.dir, manifestName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(m.dir, manifestName)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	m.dirty = false
+	return nil
+}
+
+func (r *syncRun) openManifest(localDir string) *manifest {
+	if !r.config.UseManifest {
+		return nil
+	}
+	m, err := loadManifest(localDir)
+	if err != nil {
+		r.warnln("Ignoring manifest:", err)
+		m = &manifest{dir: localDir, entries: make(map[string]manifestEntry)}
+	}
+	m.hash = r.localSHA256
+	return m
+}
+
+func (r *syncRun) closeManifest(m *manifest) {
+	if m == nil || r.dryRun() {
+		return
+	}
+	if err := m.save(); err != nil {
+		r.errorln("Failed to save manifest in", m.dir, ":", err)
+	}
+}
+
+// manifestChanged applies the manifest check to a file the ModTime
+// comparison decided to skip.
+func (r *syncRun) manifestChanged(m *manifest, name string, localInfo, otherInfo os.FileInfo) bool {
+	if m == nil {
+		return false
+	}
+	changed, err := m.changed(name, localInfo, otherInfo)
+	if err != nil {
+		r.errorln("Failed to check manifest for", filepath.Join(m.dir, name), ":", err)
+		return false
+	}
+	if changed {
+		r.warnln("Manifest mismatch, transferring again:", filepath.Join(m.dir, name))
+		r.reason = "manifest mismatch"
+	}
+	return changed
+}
+
+func (r *syncRun) recordManifest(m *manifest, name string) {
+	if m == nil {
+		return
+	}
+	if _, err := m.record(name); err != nil {
+		r.errorln("Failed to update manifest for", filepath.Join(m.dir, name), ":", err)
+	}
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,107 @@
+package datasync
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSlowestDirs is how many directories Result.SlowestDirs lists.
+const maxSlowestDirs = 5
+
+// peakRateMinDuration is how long a transfer must take to count towards
+// Result.PeakRate. Faster ones mostly measure the latency of opening and
+// closing the file.
+const peakRateMinDuration = 250 * time.Millisecond
+
+// DirTiming is how long the sync spent in a source directory, not counting
+// its subdirectories, and what it transferred there.
+type DirTiming struct {
+	Dir      string
+	Duration time.Duration
+	Files    int
+	Bytes    int64
+}
+
+// runMetrics collects the timings of a run, including those of the workers
+// of a parallel date range.
+type runMetrics struct {
+	mu           sync.Mutex
+	transferTime time.Duration
+	peakRate     float64
+	slowest      []DirTiming
+}
+
+// dirMark is taken by startDir when a directory is entered, and handed to
+// completeDir when it is done.
+type dirMark struct {
+	stats   DirStats
+	started time.Time
+	nested  DirTiming
+	// span is the directory's trace span, parentSpan the one it replaced.
+	span, parentSpan *span
+}
+
+// AverageRate is the number of bytes transferred per second of
+// TransferTime.
+func (r Result) AverageRate() float64 {
+	if r.TransferTime <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.TransferTime.Seconds()
+}
+
+func (m *runMetrics) addTransfer(bytes int64, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transferTime += elapsed
+	if elapsed >= peakRateMinDuration {
+		m.peakRate = max(m.peakRate, float64(bytes)/elapsed.Seconds())
+	}
+}
+
+func (m *runMetrics) addDir(dir DirTiming) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := sort.Search(len(m.slowest), func(i int) bool { return m.slowest[i].Duration < dir.Duration })
+	if i == maxSlowestDirs {
+		return
+	}
+	m.slowest = append(m.slowest, DirTiming{})
+	copy(m.slowest[i+1:], m.slowest[i:])
+	m.slowest[i] = dir
+	if len(m.slowest) > maxSlowestDirs {
+		m.slowest = m.slowest[:maxSlowestDirs]
+	}
+}
+
+// fill copies the metrics into result.
+func (m *runMetrics) fill(result *Result) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result.TransferTime = m.transferTime
+	result.PeakRate = m.peakRate
+	result.SlowestDirs = append([]DirTiming(nil), m.slowest...)
+}
+
+// startDir marks the start of the source directory about to be synced.
+func (r *syncRun) startDir() dirMark {
+	mark := dirMark{stats: r.stats(), started: time.Now(), nested: r.nested}
+	if s := r.startSpan("directory"); s != nil {
+		mark.span, mark.parentSpan = s, r.span
+		r.span = s
+	}
+	return mark
+}
+
+// dirTiming returns the timing of dir since mark, leaving out what the
+// directories completed in between took, which are its subdirectories.
+func (r *syncRun) dirTiming(dir string, mark dirMark) DirTiming {
+	now := r.stats()
+	return DirTiming{
+		Dir:      dir,
+		Duration: time.Since(mark.started) - (r.nested.Duration - mark.nested.Duration),
+		Files:    now.Files - mark.stats.Files - (r.nested.Files - mark.nested.Files),
+		Bytes:    now.Bytes - mark.stats.Bytes - (r.nested.Bytes - mark.nested.Bytes),
+	}
+}
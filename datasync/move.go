@@ -0,0 +1,113 @@
+package datasync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// removeSource deletes the source copy of a file just transferred by a move
+// action, once the checksums of both copies match. A file whose copies
+// differ is left in place and reported as a failure.
+func (r *syncRun) removeSource(localFilePath, remoteFilePath string) error {
+	// Only the unchanged source may come from the checksum cache; the copy
+	// just written is always hashed in full.
+	var localSum, remoteSum string
+	var err error
+	if r.config.direction() == "pull" {
+		localSum, err = fileSHA256(localFilePath)
+	} else {
+		localSum, err = r.localSHA256(localFilePath)
+	}
+	if err != nil {
+		r.errorln("Failed to verify", localFilePath, ", keeping the source:", err)
+		return err
+	}
+	if r.config.direction() == "pull" {
+		remoteSum, err = r.remoteSHA256(remoteFilePath)
+	} else {
+		remoteSum, err = r.hashRemoteFile(remoteFilePath)
+	}
+	if err != nil {
+		r.errorln("Failed to verify", remoteFilePath, ", keeping the source:", err)
+		return err
+	}
+	if localSum != remoteSum {
+		err := fmt.Errorf("checksum mismatch between %s and %s", localFilePath, remoteFilePath)
+		r.warnln("Keeping the source:", err)
+		return err
+	}
+
+	var size int64
+	if info, err := os.Stat(localFilePath); err == nil {
+		size = info.Size()
+	}
+	if r.config.direction() == "pull" {
+		err = r.client.Remove(remoteFilePath)
+	} else {
+		err = os.Remove(localFilePath)
+	}
+	r.auditRemoval(localFilePath, remoteFilePath, size, localSum, err)
+	if err != nil {
+		r.errorln("Failed to remove source file after transfer:", err)
+		return err
+	}
+	r.debugf("%s: source removed after verified transfer", r.sourcePath(localFilePath, remoteFilePath))
+	return nil
+}
+
+func (r *syncRun) sourcePath(localFilePath, remoteFilePath string) string {
+	if r.config.direction() == "pull" {
+		return remoteFilePath
+	}
+	return localFilePath
+}
+
+// removeEmptyRemoteDir removes a remote subdirectory a move-pull emptied.
+func (r *syncRun) removeEmptyRemoteDir(dir string) {
+	if !r.config.moves() || !r.config.RemoveEmptyDirs {
+		return
+	}
+	entries, err := r.client.ReadDir(dir)
+	if err != nil || len(entries) > 0 {
+		return
+	}
+	if r.dryRun() {
+		r.infoln("Would remove empty directory", dir)
+		return
+	}
+	if err := r.client.Remove(dir); err != nil {
+		r.errorln("Failed to remove empty remote directory", dir, ":", err)
+		return
+	}
+	r.debugf("%s: removed empty directory", dir)
+}
+
+// removeEmptyLocalDir removes a local subdirectory a move-push emptied. A
+// manifest left behind does not count as content.
+func (r *syncRun) removeEmptyLocalDir(dir string) {
+	if !r.config.moves() || !r.config.RemoveEmptyDirs {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() != manifestName {
+			return
+		}
+	}
+	if r.dryRun() {
+		r.infoln("Would remove empty directory", dir)
+		return
+	}
+	if len(entries) > 0 {
+		os.Remove(filepath.Join(dir, manifestName))
+	}
+	if err := os.Remove(dir); err != nil {
+		r.errorln("Failed to remove empty local directory", dir, ":", err)
+		return
+	}
+	r.debugf("%s: removed empty directory", dir)
+}
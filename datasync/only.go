@@ -0,0 +1,43 @@
+package datasync
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// within reports whether path, an entry below the directory being synced,
+// lies inside one of Syncer.Only or on the way to one, and so is visited.
+func (r *syncRun) within(path string, dir bool) bool {
+	if r.inOnly(path, dir) {
+		return true
+	}
+	r.debugf("%s: skip (not in Only)", path)
+	return false
+}
+
+func (r *syncRun) inOnly(path string, dir bool) bool {
+	if r.plan.applying() {
+		return r.plan.includes(path, dir)
+	}
+	only := r.syncer.Only
+	if r.changed != nil {
+		only = r.only
+	} else if len(only) == 0 {
+		return true
+	}
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil {
+		return true
+	}
+	sep := string(filepath.Separator)
+	for _, only := range only {
+		only = filepath.Clean(only)
+		if rel == only || strings.HasPrefix(rel, only+sep) {
+			return true
+		}
+		if dir && strings.HasPrefix(only, rel+sep) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package datasync
+
+import (
+	"os"
+
+	"github.com/pkg/sftp"
+)
+
+// preserveOwnership gives a downloaded file the uid and gid of its remote
+// original. Failing to do so, e.g. when not running as root or on Windows,
+// only warns, once per run.
+func (r *syncRun) preserveOwnership(localFilePath string, remoteInfo os.FileInfo) {
+	if !r.config.PreserveOwnership || r.ownershipWarned {
+		return
+	}
+	stat, ok := remoteInfo.Sys().(*sftp.FileStat)
+	if !ok {
+		r.warnln("Not preserving ownership: the server does not report file owners")
+		r.ownershipWarned = true
+		return
+	}
+	if err := os.Chown(localFilePath, int(stat.UID), int(stat.GID)); err != nil {
+		r.warnln("Not preserving ownership:", err)
+		r.ownershipWarned = true
+	}
+}
@@ -0,0 +1,42 @@
+package datasync
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// MaxPacketSize raises the size of the SFTP read and write requests above
+// the 32 KB every server supports, so that as many requests in flight as
+// ConcurrentRequests carry more data. A server that caps reads below it
+// answers them short, which the pipelined download of *sftp.File takes
+// for the end of a range and silently drops data, so downloads are checked
+// against the size of the remote file.
+
+func (c Config) validatePacketSize() error {
+	if c.MaxPacketSize < 0 {
+		return fmt.Errorf("maxPacketSize must not be negative")
+	}
+	if c.MaxPacketSize > 0 && c.protocol() != "sftp" {
+		return fmt.Errorf("maxPacketSize is only supported for protocol sftp")
+	}
+	return nil
+}
+
+// checkPacketSize fails the download of remoteFile, which copied n bytes,
+// when that is fewer than the file has.
+func (r *syncRun) checkPacketSize(remoteFile io.Reader, remoteFilePath string, n int64) error {
+	file, ok := remoteFile.(interface{ Stat() (os.FileInfo, error) })
+	if r.config.MaxPacketSize == 0 || !ok {
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if n < info.Size() {
+		return fmt.Errorf("downloaded %d of the %d bytes of %s: the server may not support maxPacketSize %d",
+			n, info.Size(), remoteFilePath, r.config.MaxPacketSize)
+	}
+	return nil
+}
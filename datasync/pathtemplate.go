@@ -0,0 +1,150 @@
+package datasync
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// LocalDir, RemoteDir, LocalDirs and RemoteDirs may contain text/template
+// actions such as {{.Env}}, with the fields of pathVars. Every run resolves
+// them before it looks at the paths. The date fields are the day the run
+// starts, or in a date range sync each date synced, which then takes the
+// place of the date subfolder.
+
+// pathVars are the variables of path templates.
+type pathVars struct {
+	// Name is the config's name, Host the name of the machine DataSync runs
+	// on and Env the config's Env.
+	Name string
+	Host string
+	Env  string
+	// Date is formatted with DateLayout.
+	Date  string
+	Year  string
+	Month string
+	Day   string
+}
+
+// hasPathTemplates reports whether any directory of c is a template.
+func (c Config) hasPathTemplates() bool {
+	for _, pair := range c.DirPairs() {
+		if strings.Contains(pair.LocalDir, "{{") || strings.Contains(pair.RemoteDir, "{{") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Config) validatePathTemplates() error {
+	if !c.hasPathTemplates() {
+		return nil
+	}
+	// Without a name the key of the config would change with the paths.
+	if c.Name == "" {
+		return fmt.Errorf("templates in localDir or remoteDir require a name")
+	}
+	if _, err := c.ResolvePaths(time.Now()); err != nil {
+		return err
+	}
+	if !c.datedPaths() {
+		return nil
+	}
+	for _, pair := range c.DirPairs() {
+		if hasGlob(pair.RemoteDir) {
+			return fmt.Errorf("date variables in paths cannot be combined with a glob in remoteDir")
+		}
+	}
+	switch {
+	case c.RetentionDays > 0:
+		return fmt.Errorf("date variables in paths cannot be combined with retentionDays")
+	case c.WatchLocal:
+		return fmt.Errorf("date variables in paths cannot be combined with watchLocal")
+	}
+	return nil
+}
+
+// datedPaths reports whether the directories of c depend on the date.
+func (c Config) datedPaths() bool {
+	a, errA := c.ResolvePaths(time.Date(2001, 2, 3, 0, 0, 0, 0, time.UTC))
+	b, errB := c.ResolvePaths(time.Date(2002, 4, 5, 0, 0, 0, 0, time.UTC))
+	if errA != nil || errB != nil {
+		return false
+	}
+	pairsA, pairsB := a.DirPairs(), b.DirPairs()
+	for i := range pairsA {
+		if pairsA[i] != pairsB[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolvePaths returns c with the templates in its directories resolved for
+// date.
+func (c Config) ResolvePaths(date time.Time) (Config, error) {
+	if !c.hasPathTemplates() {
+		return c, nil
+	}
+	vars, err := c.pathVars(date)
+	if err != nil {
+		return c, err
+	}
+	resolve := func(dir *string) {
+		if err == nil {
+			*dir, err = renderPath(*dir, vars)
+		}
+	}
+	resolve(&c.LocalDir)
+	resolve(&c.RemoteDir)
+	c.LocalDirs = append([]string(nil), c.LocalDirs...)
+	c.RemoteDirs = append([]string(nil), c.RemoteDirs...)
+	for i := range c.LocalDirs {
+		resolve(&c.LocalDirs[i])
+	}
+	for i := range c.RemoteDirs {
+		resolve(&c.RemoteDirs[i])
+	}
+	return c, err
+}
+
+// resolvePair resolves the templates of pair, a directory pair of c, for
+// date.
+func (c Config) resolvePair(pair DirPair, date time.Time) (DirPair, error) {
+	c.LocalDir, c.RemoteDir, c.LocalDirs, c.RemoteDirs = pair.LocalDir, pair.RemoteDir, nil, nil
+	c, err := c.ResolvePaths(date)
+	return DirPair{c.LocalDir, c.RemoteDir}, err
+}
+
+func (c Config) pathVars(date time.Time) (pathVars, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return pathVars{}, fmt.Errorf("unable to resolve the path templates: %w", err)
+	}
+	return pathVars{
+		Name:  c.Name,
+		Host:  host,
+		Env:   c.Env,
+		Date:  date.Format(c.dateLayout()),
+		Year:  date.Format("2006"),
+		Month: date.Format("01"),
+		Day:   date.Format("02"),
+	}, nil
+}
+
+func renderPath(dir string, vars pathVars) (string, error) {
+	if !strings.Contains(dir, "{{") {
+		return dir, nil
+	}
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(dir)
+	if err != nil {
+		return "", fmt.Errorf("invalid path template %q: %w", dir, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("invalid path template %q: %w", dir, err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,150 @@
+package datasync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A dry run records the transfers and removals it would carry out in
+// Result.Planned, so that they can be reviewed and then carried out with
+// Apply. Apply syncs only the planned paths, and re-checks each of them as
+// a sync would, skipping those the comparisons no longer transfer or
+// retention no longer removes, and those whose source changed since the
+// plan was made.
+
+// PlannedOp is a transfer or removal a dry run would have carried out.
+type PlannedOp struct {
+	// Action is "download", "upload" or "copy" for a transfer, "archive"
+	// or "extract" with ArchiveMode, and "remove" for a removal by
+	// RetentionDays or SourceRetention.
+	Action string `json:"action"`
+	// Source is the file transferred, or the file or date directory
+	// removed, as the sync logs them.
+	Source string `json:"source"`
+	Dest   string `json:"dest,omitempty"`
+	// Size and ModTime describe the source file when the plan was made.
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"modTime"`
+	// RemoveSource marks the transfers of a move- action, which remove the
+	// source file once it is transferred.
+	RemoveSource bool   `json:"removeSource,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// runPlan is what a run records as planned and, for Apply, what it is to
+// carry out. It is shared by the workers of a parallel date range.
+type runPlan struct {
+	mu      sync.Mutex
+	planned []PlannedOp
+
+	// transfers and removals hold the operations Apply carries out by
+	// their slash-separated source paths, as a file may be both uploaded
+	// and removed, and dirs the directories containing them.
+	transfers map[string]PlannedOp
+	removals  map[string]PlannedOp
+	dirs      map[string]bool
+}
+
+func (p *runPlan) record(op PlannedOp) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.planned = append(p.planned, op)
+}
+
+// applying reports whether the run carries out a plan.
+func (p *runPlan) applying() bool {
+	return p != nil && p.transfers != nil
+}
+
+// includes reports whether the file path is planned, or for a directory
+// whether a planned path lies below it.
+func (p *runPlan) includes(path string, dir bool) bool {
+	key := filepath.ToSlash(path)
+	if dir {
+		return p.dirs[key]
+	}
+	_, transfer := p.transfers[key]
+	_, removal := p.removals[key]
+	return transfer || removal
+}
+
+// Apply carries out the operations of a plan recorded by a dry run of
+// config, syncing only their source paths. A planned transfer is skipped
+// when its source no longer has the planned size and ModTime, or when the
+// config's comparisons find the destination up to date by now; a planned
+// removal when the retention that planned it no longer applies. Apply does
+// not support ArchiveMode.
+func (s *Syncer) Apply(ctx context.Context, config Config, ops []PlannedOp) (Result, error) {
+	if config.archiveMode() != "" {
+		return Result{}, fmt.Errorf("apply is not supported with archiveMode")
+	}
+	plan := &runPlan{transfers: make(map[string]PlannedOp), removals: make(map[string]PlannedOp), dirs: make(map[string]bool)}
+	for _, op := range ops {
+		key := filepath.ToSlash(op.Source)
+		if op.Action == "remove" {
+			plan.removals[key] = op
+		} else {
+			plan.transfers[key] = op
+		}
+		for dir := path.Dir(key); !plan.dirs[dir]; dir = path.Dir(dir) {
+			plan.dirs[dir] = true
+		}
+	}
+	return s.sync(ctx, config, "", "", nil, plan)
+}
+
+// planTransfer logs a transfer a dry run skips and records it in the plan,
+// counting it as if it had happened. info describes the source file, and
+// is nil for the archives of ArchiveMode.
+func (r *syncRun) planTransfer(verb, src, dst string, info os.FileInfo) {
+	r.infoln("Would", verb, src, "to", dst)
+	if r.config.moves() {
+		r.infoln("Would remove source file", src)
+	}
+	op := PlannedOp{Action: verb, Source: src, Dest: dst, RemoveSource: r.config.moves(), Reason: r.reason}
+	if info != nil {
+		op.Size, op.ModTime = info.Size(), info.ModTime()
+	}
+	r.plan.record(op)
+	r.countFile()
+}
+
+// planRemoval records the removal of path a dry run skips. info describes
+// a file, and is nil for a directory.
+func (r *syncRun) planRemoval(path, reason string, info os.FileInfo) {
+	op := PlannedOp{Action: "remove", Source: path, Reason: reason}
+	if info != nil {
+		op.Size, op.ModTime = info.Size(), info.ModTime()
+	}
+	r.plan.record(op)
+}
+
+// offPlan reports whether Apply is to leave path alone: it is not planned
+// to be transferred, or to be removed with removal, or its source, which
+// info describes unless it is a directory, changed since the plan was
+// made.
+func (r *syncRun) offPlan(path string, info os.FileInfo, removal bool) bool {
+	if !r.plan.applying() {
+		return false
+	}
+	ops := r.plan.transfers
+	if removal {
+		ops = r.plan.removals
+	}
+	op, ok := ops[filepath.ToSlash(path)]
+	switch {
+	case !ok:
+		r.debugf("%s: skip (not in the plan)", path)
+	case info != nil && (info.Size() != op.Size || !info.ModTime().Equal(op.ModTime)):
+		r.infoln("Skipping", path, ": changed since the plan was made")
+		r.skip(path, "changed since the plan was made")
+	default:
+		return false
+	}
+	return true
+}
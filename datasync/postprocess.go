@@ -0,0 +1,139 @@
+package datasync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// With PostProcessCommand every pulled file matching PostProcessGlob is
+// handed to the command once it is downloaded, and verified if
+// VerifyAfterPush is set. With PostProcessOutput the command's standard
+// output replaces the file. A failed command fails the file and removes
+// the local copy, so the next run downloads and processes it again, and a
+// move keeps the source.
+
+// defaultPostProcessTimeout bounds a PostProcessCommand when the config
+// sets no PostProcessTimeout.
+const defaultPostProcessTimeout = 5 * time.Minute
+
+func (c Config) validatePostProcess() error {
+	if c.PostProcessCommand == "" {
+		if c.PostProcessGlob != "" || c.PostProcessOutput {
+			return fmt.Errorf("postProcessGlob and postProcessOutput require postProcessCommand")
+		}
+		return nil
+	}
+	if c.direction() != "pull" {
+		return fmt.Errorf("postProcessCommand requires action pull or move-pull")
+	}
+	if _, err := path.Match(c.PostProcessGlob, ""); err != nil {
+		return fmt.Errorf("invalid postProcessGlob: %w", err)
+	}
+	if c.PostProcessTimeout < 0 {
+		return fmt.Errorf("postProcessTimeout must not be negative")
+	}
+	// The processed file no longer has the remote size and content.
+	if c.PostProcessOutput && c.StateDBPath == "" && c.compareMode() != "modtime" {
+		return fmt.Errorf("postProcessOutput requires compareMode modtime or a stateDBPath")
+	}
+	return nil
+}
+
+// postProcesses reports whether PostProcessCommand applies to the remote
+// file. A glob with a slash is matched against the path below the synced
+// directory, one without against the file name.
+func (r *syncRun) postProcesses(remoteFilePath string) bool {
+	if r.config.PostProcessCommand == "" {
+		return false
+	}
+	glob := r.config.PostProcessGlob
+	if glob == "" {
+		return true
+	}
+	name := path.Base(toRemote(remoteFilePath))
+	if strings.Contains(glob, "/") {
+		rel, ok := remoteRel(r.root, remoteFilePath)
+		if !ok {
+			return false
+		}
+		name = rel
+	}
+	matched, _ := path.Match(glob, name)
+	return matched
+}
+
+// postProcess runs PostProcessCommand on a file just downloaded to
+// localFilePath, and removes the file if it fails.
+func (r *syncRun) postProcess(localFilePath, remoteFilePath string) error {
+	if !r.postProcesses(remoteFilePath) {
+		return nil
+	}
+	err := r.runPostProcess(localFilePath, remoteFilePath)
+	if err != nil {
+		os.Remove(localFilePath)
+		return fmt.Errorf("postProcessCommand failed: %w", err)
+	}
+	r.debugf("%s: post-processed", localFilePath)
+	return nil
+}
+
+func (r *syncRun) runPostProcess(localFilePath, remoteFilePath string) error {
+	timeout := defaultPostProcessTimeout
+	if r.config.PostProcessTimeout > 0 {
+		timeout = time.Duration(r.config.PostProcessTimeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, timeout)
+	defer cancel()
+
+	// The path is passed through the environment, so it needs no quoting.
+	command := r.config.PostProcessCommand + ` "$DATASYNC_FILE"`
+	if runtime.GOOS == "windows" {
+		command = r.config.PostProcessCommand + ` "%DATASYNC_FILE%"`
+	}
+	cmd := shellCommand(ctx, command)
+	cmd.Env = append(os.Environ(),
+		"DATASYNC_FILE="+localFilePath,
+		"DATASYNC_REMOTE_FILE="+remoteFilePath,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	var output *os.File
+	if r.config.PostProcessOutput {
+		var err error
+		output, err = os.CreateTemp(filepath.Dir(localFilePath), "."+filepath.Base(localFilePath)+".datasync-post-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(output.Name())
+		defer output.Close()
+		cmd.Stdout = output
+	} else {
+		cmd.Stdout = &stderr
+	}
+
+	err := cmd.Run()
+	if out := strings.TrimSpace(stderr.String()); out != "" {
+		r.infoln("postProcessCommand output for", localFilePath, ":", out)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = ctx.Err()
+	}
+	if err != nil || output == nil {
+		return err
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(localFilePath); err == nil {
+		os.Chmod(output.Name(), info.Mode().Perm())
+	}
+	return os.Rename(output.Name(), localFilePath)
+}
@@ -0,0 +1,143 @@
+package datasync
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTPProxy, or else the HTTPS_PROXY environment variable, tunnels SFTP
+// connections through an HTTP proxy with CONNECT, for networks where only
+// the proxy may connect out. Credentials in the proxy URL are sent with
+// basic authentication.
+
+// proxyHandshakeTimeout bounds the CONNECT exchange with the proxy.
+const proxyHandshakeTimeout = 30 * time.Second
+
+func (c Config) validateProxy() error {
+	if c.HTTPProxy == "" {
+		return nil
+	}
+	if c.protocol() != "sftp" {
+		return fmt.Errorf("httpProxy is only supported for protocol sftp")
+	}
+	if _, err := parseProxyURL(c.HTTPProxy); err != nil {
+		return fmt.Errorf("invalid httpProxy: %w", err)
+	}
+	return nil
+}
+
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, must be http or https", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s has no host", u.Redacted())
+	}
+	return u, nil
+}
+
+// proxyFor returns the proxy to reach addr through: HTTPProxy, or the one
+// the environment gives for it, which honors NO_PROXY. It is nil for a
+// direct connection.
+func (c Config) proxyFor(addr string) (*url.URL, error) {
+	if c.HTTPProxy != "" {
+		return parseProxyURL(c.HTTPProxy)
+	}
+	req := &http.Request{URL: &url.URL{Scheme: "https", Host: addr}}
+	u, err := http.ProxyFromEnvironment(req)
+	if err != nil || u == nil {
+		return nil, err
+	}
+	return parseProxyURL(u.String())
+}
+
+// dialThroughProxy opens a tunnel to addr through the HTTP proxy, or a
+// direct connection when there is none.
+func dialThroughProxy(config Config, addr string, timeout time.Duration) (net.Conn, error) {
+	proxy, err := config.proxyFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		port := "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+	}
+	tunnel, err := proxyConnect(conn, proxy, addr)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Redacted(), err)
+	}
+	return tunnel, nil
+}
+
+// proxyConnect asks the proxy on conn for a tunnel to addr.
+func proxyConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return nil, fmt.Errorf("CONNECT %s failed: %s", addr, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The proxy could not reach addr, which dialRetries and
+		// fallbackHosts handle like a server that cannot be dialed.
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("CONNECT %s failed: %s", addr, resp.Status)}
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn reads what the proxy sent past its response, such as the
+// SSH server's version line, before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,42 @@
+package datasync
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// TestProxyConnectRefusals checks which CONNECT refusals count as dial
+// errors, which dialRetries and fallbackHosts act on.
+func TestProxyConnectRefusals(t *testing.T) {
+	tests := []struct {
+		status int
+		dial   bool
+	}{
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusGatewayTimeout, true},
+		{http.StatusForbidden, true},
+		{http.StatusProxyAuthRequired, false},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			buf := make([]byte, 4096)
+			server.Read(buf)
+			fmt.Fprintf(server, "HTTP/1.1 %d %s\r\n\r\n", tt.status, http.StatusText(tt.status))
+		}()
+		proxy := &url.URL{Scheme: "http", Host: "proxy:3128"}
+		_, err := proxyConnect(client, proxy, "sftp.example.com:22")
+		client.Close()
+		if err == nil {
+			t.Fatalf("status %d: CONNECT succeeded", tt.status)
+		}
+		if got := isDialError(err); got != tt.dial {
+			t.Errorf("status %d: isDialError(%v) = %v, want %v", tt.status, err, got, tt.dial)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package datasync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// With ReadOnlyRemote a config may only read from its remote side, as for
+// a partner server that must never be written to. Settings that would
+// write to it are rejected when the config is validated, and on top of
+// that the connection refuses every write, so that no code path of a sync
+// can issue one.
+
+var errReadOnlyRemote = errors.New("the remote is read-only (readOnlyRemote)")
+
+func (c Config) validateReadOnlyRemote() error {
+	if !c.ReadOnlyRemote {
+		return nil
+	}
+	switch {
+	case c.direction() == "push":
+		return fmt.Errorf("action %s writes to the remote, which readOnlyRemote forbids", c.Action)
+	case c.moves():
+		return fmt.Errorf("action %s removes remote files, which readOnlyRemote forbids", c.Action)
+	case c.MaxClockSkew > 0:
+		return fmt.Errorf("maxClockSkew writes a probe file to the remote, which readOnlyRemote forbids")
+	}
+	return nil
+}
+
+// readOnlyClient is the remote side of a config with ReadOnlyRemote.
+type readOnlyClient struct {
+	Client
+}
+
+func (c readOnlyClient) Create(path string) (io.WriteCloser, error) {
+	return nil, &fs.PathError{Op: "create", Path: path, Err: errReadOnlyRemote}
+}
+
+func (c readOnlyClient) MkdirAll(path string) error {
+	return &fs.PathError{Op: "mkdir", Path: path, Err: errReadOnlyRemote}
+}
+
+func (c readOnlyClient) Remove(path string) error {
+	return &fs.PathError{Op: "remove", Path: path, Err: errReadOnlyRemote}
+}
+
+// clientAs returns c as a T, looking through a readOnlyClient, for the
+// optional interfaces of Clients that only read.
+func clientAs[T any](c Client) (T, bool) {
+	if ro, ok := c.(readOnlyClient); ok {
+		c = ro.Client
+	}
+	t, ok := c.(T)
+	return t, ok
+}
@@ -0,0 +1,134 @@
+package datasync
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+)
+
+// maxReconnects caps how often a single sync reconnects after losing its
+// connection.
+const maxReconnects = 5
+
+// ErrConnectionLost can be returned, or wrapped, by a Client whose
+// connection dropped, so the sync reconnects instead of failing every
+// remaining file.
+var ErrConnectionLost = errors.New("connection lost")
+
+func isConnectionLost(err error) bool {
+	return errors.Is(err, ErrConnectionLost) ||
+		errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// retryOnDisconnect runs op, and runs it once more on a new connection if
+// it failed because the connection dropped.
+func (r *syncRun) retryOnDisconnect(op func() error) error {
+	err := op()
+	if err == nil || !isConnectionLost(err) || !r.reconnect(err) {
+		return err
+	}
+	return op()
+}
+
+// reconnect replaces the lost client with a new connection and reports
+// whether that worked.
+func (r *syncRun) reconnect(cause error) bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+	if r.reconnects >= maxReconnects {
+		r.errorln("Connection lost, giving up after", maxReconnects, "reconnects:", cause)
+		return false
+	}
+	r.reconnects++
+	r.warnln("Connection lost, reconnecting", r.reconnects, "of", maxReconnects, ":", cause)
+	if r.lister != nil {
+		// The rest of the tree is listed serially on the new connection.
+		r.lister.stop()
+		r.lister = nil
+	}
+	config := r.config
+	if c, ok := clientAs[*sftpConnection](r.client); ok {
+		// Stay on the host the sync started on.
+		config.SSHHost, config.FallbackHosts = c.host, nil
+	}
+	r.client.Close()
+	client, err := r.syncer.connect(r.ctx, config)
+	if err != nil {
+		r.errorln("Failed to reconnect:", err)
+		r.client = disconnectedClient{cause}
+		return false
+	}
+	r.client = client
+	r.infoln("Reconnected to", r.config.remoteHost())
+
+	if r.dest != nil {
+		// Either side of a relay may have dropped, so both are renewed.
+		r.dest.Close()
+		dest, err := r.syncer.connect(r.ctx, r.config.destinationConfig())
+		if err != nil {
+			r.errorln("Failed to reconnect to destination:", err)
+			r.dest = disconnectedClient{cause}
+			return false
+		}
+		r.dest = dest
+		r.infoln("Reconnected to", r.config.Destination.SSHHost)
+	}
+	return true
+}
+
+// checkConnection stats the first remote directory, and for a relay the
+// first destination directory, before the sync starts, and reconnects once
+// if the server does not answer. A directory that does not exist or may
+// not be read is an answer.
+func (r *syncRun) checkConnection() {
+	pairs := r.config.DirPairs()
+	if len(pairs) == 0 {
+		return
+	}
+	err := r.statDir(r.client, pairs[0].RemoteDir)
+	if err == nil && r.dest != nil {
+		err = r.statDir(r.dest, pairs[0].LocalDir)
+	}
+	if err == nil {
+		r.debugf("connection check: %s answered", r.config.remoteHost())
+		return
+	}
+	r.debugf("connection check: %s did not answer: %v", r.config.remoteHost(), err)
+	if r.reconnect(err) {
+		r.debugf("connection check: reconnected to %s", r.config.remoteHost())
+	}
+}
+
+// statDir stats dir, or the part of it before any glob, through client,
+// returning only the errors that were no answer from the server.
+func (r *syncRun) statDir(client Client, dir string) error {
+	for hasGlob(dir) {
+		dir = path.Dir(dir)
+	}
+	_, err := client.Stat(dir)
+	if err == nil || os.IsNotExist(err) || os.IsPermission(err) {
+		return nil
+	}
+	return err
+}
+
+// disconnectedClient stands in for a connection that could not be
+// re-established. It fails every operation with the original error, so the
+// next operation tries to reconnect again.
+type disconnectedClient struct {
+	err error
+}
+
+func (c disconnectedClient) ReadDir(string) ([]os.FileInfo, error) { return nil, c.err }
+func (c disconnectedClient) Stat(string) (os.FileInfo, error)      { return nil, c.err }
+func (c disconnectedClient) Open(string) (io.ReadCloser, error)    { return nil, c.err }
+func (c disconnectedClient) Create(string) (io.WriteCloser, error) { return nil, c.err }
+func (c disconnectedClient) MkdirAll(string) error                 { return c.err }
+func (c disconnectedClient) Remove(string) error                   { return c.err }
+func (c disconnectedClient) Close() error                          { return nil }
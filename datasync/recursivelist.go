@@ -0,0 +1,164 @@
+package datasync
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// With RecursiveList a pull lists the whole remote tree before walking it,
+// with a single walk over SFTP and one paged listing of the prefix on S3
+// instead of a listing per directory, and compares the files the state DB
+// has seen in an earlier run by the size and ModTime of that listing, so
+// that only new files and symlinks are stat'ed one by one.
+
+// treeClient is implemented by Clients that can list a whole tree at once.
+type treeClient interface {
+	// ListTree lists dir and the directories below it that visit accepts,
+	// by path. A directory that cannot be listed is recorded with its
+	// error.
+	ListTree(dir string, visit func(dir string, depth int) bool) (map[string]treeDir, error)
+}
+
+type treeDir struct {
+	infos []os.FileInfo
+	err   error
+}
+
+func (c Config) validateRecursiveList() error {
+	if c.RecursiveList && (c.direction() != "pull" || c.archiveMode() != "") {
+		return fmt.Errorf("recursiveList requires action pull or move-pull without archiveMode")
+	}
+	return nil
+}
+
+// listTree lists the tree below remoteDir ahead of pullData when the
+// config asks for it and the client supports it, and returns the function
+// dropping the listing.
+func (r *syncRun) listTree(remoteDir string) func() {
+	if !r.config.RecursiveList || r.tree != nil {
+		return func() {}
+	}
+	if _, ok := clientAs[treeClient](r.client); !ok {
+		r.debugf("%s: %s servers cannot list a tree at once, listing each directory", remoteDir, r.config.protocol())
+		return func() {}
+	}
+	started := time.Now()
+	var tree map[string]treeDir
+	err := r.retryOnDisconnect(func() (err error) {
+		c, _ := clientAs[treeClient](r.client)
+		tree, err = c.ListTree(remoteDir, r.visitsDir)
+		return err
+	})
+	if err != nil {
+		r.warnln("Failed to list", remoteDir, "recursively, listing each directory instead:", err)
+		return func() {}
+	}
+	r.debugf("%s: listed %d directories in %s", remoteDir, len(tree), time.Since(started).Round(time.Millisecond))
+	r.tree = tree
+	return func() { r.tree = nil }
+}
+
+// visitsDir reports whether pullData enters the remote directory dir at
+// depth.
+func (r *syncRun) visitsDir(dir string, depth int) bool {
+	return (r.config.MaxDepth <= 0 || depth <= r.config.MaxDepth) && r.inOnly(dir, true)
+}
+
+// takeTreeDir hands over the listing of dir from the tree, if it has one.
+func (r *syncRun) takeTreeDir(dir string) (treeDir, bool) {
+	dir = path.Clean(dir)
+	entry, ok := r.tree[dir]
+	delete(r.tree, dir)
+	return entry, ok
+}
+
+// listed reports whether the listing's info of the source file key can be
+// compared as it is, without a Stat.
+func (r *syncRun) listed(key string, info os.FileInfo) bool {
+	return r.config.RecursiveList && info.Mode().IsRegular() && r.stateKnown(key)
+}
+
+func (c *sftpConnection) ListTree(dir string, visit func(dir string, depth int) bool) (map[string]treeDir, error) {
+	root := path.Clean(dir)
+	tree := make(map[string]treeDir)
+	walker := c.Walk(root)
+	for walker.Step() {
+		p := walker.Path()
+		if err := walker.Err(); err != nil {
+			if p == root {
+				return nil, err
+			}
+			tree[p] = treeDir{err: err}
+			continue
+		}
+		info := walker.Stat()
+		if p != root {
+			parent := path.Dir(p)
+			tree[parent] = treeDir{infos: append(tree[parent].infos, info)}
+		}
+		if !info.IsDir() {
+			continue
+		}
+		if p != root && !visit(p, strings.Count(strings.TrimPrefix(strings.TrimPrefix(p, root), "/"), "/")+1) {
+			walker.SkipDir()
+			continue
+		}
+		if _, ok := tree[p]; !ok {
+			tree[p] = treeDir{infos: []os.FileInfo{}}
+		}
+	}
+	return tree, nil
+}
+
+// ListTree lists every key below the prefix of dir, as S3 cannot leave
+// out the directories that visit rejects.
+func (c *s3Connection) ListTree(dir string, visit func(dir string, depth int) bool) (map[string]treeDir, error) {
+	root := path.Clean(dir)
+	prefix := s3Prefix(dir)
+	tree := map[string]treeDir{root: {infos: []os.FileInfo{}}}
+	// add records an entry of a directory below root, and the directories
+	// on the way to it, once.
+	var add func(rel string, info os.FileInfo)
+	add = func(rel string, info os.FileInfo) {
+		parent := path.Join(root, path.Dir(rel))
+		if _, ok := tree[parent]; !ok {
+			add(path.Dir(rel), s3FileInfo{name: path.Base(path.Dir(rel)), dir: true})
+		}
+		if info.IsDir() {
+			p := path.Join(root, rel)
+			if _, ok := tree[p]; ok {
+				return
+			}
+			tree[p] = treeDir{infos: []os.FileInfo{}}
+		}
+		tree[parent] = treeDir{infos: append(tree[parent].infos, info)}
+	}
+	pages := s3.NewListObjectsV2Paginator(c.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(c.ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list %s: %w", dir, err)
+		}
+		for _, object := range page.Contents {
+			rel := strings.TrimPrefix(aws.ToString(object.Key), prefix)
+			if dir, ok := strings.CutSuffix(rel, "/"); ok {
+				// A placeholder object for a directory.
+				if dir != "" {
+					add(dir, s3FileInfo{name: path.Base(dir), dir: true})
+				}
+				continue
+			}
+			add(rel, s3FileInfo{name: path.Base(rel), size: aws.ToInt64(object.Size), modTime: aws.ToTime(object.LastModified)})
+		}
+	}
+	return tree, nil
+}
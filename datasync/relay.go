@@ -0,0 +1,235 @@
+package datasync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// Action "relay" copies from the remote directory on the config's server
+// to a directory on another SFTP server, the Destination. LocalDir names
+// that directory, and files stream from one connection straight into the
+// other without being staged on disk.
+
+// Endpoint is the SFTP server a relay copies to.
+type Endpoint struct {
+	SSHHost            string   `json:"sshHost"`
+	SSHPort            int      `json:"sshPort"`
+	User               string   `json:"user"`
+	Password           string   `json:"password"`
+	PrivateKeyPath     string   `json:"privateKeyPath"`
+	HostKeyFingerprint string   `json:"hostKeyFingerprint"`
+	FallbackHosts      []string `json:"fallbackHosts"`
+}
+
+// destinationConfig returns the config to connect to the destination of a
+// relay with.
+func (c Config) destinationConfig() Config {
+	dest := c
+	dest.Protocol = "sftp"
+	dest.SSHHost = c.Destination.SSHHost
+	dest.SSHPort = c.Destination.SSHPort
+	dest.User = c.Destination.User
+	dest.Password = c.Destination.Password
+	dest.PrivateKeyPath = c.Destination.PrivateKeyPath
+	dest.HostKeyFingerprint = c.Destination.HostKeyFingerprint
+	// The source's fallback hosts serve the source, not the destination.
+	dest.FallbackHosts = c.Destination.FallbackHosts
+	dest.Ciphers, dest.KeyExchanges, dest.MACs = nil, nil, nil
+	// ReadOnlyRemote guards the source of the relay.
+	dest.ReadOnlyRemote = false
+	return dest
+}
+
+func (c Config) validateRelay() error {
+	switch {
+	case c.Destination.SSHHost == "":
+		return errors.New("destination.sshHost is required for action relay")
+	case c.RetentionDays > 0:
+		return errors.New("retentionDays is not supported for action relay")
+	case c.compareMode() == "checksum":
+		return errors.New("compareMode checksum is not supported for action relay")
+	}
+	return nil
+}
+
+func (r *syncRun) relayData(destDir, srcDir string, depth int) error {
+	if depth == 0 {
+		defer r.startLister(srcDir)()
+	}
+	mark := r.startDir()
+	var srcFiles []os.FileInfo
+	err := r.retryOnDisconnect(func() (err error) {
+		srcFiles, err = r.readRemoteDir(srcDir)
+		return err
+	})
+	if err != nil && depth > 0 && r.vanishedFrom(srcDir, true, err) {
+		r.endDirSpan(srcDir, mark)
+		return nil
+	}
+	if err != nil {
+		r.fail(srcDir, err)
+		r.endDirSpan(srcDir, mark)
+		return err
+	}
+	defer r.completeDir(srcDir, mark)
+	defer r.loadIgnoreRules(srcDir)()
+
+	batch := r.newStateBatch()
+	defer r.commitState(batch)
+
+	orderEntries(r, srcFiles)
+	for i, file := range srcFiles {
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+		if r.limitReached() {
+			deferEntries(r, srcFiles[i:])
+			return nil
+		}
+		srcFilePath := remoteJoin(srcDir, file.Name())
+		destFilePath := remoteJoin(destDir, file.Name())
+		if r.hidden(srcFilePath, file.Name()) || r.ignored(srcFilePath, file.IsDir()) || !r.within(srcFilePath, file.IsDir()) {
+			continue
+		}
+
+		if file.IsDir() {
+			if r.depthExceeded(srcFilePath, depth+1) {
+				continue
+			}
+			ok, err := r.createDestDir(srcFilePath, destFilePath, func() error {
+				return r.mkdirRemote(r.dest, destFilePath)
+			})
+			if !ok {
+				if err != nil && r.config.AbortOnError {
+					return err
+				}
+				continue
+			}
+			if r.breadthFirst() {
+				r.queueDir(destFilePath, srcFilePath, depth+1)
+				continue
+			}
+			if err := r.relayData(destFilePath, srcFilePath, depth+1); err != nil {
+				r.errorln("Failed to copy directory", srcFilePath, ":", err)
+				if r.config.AbortOnError {
+					return err
+				}
+			}
+			continue
+		}
+
+		if r.excluded(srcFilePath, file) || r.offPlan(srcFilePath, file, false) {
+			continue
+		}
+		key := r.stateKey(srcFilePath)
+		if r.stateUnchanged(key, file) {
+			r.debugf("%s: skip (unchanged since last run)", srcFilePath)
+			r.skip(srcFilePath, "unchanged since last run")
+			continue
+		}
+
+		var srcInfo, destInfo os.FileInfo
+		err := r.retryOnDisconnect(func() (err error) {
+			if srcInfo, err = r.client.Stat(srcFilePath); err != nil {
+				return err
+			}
+			destInfo, err = r.dest.Stat(destFilePath)
+			if os.IsNotExist(err) {
+				destInfo, err = nil, nil
+			}
+			return err
+		})
+		if err != nil {
+			if r.vanishedFrom(srcFilePath, true, err) {
+				continue
+			}
+			r.errorln("Failed to stat", srcFilePath, "or", destFilePath, ":", err)
+			r.fail(srcFilePath, err)
+			if r.config.AbortOnError {
+				return err
+			}
+			continue
+		}
+		if destInfo != nil && destInfo.IsDir() {
+			ok, err := r.resolveTypeMismatch(srcFilePath, destFilePath, destInfo)
+			if !ok {
+				if err != nil && r.config.AbortOnError {
+					return err
+				}
+				continue
+			}
+			destInfo = nil
+		}
+		if !r.shouldTransfer(srcFilePath, destFilePath, srcInfo, destInfo) {
+			r.skip(srcFilePath, "up to date")
+			batch.add(key, file)
+			continue
+		}
+		if r.dryRun() {
+			r.planTransfer("copy", srcFilePath, destFilePath, srcInfo)
+			continue
+		}
+		ctx, cancel := r.fileContext()
+		err = r.retryOnDisconnect(func() error {
+			return r.relayFile(ctx, destFilePath, srcFilePath, r.transferOptions())
+		})
+		cancel()
+		r.audit("copy", destFilePath, srcFilePath, srcInfo.Size(), err)
+		if err != nil {
+			if r.vanishedFrom(srcFilePath, true, err) {
+				continue
+			}
+			r.errorln("Failed to copy file", srcFilePath, ":", err)
+			r.fail(srcFilePath, err)
+			if r.config.AbortOnError {
+				return err
+			}
+			continue
+		}
+		r.countFile()
+		batch.add(key, file)
+	}
+
+	return nil
+}
+
+func (r *syncRun) relayFile(ctx context.Context, destFilePath, srcFilePath string, opts copyOptions) error {
+	started := time.Now()
+	srcFile, err := r.client.Open(srcFilePath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	destFile, err := r.dest.Create(destFilePath)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	n, err := copyFile(ctx, destFile, srcFile, closers{srcFile, destFile}, opts)
+	if err == nil {
+		err = destFile.Close()
+	}
+	if err != nil {
+		destFile.Close()
+		r.dest.Remove(destFilePath)
+		if errors.Is(err, context.DeadlineExceeded) {
+			r.errorln("Timed out copying", srcFilePath, "after", n, "bytes")
+		}
+		return err
+	}
+
+	r.transferred(srcFilePath, n, time.Since(started))
+	r.transferln("Copied", srcFilePath, "to", r.config.Destination.SSHHost+":"+destFilePath)
+	return nil
+}
+
+// closers closes both ends of a relayed file when its copy is cancelled.
+type closers [2]interface{ Close() error }
+
+func (c closers) Close() error {
+	return errors.Join(c[0].Close(), c[1].Close())
+}
@@ -0,0 +1,17 @@
+package datasync
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDestinationConfigFallbackHosts(t *testing.T) {
+	c := Config{Action: "relay", SSHHost: "source", FallbackHosts: []string{"source2"}, Destination: Endpoint{SSHHost: "backup"}}
+	if dest := c.destinationConfig(); dest.SSHHost != "backup" || len(dest.FallbackHosts) != 0 {
+		t.Errorf("destination connects to %s with fallbacks %q, want backup without any", dest.SSHHost, dest.FallbackHosts)
+	}
+	c.Destination.FallbackHosts = []string{"backup2"}
+	if dest := c.destinationConfig(); !slices.Equal(dest.FallbackHosts, []string{"backup2"}) {
+		t.Errorf("destination fallbacks are %q, want [backup2]", dest.FallbackHosts)
+	}
+}
@@ -0,0 +1,286 @@
+package datasync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// With UseRemoteHash two copies of the same size are compared by a hash the
+// SFTP server computes itself, through the check-file extension of the SFTP
+// drafts, instead of by ModTime, so content changes are found without
+// transferring anything. pkg/sftp cannot send extended requests, so they go
+// over a second SFTP session on the same SSH connection. Servers that do
+// not advertise the extension, OpenSSH among them, fall back to the usual
+// comparison.
+
+var errNoRemoteHash = errors.New("the server does not support check-file")
+
+// remoteHashAlgorithms are the algorithms offered to the server, which
+// picks the first one it supports.
+const remoteHashAlgorithms = "sha256,sha512,sha384,sha224,sha1,md5,crc32"
+
+// SFTP packet types and status codes of the check-file exchange.
+const (
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpStatus        = 101
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+	fxOpUnsupported  = 8
+)
+
+// remoteHasher is implemented by Clients whose server can hash files.
+type remoteHasher interface {
+	// RemoteHash returns the algorithm the server used and the hash, or
+	// errNoRemoteHash.
+	RemoteHash(path string) (string, []byte, error)
+}
+
+func (c Config) validateRemoteHash() error {
+	if !c.UseRemoteHash {
+		return nil
+	}
+	if c.protocol() != "sftp" {
+		return fmt.Errorf("useRemoteHash is only supported for protocol sftp")
+	}
+	if c.direction() == "relay" {
+		return fmt.Errorf("useRemoteHash is not supported for action relay")
+	}
+	if c.compareMode() == "checksum" {
+		return fmt.Errorf("useRemoteHash cannot be combined with compareMode checksum")
+	}
+	return nil
+}
+
+// remoteHashDiffers compares both copies of a file by the server's hash of
+// the remote one. ok is false when the server cannot tell, and the file is
+// to be compared as usual.
+func (r *syncRun) remoteHashDiffers(srcPath, dstPath string) (differs, ok bool) {
+	hasher, supported := clientAs[remoteHasher](r.client)
+	if !supported || r.encrypted(srcPath) {
+		return false, false
+	}
+	localPath, remotePath := dstPath, srcPath
+	if r.config.direction() == "push" {
+		localPath, remotePath = srcPath, dstPath
+	}
+	alg, remoteSum, err := hasher.RemoteHash(remotePath)
+	if errors.Is(err, errNoRemoteHash) {
+		if !r.remoteHashMissing {
+			r.remoteHashMissing = true
+			r.infoln("The server does not support check-file, comparing size and ModTime instead of hashes")
+		}
+		return false, false
+	}
+	if err != nil {
+		r.warnln("Failed to get the server's hash of", remotePath, ", comparing size and ModTime:", err)
+		return false, false
+	}
+	localSum, err := r.localHash(alg, localPath)
+	if err != nil {
+		r.warnln("Failed to hash", localPath, ", comparing size and ModTime:", err)
+		return false, false
+	}
+	if !bytes.Equal(localSum, remoteSum) {
+		return r.transferBecause(srcPath, "%s reported by the server differs", alg), true
+	}
+	r.debugf("%s: skip (same %s as reported by the server)", srcPath, alg)
+	return false, true
+}
+
+// localHash hashes the local file at path with the named algorithm, taking
+// SHA-256 from the checksum cache.
+func (r *syncRun) localHash(alg, path string) ([]byte, error) {
+	var h hash.Hash
+	switch alg {
+	case "sha256":
+		sum, err := r.localSHA256(path)
+		if err != nil {
+			return nil, err
+		}
+		return hex.DecodeString(sum)
+	case "sha512":
+		h = sha512.New()
+	case "sha384":
+		h = sha512.New384()
+	case "sha224":
+		h = sha256.New224()
+	case "sha1":
+		h = sha1.New()
+	case "md5":
+		h = md5.New()
+	case "crc32":
+		h = crc32.NewIEEE()
+	default:
+		return nil, fmt.Errorf("the server used the unknown hash %q", alg)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (c *sftpConnection) RemoteHash(path string) (string, []byte, error) {
+	if _, ok := c.HasExtension("check-file"); !ok {
+		if _, ok := c.HasExtension("check-file-name"); !ok {
+			return "", nil, errNoRemoteHash
+		}
+	}
+	c.checkFileMu.Lock()
+	defer c.checkFileMu.Unlock()
+	if c.checkFile == nil {
+		session, err := openCheckFileSession(c.conn)
+		if err != nil {
+			return "", nil, err
+		}
+		c.checkFile = session
+	}
+	return c.checkFile.hash(path)
+}
+
+// checkFileSession is an SFTP session used only for check-file requests,
+// one at a time.
+type checkFileSession struct {
+	session *ssh.Session
+	w       io.WriteCloser
+	r       io.Reader
+	id      uint32
+}
+
+func openCheckFileSession(conn *ssh.Client) (*checkFileSession, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	s := &checkFileSession{session: session}
+	if s.w, err = session.StdinPipe(); err == nil {
+		if s.r, err = session.StdoutPipe(); err == nil {
+			err = session.RequestSubsystem("sftp")
+		}
+	}
+	if err == nil {
+		err = s.send(binary.BigEndian.AppendUint32([]byte{fxpInit}, 3))
+	}
+	if err == nil {
+		var packet []byte
+		if packet, err = s.receive(); err == nil && packet[0] != fxpVersion {
+			err = fmt.Errorf("unexpected SFTP packet type %d", packet[0])
+		}
+	}
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("unable to open a session for check-file: %w", err)
+	}
+	return s, nil
+}
+
+func (s *checkFileSession) hash(path string) (string, []byte, error) {
+	s.id++
+	packet := binary.BigEndian.AppendUint32([]byte{fxpExtended}, s.id)
+	packet = appendString(packet, "check-file-name")
+	packet = appendString(packet, path)
+	packet = appendString(packet, remoteHashAlgorithms)
+	// Hash the whole file, from offset 0 to the end, as a single block.
+	packet = binary.BigEndian.AppendUint64(packet, 0)
+	packet = binary.BigEndian.AppendUint64(packet, 0)
+	packet = binary.BigEndian.AppendUint32(packet, 0)
+	if err := s.send(packet); err != nil {
+		return "", nil, err
+	}
+	reply, err := s.receive()
+	if err != nil {
+		return "", nil, err
+	}
+	data := reply[1:]
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != s.id {
+		return "", nil, fmt.Errorf("unexpected reply to check-file")
+	}
+	data = data[4:]
+	switch reply[0] {
+	case fxpExtendedReply:
+		name, data, ok := readString(data)
+		if !ok || name != "check-file" {
+			return "", nil, fmt.Errorf("malformed reply to check-file")
+		}
+		// The hash makes up the rest of the reply.
+		alg, sum, ok := readString(data)
+		if !ok {
+			return "", nil, fmt.Errorf("malformed reply to check-file")
+		}
+		return strings.ToLower(alg), sum, nil
+	case fxpStatus:
+		if len(data) >= 4 && binary.BigEndian.Uint32(data) == fxOpUnsupported {
+			return "", nil, errNoRemoteHash
+		}
+		msg := "unknown error"
+		if len(data) >= 4 {
+			if text, _, ok := readString(data[4:]); ok && text != "" {
+				msg = text
+			}
+		}
+		return "", nil, fmt.Errorf("check-file failed: %s", msg)
+	}
+	return "", nil, fmt.Errorf("unexpected SFTP packet type %d", reply[0])
+}
+
+func (s *checkFileSession) send(packet []byte) error {
+	_, err := s.w.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(packet))), packet...))
+	return err
+}
+
+// receive reads the next packet, starting with its type.
+func (s *checkFileSession) receive() ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(s.r, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n == 0 || n > 1<<20 {
+		return nil, fmt.Errorf("invalid SFTP packet length %d", n)
+	}
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(s.r, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+func (s *checkFileSession) Close() error {
+	return s.session.Close()
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint32(b, uint32(len(s))), s...)
+}
+
+// readString reads an SFTP string off the front of data, returning the
+// rest.
+func readString(data []byte) (string, []byte, bool) {
+	if len(data) < 4 {
+		return "", nil, false
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(len(data)-4) < uint64(n) {
+		return "", nil, false
+	}
+	return string(data[4 : 4+n]), data[4+n:], true
+}
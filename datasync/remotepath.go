@@ -0,0 +1,75 @@
+package datasync
+
+import (
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Remote paths always use forward slashes, as SFTP, FTP and S3 servers
+// expect whatever the local OS, so they are built with package path while
+// local ones use filepath. On Windows, filepath.Join would put backslashes
+// into remote paths.
+
+// windowsPaths is whether local paths, and the parts of remote paths taken
+// from them, may separate their elements with backslashes. Tests set it to
+// simulate Windows.
+var windowsPaths = runtime.GOOS == "windows"
+
+// toRemote turns the separators of p into forward slashes.
+func toRemote(p string) string {
+	if windowsPaths {
+		return strings.ReplaceAll(p, `\`, "/")
+	}
+	return p
+}
+
+// remoteJoin joins the elements of a remote path.
+func remoteJoin(elem ...string) string {
+	if windowsPaths {
+		elem = slices.Clone(elem)
+		for i, e := range elem {
+			elem[i] = toRemote(e)
+		}
+	}
+	return path.Join(elem...)
+}
+
+// remoteRel returns the slash-separated path of the remote path target
+// relative to root, and false when target does not lie below root.
+func remoteRel(root, target string) (string, bool) {
+	root, target = path.Clean(toRemote(root)), path.Clean(toRemote(target))
+	if target == root {
+		return ".", true
+	}
+	prefix := root
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if rel, ok := strings.CutPrefix(target, prefix); ok {
+		return rel, true
+	}
+	return "", false
+}
+
+// joinSide joins the elements of a path on the remote side when remote is
+// true, and of a local path otherwise.
+func joinSide(remote bool, elem ...string) string {
+	if remote {
+		return remoteJoin(elem...)
+	}
+	return filepath.Join(elem...)
+}
+
+// srcRemote reports whether the source of the sync is on the remote side.
+func (r *syncRun) srcRemote() bool {
+	return r.config.direction() != "push"
+}
+
+// destRemote reports whether the destination of the sync is on the remote
+// side.
+func (r *syncRun) destRemote() bool {
+	return r.config.direction() != "pull"
+}
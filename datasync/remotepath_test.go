@@ -0,0 +1,108 @@
+package datasync
+
+import "testing"
+
+// simulateWindows makes remote paths be built as on Windows for the rest
+// of the test.
+func simulateWindows(t *testing.T) {
+	saved := windowsPaths
+	windowsPaths = true
+	t.Cleanup(func() { windowsPaths = saved })
+}
+
+func TestRemoteJoinOnWindows(t *testing.T) {
+	simulateWindows(t)
+	tests := []struct {
+		elem []string
+		want string
+	}{
+		{[]string{"/data", "2024-01-01"}, "/data/2024-01-01"},
+		{[]string{`\data`, "2024-01-01"}, "/data/2024-01-01"},
+		{[]string{"/data", `2024\01\02`, "a.txt"}, "/data/2024/01/02/a.txt"},
+		{[]string{`/data\reports/`, `sub\`, "a.txt"}, "/data/reports/sub/a.txt"},
+		{[]string{"data", `..\other`, "a.txt"}, "other/a.txt"},
+	}
+	for _, tt := range tests {
+		if got := remoteJoin(tt.elem...); got != tt.want {
+			t.Errorf("remoteJoin(%q) = %q, want %q", tt.elem, got, tt.want)
+		}
+		if got := joinSide(true, tt.elem...); got != tt.want {
+			t.Errorf("joinSide(true, %q) = %q, want %q", tt.elem, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteJoinKeepsElements(t *testing.T) {
+	simulateWindows(t)
+	elem := []string{`\data`, `a\b`}
+	remoteJoin(elem...)
+	if elem[0] != `\data` || elem[1] != `a\b` {
+		t.Errorf("remoteJoin changed its arguments to %q", elem)
+	}
+}
+
+func TestRemoteRel(t *testing.T) {
+	simulateWindows(t)
+	tests := []struct {
+		root, target string
+		want         string
+		ok           bool
+	}{
+		{"/data", "/data/a.txt", "a.txt", true},
+		{"/data/", "/data/2024-01-01/a.txt", "2024-01-01/a.txt", true},
+		{`\data`, `/data\2024-01-01/a.txt`, "2024-01-01/a.txt", true},
+		{"/data", "/data", ".", true},
+		{"/", "/data/a.txt", "data/a.txt", true},
+		{"/data", "/database/a.txt", "", false},
+		{"/data", "/other/a.txt", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := remoteRel(tt.root, tt.target)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("remoteRel(%q, %q) = %q, %v, want %q, %v", tt.root, tt.target, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRemoteStateKeyOnWindows(t *testing.T) {
+	simulateWindows(t)
+	tests := []struct {
+		remoteDir string
+		multiPair bool
+		src       string
+		want      string
+	}{
+		{"/data", false, "/data/2024-01-01/a.txt", "2024-01-01/a.txt"},
+		{`\data\`, false, "/data/2024-01-01/a.txt", "2024-01-01/a.txt"},
+		{"/data", false, remoteJoin("/data", `2024\01`, "a.txt"), "2024/01/a.txt"},
+		{"/data", true, "/data/sub/a.txt", "/data/sub/a.txt"},
+		{"/data", false, `/elsewhere\a.txt`, "/elsewhere/a.txt"},
+	}
+	for _, tt := range tests {
+		r := &syncRun{config: Config{Action: "pull", RemoteDir: tt.remoteDir}, multiPair: tt.multiPair}
+		if got := r.stateKey(tt.src); got != tt.want {
+			t.Errorf("stateKey(%q) under %q = %q, want %q", tt.src, tt.remoteDir, got, tt.want)
+		}
+	}
+}
+
+func TestPostProcessGlobOnWindows(t *testing.T) {
+	simulateWindows(t)
+	tests := []struct {
+		root, glob, remote string
+		want               bool
+	}{
+		{"/data", "*.csv", remoteJoin("/data", `sub\a.csv`), true},
+		{"/data", "sub/*.csv", remoteJoin("/data", `sub\a.csv`), true},
+		{`\data\`, "sub/*.csv", "/data/sub/a.csv", true},
+		{"/data", "sub/*.csv", remoteJoin("/data", `other\a.csv`), false},
+		{"/data", "sub/*.csv", remoteJoin("/data", `sub\deeper`, "a.csv"), false},
+		{"/data", "sub/*.csv", "/elsewhere/sub/a.csv", false},
+	}
+	for _, tt := range tests {
+		r := &syncRun{config: Config{PostProcessCommand: "true", PostProcessGlob: tt.glob}, root: tt.root}
+		if got := r.postProcesses(tt.remote); got != tt.want {
+			t.Errorf("postProcesses(%q) with glob %q under %q = %v, want %v", tt.remote, tt.glob, tt.root, got, tt.want)
+		}
+	}
+}
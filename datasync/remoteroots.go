@@ -0,0 +1,34 @@
+package datasync
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CheckRemoteRoots returns an error unless every remote directory of config
+// is one of roots or lies below one. Any directory is allowed when roots is
+// empty. Directories are compared as cleaned paths, so "/data/../etc" is
+// not below "/data".
+func CheckRemoteRoots(config Config, roots []string) error {
+	if len(roots) == 0 {
+		return nil
+	}
+	for _, pair := range config.DirPairs() {
+		if !underRemoteRoot(pair.RemoteDir, roots) {
+			return fmt.Errorf("remoteDir %s is not below any of allowedRemoteRoots %s", pair.RemoteDir, strings.Join(roots, ", "))
+		}
+	}
+	return nil
+}
+
+func underRemoteRoot(dir string, roots []string) bool {
+	dir = path.Clean(dir)
+	for _, root := range roots {
+		root = path.Clean(root)
+		if dir == root || strings.HasPrefix(dir, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
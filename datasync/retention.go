@@ -0,0 +1,120 @@
+package datasync
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// applyRetention deletes the date folders under the destination directory
+// that are older than RetentionDays. Folders whose paths do not match the
+// DateLayout are left alone.
+func (r *syncRun) applyRetention() {
+	if r.config.RetentionDays <= 0 || r.ctx.Err() != nil {
+		return
+	}
+
+	now := time.Now()
+	cutoff := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -r.config.RetentionDays)
+
+	destDir := r.config.LocalDir
+	if r.config.direction() == "push" {
+		destDir = r.config.RemoteDir
+	}
+	layout := r.config.dateLayout()
+	names, err := r.destSubdirs(destDir, "", strings.Count(layout, "/")+1)
+	if err != nil {
+		r.errorln("Failed to list", destDir, "for retention:", err)
+		r.fail(destDir, err)
+		return
+	}
+
+	for _, name := range names {
+		date, err := time.Parse(layout, name)
+		if err != nil || !date.Before(cutoff) {
+			continue
+		}
+		dir := joinSide(r.destRemote(), destDir, name)
+		if r.offPlan(dir, nil, true) {
+			continue
+		}
+		if r.dryRun() {
+			r.infoln("Would remove", dir, ": older than retentionDays", r.config.RetentionDays)
+			r.planRemoval(dir, fmt.Sprint("older than retentionDays ", r.config.RetentionDays), nil)
+			continue
+		}
+		if r.config.direction() == "push" {
+			err = removeRemoteAll(r.client, dir)
+		} else {
+			err = os.RemoveAll(dir)
+		}
+		if err != nil {
+			r.errorln("Failed to remove", dir, ":", err)
+			r.fail(dir, err)
+			continue
+		}
+		r.infoln("Removed", dir, ": older than retentionDays", r.config.RetentionDays)
+	}
+}
+
+// destSubdirs lists the directories exactly depth levels below destDir, as
+// slash-separated paths relative to it.
+func (r *syncRun) destSubdirs(destDir, prefix string, depth int) ([]string, error) {
+	var children []string
+	dir := joinSide(r.destRemote(), destDir, prefix)
+	if r.config.direction() == "push" {
+		entries, err := r.client.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				children = append(children, path.Join(prefix, entry.Name()))
+			}
+		}
+	} else {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				children = append(children, path.Join(prefix, entry.Name()))
+			}
+		}
+	}
+	if depth == 1 {
+		return children, nil
+	}
+
+	var names []string
+	for _, child := range children {
+		grandchildren, err := r.destSubdirs(destDir, child, depth-1)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, grandchildren...)
+	}
+	return names, nil
+}
+
+func removeRemoteAll(client Client, path string) error {
+	entries, err := client.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child := remoteJoin(path, entry.Name())
+		if entry.IsDir() {
+			err = removeRemoteAll(client, child)
+		} else {
+			err = client.Remove(child)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return client.Remove(path)
+}
@@ -0,0 +1,221 @@
+package datasync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3Connection is the Client for Protocol "s3". Paths map to object keys
+// without the leading slash, and directories to the key prefixes up to a
+// "/", so MkdirAll has nothing to do.
+type s3Connection struct {
+	ctx      context.Context
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+}
+
+func connectToS3(ctx context.Context, config Config) (*s3Connection, error) {
+	opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(config.Region)}
+	if config.AccessKey != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(config.AccessKey, config.SecretKey, "")))
+	}
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(awsConfig)
+	return &s3Connection{
+		ctx:      ctx,
+		client:   client,
+		uploader: manager.NewUploader(client),
+		bucket:   config.Bucket,
+	}, nil
+}
+
+func s3Key(name string) string {
+	return strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), "/")
+}
+
+// s3Prefix returns the prefix of the keys below the directory name.
+func s3Prefix(name string) string {
+	key := s3Key(name)
+	if key == "." || key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func (c *s3Connection) ReadDir(dir string) ([]os.FileInfo, error) {
+	prefix := s3Prefix(dir)
+	var infos []os.FileInfo
+	pages := s3.NewListObjectsV2Paginator(c.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(c.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(c.ctx)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: dir, Err: err}
+		}
+		for _, p := range page.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(p.Prefix), prefix), "/")
+			infos = append(infos, s3FileInfo{name: name, dir: true})
+		}
+		for _, object := range page.Contents {
+			name := strings.TrimPrefix(aws.ToString(object.Key), prefix)
+			if name == "" {
+				// A placeholder object for the directory itself.
+				continue
+			}
+			infos = append(infos, s3FileInfo{
+				name:    name,
+				size:    aws.ToInt64(object.Size),
+				modTime: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+	return infos, nil
+}
+
+func (c *s3Connection) Stat(name string) (os.FileInfo, error) {
+	head, err := c.client.HeadObject(c.ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(s3Key(name)),
+	})
+	if err == nil {
+		return s3FileInfo{
+			name:    path.Base(s3Key(name)),
+			size:    aws.ToInt64(head.ContentLength),
+			modTime: aws.ToTime(head.LastModified),
+		}, nil
+	}
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	// No such object, but keys below it make it a directory.
+	list, err := c.client.ListObjectsV2(c.ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(c.bucket),
+		Prefix:  aws.String(s3Prefix(name)),
+		MaxKeys: aws.Int32(1),
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(list.Contents) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return s3FileInfo{name: path.Base(s3Key(name)), dir: true}, nil
+}
+
+func (c *s3Connection) Open(name string) (io.ReadCloser, error) {
+	object, err := c.client.GetObject(c.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(s3Key(name)),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			err = fs.ErrNotExist
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return object.Body, nil
+}
+
+// Create streams what is written to the object into a multipart upload,
+// which completes when the file is closed.
+func (c *s3Connection) Create(name string) (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.uploader.Upload(c.ctx, &s3.PutObjectInput{
+			Bucket: aws.String(c.bucket),
+			Key:    aws.String(s3Key(name)),
+			Body:   r,
+		})
+		r.CloseWithError(err)
+		done <- err
+	}()
+	return &s3Writer{name: name, w: w, done: done}, nil
+}
+
+func (c *s3Connection) MkdirAll(string) error {
+	return nil
+}
+
+func (c *s3Connection) Remove(name string) error {
+	_, err := c.client.DeleteObject(c.ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(s3Key(name)),
+	})
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (c *s3Connection) Close() error {
+	return nil
+}
+
+type s3Writer struct {
+	name string
+	w    *io.PipeWriter
+	done chan error
+	once sync.Once
+	err  error
+}
+
+func (f *s3Writer) Write(p []byte) (int, error) {
+	return f.w.Write(p)
+}
+
+func (f *s3Writer) Close() error {
+	f.once.Do(func() {
+		f.w.Close()
+		if err := <-f.done; err != nil {
+			f.err = &fs.PathError{Op: "create", Path: f.name, Err: err}
+		}
+	})
+	return f.err
+}
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i s3FileInfo) Name() string       { return i.name }
+func (i s3FileInfo) Size() int64        { return i.size }
+func (i s3FileInfo) ModTime() time.Time { return i.modTime }
+func (i s3FileInfo) IsDir() bool        { return i.dir }
+func (i s3FileInfo) Sys() any           { return nil }
+
+func (i s3FileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
@@ -0,0 +1,111 @@
+package datasync
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// With SourceRetention a push that finished without failures deletes the
+// local files last modified more than that long ago, whether this run or an
+// earlier one uploaded them. A file is only deleted while its remote copy
+// exists, with the same size unless uploads are encrypted, so files never
+// shipped, e.g. because filters leave them out, stay.
+
+func (c Config) validateSourceRetention() error {
+	if c.SourceRetention < 0 {
+		return fmt.Errorf("sourceRetention must not be negative")
+	}
+	if c.SourceRetention == 0 {
+		return nil
+	}
+	if c.direction() != "push" {
+		return fmt.Errorf("sourceRetention requires action push or move-push")
+	}
+	if c.archiveMode() != "" {
+		return fmt.Errorf("sourceRetention is not supported with archiveMode")
+	}
+	return nil
+}
+
+// pruneSource deletes the files below the current LocalDir that are older
+// than SourceRetention and shipped.
+func (r *syncRun) pruneSource() {
+	if r.config.SourceRetention <= 0 || r.ctx.Err() != nil {
+		return
+	}
+	localDir, err := filepath.Abs(r.config.LocalDir)
+	if err != nil || filepath.Dir(localDir) == localDir {
+		r.errorln("Refusing to apply sourceRetention to", r.config.LocalDir)
+		return
+	}
+	r.root = localDir
+	cutoff := time.Now().Add(-time.Duration(r.config.SourceRetention))
+
+	err = filepath.WalkDir(localDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			r.warnln("Failed to list", path, "for sourceRetention:", err)
+			if entry != nil && entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if r.ctx.Err() != nil {
+			return r.ctx.Err()
+		}
+		if path == localDir {
+			return nil
+		}
+		if !r.inOnly(path, entry.IsDir()) {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || entry.Name() == manifestName {
+			return nil
+		}
+		rel, err := filepath.Rel(localDir, path)
+		if err != nil || !filepath.IsLocal(rel) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		r.pruneSourceFile(path, rel, info)
+		return nil
+	})
+	if err != nil && r.ctx.Err() == nil {
+		r.errorln("Failed to apply sourceRetention to", localDir, ":", err)
+	}
+}
+
+func (r *syncRun) pruneSourceFile(path, rel string, info os.FileInfo) {
+	remoteFilePath := remoteJoin(r.config.RemoteDir, filepath.ToSlash(filepath.Dir(rel)), r.remoteName(info.Name(), false))
+	remoteInfo, err := r.client.Stat(remoteFilePath)
+	if err != nil {
+		r.debugf("%s: keep (no remote copy for sourceRetention: %v)", path, err)
+		return
+	}
+	if !r.resized(path) && remoteInfo.Size() != info.Size() {
+		r.debugf("%s: keep (remote copy is %d bytes instead of %d)", path, remoteInfo.Size(), info.Size())
+		return
+	}
+	if r.offPlan(path, info, true) {
+		return
+	}
+	if r.dryRun() {
+		r.infoln("Would remove", path, ": older than sourceRetention", time.Duration(r.config.SourceRetention))
+		r.planRemoval(path, fmt.Sprint("older than sourceRetention ", time.Duration(r.config.SourceRetention)), info)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		r.errorln("Failed to remove", path, ":", err)
+		r.fail(path, err)
+		return
+	}
+	r.infoln("Removed", path, ": older than sourceRetention", time.Duration(r.config.SourceRetention))
+}
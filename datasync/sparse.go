@@ -0,0 +1,126 @@
+package datasync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// With PreserveSparse a pulled file is written through a sparseWriter,
+// which seeks over every block of zeros instead of writing it, so file
+// systems supporting holes leave those blocks unallocated. Where seeking
+// past the written part or truncating fails, the zeros are written out and
+// the file ends up dense, but with the same content.
+
+// sparseBlock is the granularity at which zeros are skipped, the block size
+// of most file systems.
+const sparseBlock = 4096
+
+var zeroBlock = make([]byte, sparseBlock)
+
+type sparseWriter struct {
+	f *os.File
+	// offset is the logical size written so far, pos the position of f.
+	offset, pos int64
+	// dense is set once seeking failed, after which zeros are written.
+	dense bool
+}
+
+func newSparseWriter(f *os.File) *sparseWriter {
+	// Windows only leaves holes in files marked sparse.
+	if err := setSparse(f); err != nil {
+		return &sparseWriter{f: f, dense: true}
+	}
+	return &sparseWriter{f: f}
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Split p into runs of whole blocks, aligned to the file offset,
+		// that are either all zeros or all contain data.
+		end := min(sparseBlock-int(w.offset%sparseBlock), len(p))
+		zero := isZeros(p[:end])
+		for end < len(p) {
+			next := min(end+sparseBlock, len(p))
+			if isZeros(p[end:next]) != zero {
+				break
+			}
+			end = next
+		}
+		if zero && !w.dense {
+			w.offset += int64(end)
+		} else if err := w.write(p[:end]); err != nil {
+			return written, err
+		}
+		written += end
+		p = p[end:]
+	}
+	return written, nil
+}
+
+func (w *sparseWriter) write(p []byte) error {
+	if err := w.skipTo(w.offset); err != nil {
+		return err
+	}
+	n, err := w.f.Write(p)
+	w.offset += int64(n)
+	w.pos = w.offset
+	return err
+}
+
+// skipTo moves f to offset, leaving a hole, or filling it with zeros once
+// seeking failed.
+func (w *sparseWriter) skipTo(offset int64) error {
+	if w.pos == offset {
+		return nil
+	}
+	if !w.dense {
+		if _, err := w.f.Seek(offset, io.SeekStart); err == nil {
+			w.pos = offset
+			return nil
+		}
+		w.dense = true
+	}
+	for w.pos < offset {
+		n, err := w.f.Write(zeroBlock[:min(int64(sparseBlock), offset-w.pos)])
+		w.pos += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish extends the file to its logical size if it ends in a hole, and
+// checks that the size on disk matches.
+func (w *sparseWriter) finish() error {
+	if w.pos < w.offset {
+		if w.dense || w.f.Truncate(w.offset) != nil {
+			w.dense = true
+			if err := w.skipTo(w.offset); err != nil {
+				return err
+			}
+		}
+	}
+	info, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != w.offset {
+		return fmt.Errorf("sparse copy is %d bytes instead of %d", info.Size(), w.offset)
+	}
+	return nil
+}
+
+func isZeros(p []byte) bool {
+	for len(p) > 0 {
+		n := min(len(p), sparseBlock)
+		if !bytes.Equal(p[:n], zeroBlock[:n]) {
+			return false
+		}
+		p = p[n:]
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+package datasync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The algorithms the ssh package can negotiate, including the legacy ones
+// it leaves out by default.
+var (
+	sshCiphers = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc", "arcfour256", "arcfour128", "arcfour",
+	}
+	sshKeyExchanges = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+		"diffie-hellman-group-exchange-sha256", "diffie-hellman-group14-sha1",
+		"diffie-hellman-group-exchange-sha1", "diffie-hellman-group1-sha1",
+	}
+	sshMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512", "hmac-sha1", "hmac-sha1-96",
+	}
+)
+
+func validateAlgorithms(field string, names, supported []string) error {
+	for _, name := range names {
+		if !slices.Contains(supported, name) {
+			return fmt.Errorf("unsupported %s %q, expected one of %s", field, name, strings.Join(supported, ", "))
+		}
+	}
+	return nil
+}
+
+// kexInit is the SSH_MSG_KEXINIT both sides start the handshake with.
+type kexInit struct {
+	Cookie                  [16]byte `sshtype:"20"`
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+// maxKexCapture bounds how much of each direction kexSniffer keeps.
+const maxKexCapture = 64 * 1024
+
+// kexSniffer keeps the start of what is read and written on an SSH
+// connection, where the plaintext KEXINIT messages tell which algorithms
+// either side offered.
+type kexSniffer struct {
+	net.Conn
+	mu            sync.Mutex
+	read, written []byte
+	stopped       bool
+}
+
+func (c *kexSniffer) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.capture(&c.read, p[:n])
+	return n, err
+}
+
+func (c *kexSniffer) Write(p []byte) (int, error) {
+	c.capture(&c.written, p)
+	return c.Conn.Write(p)
+}
+
+func (c *kexSniffer) capture(buf *[]byte, p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.stopped && len(*buf) < maxKexCapture {
+		*buf = append(*buf, p...)
+	}
+}
+
+// kexInits stops capturing and returns the parsed client and server
+// KEXINIT, nil when not seen.
+func (c *kexSniffer) kexInits() (client, server *kexInit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	return parseKexInit(c.written), parseKexInit(c.read)
+}
+
+func parseKexInit(data []byte) *kexInit {
+	// The version line, possibly preceded by banner lines, comes first.
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return nil
+		}
+		line := data[:i]
+		data = data[i+1:]
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			break
+		}
+	}
+	if len(data) < 5 {
+		return nil
+	}
+	length, padding := int(binary.BigEndian.Uint32(data)), int(data[4])
+	if length > len(data)-4 || length < padding+1 {
+		return nil
+	}
+	var msg kexInit
+	if err := ssh.Unmarshal(data[5:4+length-padding], &msg); err != nil {
+		return nil
+	}
+	return &msg
+}
+
+// negotiated returns the first client algorithm the server also offers,
+// which is the one the handshake picks.
+func negotiated(client, server []string) string {
+	for _, name := range client {
+		if slices.Contains(server, name) {
+			return name
+		}
+	}
+	return "none"
+}
+
+// logAlgorithms logs the algorithms a handshake negotiated, or when it
+// failed, the ones the server offered.
+func logAlgorithms(logger *log.Logger, host string, conn *kexSniffer, handshakeErr error) {
+	client, server := conn.kexInits()
+	if server == nil {
+		return
+	}
+	if handshakeErr != nil || client == nil {
+		logger.Printf("DEBUG %s offers key exchanges %s, ciphers %s, MACs %s", host,
+			strings.Join(server.KexAlgos, ","), strings.Join(server.CiphersClientServer, ","),
+			strings.Join(server.MACsClientServer, ","))
+		return
+	}
+	cipherOut := negotiated(client.CiphersClientServer, server.CiphersClientServer)
+	cipherIn := negotiated(client.CiphersServerClient, server.CiphersServerClient)
+	logger.Printf("DEBUG negotiated with %s: key exchange %s, ciphers %s/%s, MACs %s/%s (client to server/server to client)", host,
+		negotiated(client.KexAlgos, server.KexAlgos), cipherOut, cipherIn,
+		negotiatedMAC(cipherOut, client.MACsClientServer, server.MACsClientServer),
+		negotiatedMAC(cipherIn, client.MACsServerClient, server.MACsServerClient))
+}
+
+// negotiatedMAC is like negotiated, except that AEAD ciphers authenticate
+// by themselves and use no MAC.
+func negotiatedMAC(cipher string, client, server []string) string {
+	if strings.Contains(cipher, "-gcm@") || strings.HasPrefix(cipher, "chacha20-poly1305") {
+		return "implicit"
+	}
+	return negotiated(client, server)
+}
@@ -0,0 +1,159 @@
+package datasync
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The state DB remembers the size and ModTime each source file had the last
+// time it was transferred or found up to date, so unchanged files can be
+// skipped without stat'ing the destination. It is only a cache: deleting
+// it makes the next run compare every file again.
+
+var (
+	stateDBs   = make(map[string]*bolt.DB)
+	stateDBsMu sync.Mutex
+)
+
+// openStateDB returns the process-wide handle for path, opening it on first
+// use. Configs may share one file; each config uses its own bucket.
+func openStateDB(path string) (*bolt.DB, error) {
+	stateDBsMu.Lock()
+	defer stateDBsMu.Unlock()
+
+	if db, ok := stateDBs[path]; ok {
+		return db, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	stateDBs[path] = db
+	return db, nil
+}
+
+type fileState struct {
+	size    int64
+	modTime int64
+}
+
+func fileStateOf(info os.FileInfo) fileState {
+	return fileState{size: info.Size(), modTime: info.ModTime().UnixNano()}
+}
+
+func (s fileState) encode() []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], uint64(s.size))
+	binary.BigEndian.PutUint64(buf[8:], uint64(s.modTime))
+	return buf
+}
+
+func decodeFileState(buf []byte) (fileState, bool) {
+	if len(buf) != 16 {
+		return fileState{}, false
+	}
+	return fileState{
+		size:    int64(binary.BigEndian.Uint64(buf[:8])),
+		modTime: int64(binary.BigEndian.Uint64(buf[8:])),
+	}, true
+}
+
+// stateKey identifies a source file by its slash-separated path relative to
+// the configured source root, so date subfolders get distinct keys.
+func (r *syncRun) stateKey(srcPath string) string {
+	if r.config.direction() == "push" {
+		rel, err := filepath.Rel(r.config.LocalDir, srcPath)
+		if err != nil || r.multiPair {
+			return filepath.ToSlash(srcPath)
+		}
+		return filepath.ToSlash(rel)
+	}
+	// Remote paths are slash-separated whatever the local OS, which
+	// filepath.Rel would not leave alone on Windows.
+	rel, ok := remoteRel(r.config.RemoteDir, srcPath)
+	if !ok || r.multiPair {
+		// Pairs of one config share a bucket, so keep the pair's root in
+		// the key.
+		return toRemote(srcPath)
+	}
+	return rel
+}
+
+func (r *syncRun) stateUnchanged(key string, info os.FileInfo) bool {
+	if r.stateDB == nil || r.force() || r.config.conflictPolicy() == "always" {
+		return false
+	}
+	var unchanged bool
+	r.stateDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(r.config.Key()))
+		if bucket == nil {
+			return nil
+		}
+		state, ok := decodeFileState(bucket.Get([]byte(key)))
+		unchanged = ok && state == fileStateOf(info)
+		return nil
+	})
+	return unchanged
+}
+
+// stateKnown reports whether the state DB has recorded the source file key
+// in an earlier run.
+func (r *syncRun) stateKnown(key string) bool {
+	if r.stateDB == nil {
+		return false
+	}
+	var known bool
+	r.stateDB.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(r.config.Key())); bucket != nil {
+			known = bucket.Get([]byte(key)) != nil
+		}
+		return nil
+	})
+	return known
+}
+
+// stateBatch collects the updates of one directory so they are written in a
+// single transaction.
+type stateBatch map[string]fileState
+
+func (r *syncRun) newStateBatch() stateBatch {
+	if r.stateDB == nil || r.dryRun() {
+		return nil
+	}
+	return make(stateBatch)
+}
+
+func (b stateBatch) add(key string, info os.FileInfo) {
+	if b != nil {
+		b[key] = fileStateOf(info)
+	}
+}
+
+func (r *syncRun) commitState(batch stateBatch) {
+	if len(batch) == 0 {
+		return
+	}
+	err := r.stateDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(r.config.Key()))
+		if err != nil {
+			return err
+		}
+		for key, state := range batch {
+			if err := bucket.Put([]byte(key), state.encode()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		r.errorln("Failed to update state DB:", err)
+	}
+}
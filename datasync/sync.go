@@ -0,0 +1,1087 @@
+// Package datasync keeps a local directory and a directory on an SFTP
+// server in sync, pulling remote changes down or pushing local ones up.
+package datasync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/openpgp"
+)
+
+// Syncer runs syncs. Its zero value is ready to use, and it is safe for
+// concurrent use by multiple goroutines.
+type Syncer struct {
+	// Debug logs the transfer decision for every file of every config, as
+	// LogLevel "debug" does for a single config.
+	Debug bool
+
+	// MaxConnectionsPerHost limits the simultaneous connections to the same
+	// SSH host across all syncs run by this Syncer. Zero means unlimited.
+	// It is read when a host is first connected to.
+	MaxConnectionsPerHost int
+
+	// MaxConcurrentDials limits how many SSH connection attempts, including
+	// those of reconnects and dial retries, are made at once across all
+	// syncs run by this Syncer. Zero means unlimited. It is read when the
+	// first connection attempt is made.
+	MaxConcurrentDials int
+
+	// NewSessionsPerSecond spaces out the SSH connection attempts of all
+	// syncs run by this Syncer so that no more than this many start per
+	// second. Zero means unlimited. It is read when the first connection
+	// attempt is made.
+	NewSessionsPerSecond float64
+
+	// MaxBytesPerSec caps the combined rate of all transfers run by this
+	// Syncer, on top of the MaxBytesPerSec of each config. Zero means
+	// unlimited. It is read when the first transfer starts.
+	MaxBytesPerSec int64
+
+	// DryRun logs what every sync would transfer or delete without changing
+	// anything, as DryRun does for a single config.
+	DryRun bool
+
+	// ExcludeEndDate makes SyncRange stop before endDate instead of
+	// including it.
+	ExcludeEndDate bool
+
+	// DateStep makes SyncRange sync only every DateStep-th date, counted
+	// from startDate. Zero means every date.
+	DateStep int
+
+	// DateConcurrency makes SyncRange sync up to DateConcurrency dates at
+	// once, each over its own connection, but never more than
+	// MaxConnectionsPerHost. Events are then called from several
+	// goroutines. Zero or one syncs the dates one after the other.
+	DateConcurrency int
+
+	// Color wraps log messages in ANSI colors: transferred files green,
+	// warnings yellow, errors red and debug output, such as the reasons
+	// files are skipped, gray.
+	Color bool
+
+	// FailFast makes SyncRange skip the remaining dates once a date
+	// reported an error.
+	FailFast bool
+
+	// Force transfers every file of every sync, as Force does for a single
+	// config.
+	Force bool
+
+	// Only restricts every sync to these paths, relative to the synced
+	// directories, pruning the walk at the top instead of filtering every
+	// file. Archives are always synced whole.
+	Only []string
+
+	// CheckpointDir, when set, makes SyncRange keep a checkpoint of the
+	// dates each directory pair completed in this directory, so that
+	// syncing the same config and range again skips them, unless Force is
+	// set. DateResult.Resumed marks the skipped dates.
+	CheckpointDir string
+
+	// Since, when set, leaves out every file last modified at or before
+	// it, in addition to the file filters of each config.
+	Since time.Time
+
+	// Events, when set, is notified of transferred and skipped files,
+	// errors and completed directories.
+	Events Events
+
+	// Connect opens the remote side of a sync. When nil, the Syncer connects
+	// to the config's SFTP server.
+	Connect func(ctx context.Context, config Config) (Client, error)
+
+	// AllowedRemoteRoots, when set, makes every sync whose remote
+	// directories are not below one of these fail without connecting; see
+	// CheckRemoteRoots.
+	AllowedRemoteRoots []string
+
+	// MaxDateRangeDays, when set, makes SyncRange fail before running
+	// anything, the preCommand included, when the range holds more dates
+	// than this, unless AllowLongRange is set.
+	MaxDateRangeDays int
+	AllowLongRange   bool
+
+	mu               sync.Mutex
+	hostSlots        map[string]chan struct{}
+	dialSlots        chan struct{}
+	sessions         *sessionLimiter
+	preparedTempDirs map[string]bool
+	inFlight         map[string]bool
+	bandwidth        *rateLimiter
+}
+
+// Result summarizes one sync run.
+type Result struct {
+	Started  time.Time
+	Duration time.Duration
+	Files    int
+	Skipped  int
+	Bytes    int64
+	Failed   int
+	LastErr  error
+	// Errors holds the first maxResultErrors errors of the run.
+	Errors []error
+	// Denied counts the files and directories that failed because the
+	// account may not read or write them, which DeniedPaths lists up to
+	// maxResultErrors of. They are included in Failed.
+	Denied      int
+	DeniedPaths []string
+	// Vanished counts the source files and directories that disappeared
+	// between being listed and being transferred. They are not included in
+	// Failed or Skipped.
+	Vanished int
+	// Dates holds the results of the single dates of a SyncRange, in
+	// order.
+	Dates []DateResult
+	// TransferTime adds up the time spent transferring files, so with
+	// DateConcurrency it may exceed Duration. PeakRate is the fastest rate
+	// of a single file, in bytes per second, among those that took at
+	// least a quarter of a second.
+	TransferTime time.Duration
+	PeakRate     float64
+	// SlowestDirs lists the source directories that took longest, slowest
+	// first.
+	SlowestDirs []DirTiming
+	// Planned lists what a dry run would have transferred and removed, in
+	// the order it found them; see Apply.
+	Planned []PlannedOp
+}
+
+const maxResultErrors = 100
+
+// Sync syncs the config's directories once. The returned error is non-nil
+// when any file failed; the Result is filled in either way.
+func (s *Syncer) Sync(ctx context.Context, config Config) (Result, error) {
+	return s.sync(ctx, config, "", "", nil, nil)
+}
+
+// SyncRange syncs the date subfolders, named by the config's DateLayout, from
+// startDate to endDate, inclusive unless ExcludeEndDate is set.
+func (s *Syncer) SyncRange(ctx context.Context, config Config, startDate, endDate string) (Result, error) {
+	return s.sync(ctx, config, startDate, endDate, nil, nil)
+}
+
+func (s *Syncer) sync(ctx context.Context, config Config, startDate, endDate string, changed []string, plan *runPlan) (Result, error) {
+	// abort stops the whole run through its context, which every loop
+	// checks, when a problem like low disk space makes going on pointless.
+	ctx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+	run := &syncRun{syncer: s, ctx: ctx, abort: abort, config: config, logger: newLogger(config), limit: &fileLimit{}, metrics: &runMetrics{}, changed: changed, plan: plan}
+	if plan == nil {
+		run.plan = &runPlan{}
+	}
+	started := time.Now()
+	var dates []string
+	if startDate != "" && endDate != "" {
+		var err error
+		if dates, err = s.rangeDates(config, startDate, endDate); err != nil {
+			// A refused range leaves no trace and runs no commands.
+			run.errorln("Skipping sync:", err)
+			run.fail("", err)
+			return Result{Started: started, Duration: time.Since(started), Failed: run.failed, LastErr: run.lastErr, Errors: run.errors}, run.err()
+		}
+	}
+	run.tracer = newTracer(config)
+	runSpan := run.startSpan("sync")
+	run.span = runSpan
+	if config.MaxRunDuration > 0 {
+		run.limit.deadline = started.Add(time.Duration(config.MaxRunDuration))
+	}
+	if startDate != "" && config.datedPaths() {
+		run.pathTemplates = config.DirPairs()
+	}
+	resolved, err := config.ResolvePaths(started)
+	if err == nil {
+		config, run.config = resolved, resolved
+		err = CheckRemoteRoots(config, s.AllowedRemoteRoots)
+	}
+	if err != nil {
+		run.errorln("Skipping sync:", err)
+		run.fail("", err)
+	} else if err := run.runPreCommand(); err != nil && config.AbortOnPreFailure {
+		run.errorln("Skipping sync: preCommand failed")
+		run.fail("", err)
+	} else {
+		run.syncFolder(startDate, endDate, dates)
+		run.reportDeferred()
+		if run.vanished > 0 {
+			run.infoln(run.vanished, "files or directories vanished from the source during the sync")
+		}
+	}
+	if err := context.Cause(ctx); err != nil && !errors.Is(run.lastErr, err) {
+		run.fail("", err)
+	}
+	run.runPostCommand()
+	if config.QuietTransfers {
+		run.infoln(fmt.Sprintf("Finished: %d transferred (%d bytes), %d skipped, %d failed in %s",
+			run.files, run.bytes, run.skipped, run.failed, time.Since(started).Round(time.Millisecond)))
+	}
+
+	result := Result{
+		Started:     started,
+		Duration:    time.Since(started),
+		Files:       run.files,
+		Skipped:     run.skipped,
+		Bytes:       run.bytes,
+		Failed:      run.failed,
+		LastErr:     run.lastErr,
+		Errors:      run.errors,
+		Denied:      run.denied,
+		DeniedPaths: run.deniedPaths,
+		Vanished:    run.vanished,
+		Dates:       run.dates,
+	}
+	run.metrics.fill(&result)
+	result.Planned = run.plan.planned
+	run.endSpan(runSpan, run.err(), stringAttr("datasync.direction", config.direction()),
+		intAttr("datasync.files", int64(run.files)), intAttr("datasync.bytes", run.bytes),
+		intAttr("datasync.skipped", int64(run.skipped)), intAttr("datasync.failed", int64(run.failed)))
+	run.flushTrace()
+	return result, run.err()
+}
+
+// syncFolder syncs the config's directories, or with startDate and endDate
+// its folders of dates.
+func (r *syncRun) syncFolder(startDate, endDate string, dates []string) {
+	config := r.config
+	var err error
+	ranged := startDate != "" && endDate != ""
+	if err := r.loadKeys(); err != nil {
+		r.errorln(err)
+		r.fail("", err)
+		return
+	}
+	if config.AuditLog != "" && !r.dryRun() {
+		auditLog, err := openAuditLog(config.AuditLog)
+		if err != nil {
+			err = fmt.Errorf("unable to open auditLog: %w", err)
+			r.errorln(err)
+			r.fail("", err)
+			return
+		}
+		r.auditLog = auditLog
+		defer auditLog.Close()
+	}
+	client, err := r.syncer.connect(r.ctx, config)
+	if err != nil {
+		r.errorln(err)
+		r.fail("", err)
+		return
+	}
+	r.client = client
+	defer func() { r.client.Close() }()
+
+	if config.direction() == "relay" {
+		r.dest, err = r.syncer.connect(r.ctx, config.destinationConfig())
+		if err != nil {
+			r.errorln("Failed to connect to destination:", err)
+			r.fail("", err)
+			return
+		}
+		defer func() { r.dest.Close() }()
+	}
+	r.checkConnection()
+
+	if config.StateDBPath != "" {
+		r.stateDB, err = openStateDB(config.StateDBPath)
+		if err != nil {
+			r.errorln("Failed to open state DB, comparing every file:", err)
+		}
+	}
+	r.openChecksumCache()
+
+	if ranged {
+		r.dates = make([]DateResult, len(dates))
+		for i, date := range dates {
+			r.dates[i].Date = date
+		}
+		if r.syncer.CheckpointDir != "" {
+			if r.checkpoint, err = r.loadCheckpoint(startDate, endDate); err != nil {
+				r.warnln("Failed to read the checkpoint of the date range, syncing every date:", err)
+			}
+			defer r.finishCheckpoint()
+		}
+	}
+
+	pairs := r.expandPairs(config.DirPairs())
+	if len(pairs) > 0 && !r.checkClockSkew(pairs[0].RemoteDir) {
+		return
+	}
+	r.multiPair = len(config.RemoteDirs) > 0 || hasGlob(config.RemoteDir)
+	if ranged {
+		r.dateEvents().OnRangeStart(config.Key(), len(dates)*len(pairs))
+	}
+	defer func() { r.config = config }()
+	for i, pair := range pairs {
+		if r.ctx.Err() != nil || r.limitReached() {
+			break
+		}
+		// Everything below works on the current pair as if it were the only
+		// one, including state keys and retention.
+		r.config.LocalDir, r.config.RemoteDir = pair.LocalDir, pair.RemoteDir
+		if r.pathTemplates != nil {
+			r.pairTemplate = &r.pathTemplates[i]
+		}
+		if r.changed != nil && !r.selectChanged() {
+			continue
+		}
+		if len(pairs) > 1 {
+			r.infoln("Syncing directory pair", i+1, "of", len(pairs), ":", pair.RemoteDir, "and", pair.LocalDir)
+		}
+		if !r.syncPair(ranged, dates) {
+			return
+		}
+	}
+}
+
+// syncPair syncs the current directory pair, or its date folders in a
+// ranged sync, and applies retention. It returns false when AbortOnError
+// stopped the run.
+func (r *syncRun) syncPair(ranged bool, dates []string) bool {
+	config := r.config
+	failed := r.failed
+	// The source is only pruned once everything in it has been shipped.
+	defer func() {
+		if r.failed == failed && r.changed == nil {
+			r.pruneSource()
+		}
+	}()
+	if !ranged {
+		if err := r.syncData(config.LocalDir, config.RemoteDir); err != nil {
+			r.errorln("Failed to sync folder:", err)
+			if config.AbortOnError {
+				return false
+			}
+		}
+		if r.changed == nil {
+			r.applyRetention()
+		}
+		return true
+	}
+
+	if r.syncer.dateConcurrency(len(dates)) > 1 {
+		ok := r.syncDatesParallel(dates)
+		if ok {
+			r.applyRetention()
+		}
+		return ok
+	}
+	for i, date := range dates {
+		if r.ctx.Err() != nil || r.limitReached() {
+			break
+		}
+		if r.checkpointed(date) {
+			r.dates[i].Resumed = true
+			r.dateEvents().OnDateComplete(date, DirStats{}, true)
+			continue
+		}
+		before := r.stats()
+		r.dateEvents().OnDateStart(date)
+		ok := r.syncDate(date)
+		r.addDateResult(i, before)
+		r.dateEvents().OnDateComplete(date, r.statsSince(before), false)
+		if r.failed == before.Failed && r.dateCompleted() {
+			r.markDone(date)
+		}
+		if !ok || r.failedFast(date, r.failed > before.Failed) {
+			return false
+		}
+	}
+	r.applyRetention()
+	return true
+}
+
+func (s *Syncer) dateStep() int {
+	if s.DateStep == 0 {
+		return 1
+	}
+	return s.DateStep
+}
+
+// rangeDates returns the dates from startDate to endDate a range sync of
+// config goes through. It fails a range exceeding MaxDateRangeDays,
+// guarding against a mistyped range pulling years of data.
+func (s *Syncer) rangeDates(config Config, startDate, endDate string) ([]string, error) {
+	dates, err := generateDateSlice(startDate, endDate, config.dateLayout(), !s.ExcludeEndDate, s.dateStep())
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate date slice: %w", err)
+	}
+	if s.MaxDateRangeDays > 0 && len(dates) > s.MaxDateRangeDays && !s.AllowLongRange {
+		return nil, fmt.Errorf("the range from %s to %s holds %d dates, more than maxDateRangeDays (%d); allowLongRange syncs it anyway", startDate, endDate, len(dates), s.MaxDateRangeDays)
+	}
+	return dates, nil
+}
+
+func generateDateSlice(startDate, endDate, layout string, inclusiveEnd bool, step int) ([]string, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("invalid date step %d: must be at least 1", step)
+	}
+	var dateSlice []string
+	start, err := time.Parse(layout, startDate)
+	if err != nil {
+		return nil, err
+	}
+	end, err := time.Parse(layout, endDate)
+	if err != nil {
+		return nil, err
+	}
+	if start.After(end) {
+		return nil, fmt.Errorf("startDate %s is after endDate %s", startDate, endDate)
+	}
+	for start.Before(end) || inclusiveEnd && start.Equal(end) {
+		dateSlice = append(dateSlice, start.Format(layout))
+		start = start.AddDate(0, 0, step)
+	}
+	return dateSlice, nil
+}
+
+// createDateDir creates the destination folder of a date, including the
+// parents a nested DateLayout needs.
+func (r *syncRun) createDateDir(localDir, remoteDir string) error {
+	if r.dryRun() {
+		return nil
+	}
+	if r.config.direction() == "push" {
+		// A missing source folder is reported by pushData; don't leave an
+		// empty folder behind for it.
+		if _, err := os.Stat(localDir); err != nil {
+			return nil
+		}
+		if r.config.archiveMode() != "" {
+			// The archive goes next to where the folder would be.
+			return r.mkdirRemote(r.client, path.Dir(remoteDir))
+		}
+		return r.mkdirRemote(r.client, remoteDir)
+	}
+	if r.config.direction() == "relay" {
+		return r.mkdirRemote(r.dest, localDir)
+	}
+	return r.mkdirLocal(localDir)
+}
+
+type syncRun struct {
+	syncer     *Syncer
+	ctx        context.Context
+	abort      context.CancelCauseFunc
+	client     Client
+	dest       Client
+	config     Config
+	stateDB    *bolt.DB
+	checksumDB *bolt.DB
+	ignores    []ignoreRules
+	logger     *log.Logger
+	multiPair  bool
+	reconnects int
+	lister     *dirLister
+	tree       map[string]treeDir
+	files      int
+	skipped    int
+	bytes      int64
+	failed     int
+	lastErr    error
+	errors     []error
+	dates      []DateResult
+	limit      *fileLimit
+	metrics    *runMetrics
+	keys       openpgp.EntityList
+	// root is the source directory syncData was called for.
+	root string
+	// reason is why the file being handled is transferred.
+	reason   string
+	auditLog *os.File
+	// denied counts the failures for a lack of permission, deniedPaths
+	// lists their paths.
+	denied      int
+	deniedPaths []string
+	// vanished counts the source files and directories that disappeared
+	// during the sync.
+	vanished int
+	// remoteHashMissing is set once UseRemoteHash found the server unable
+	// to hash files.
+	remoteHashMissing bool
+	// changed holds the local paths SyncFiles pushes, and only those of
+	// them below the current pair, relative to it.
+	changed []string
+	only    []string
+	// checkpoint records the completed dates of a SyncRange with
+	// Syncer.CheckpointDir.
+	checkpoint *rangeCheckpoint
+	// clockSkewMode replaces compareMode once checkClockSkew found the
+	// server's clock too far off.
+	clockSkewMode string
+	// nested adds up the timings of the directories completed so far.
+	nested DirTiming
+	// tracer collects the spans of the run with TracingEndpoint, and span
+	// is the one new spans are children of.
+	tracer *tracer
+	span   *span
+	// queued holds the subdirectories a breadth-first traversal is yet to
+	// sync.
+	queued []pendingDir
+	// plan collects the operations of a dry run, and holds those Apply
+	// carries out.
+	plan *runPlan
+	// pathTemplates holds the directory pairs of a date range sync whose
+	// paths depend on the date, as configured, and pairTemplate the one of
+	// the current pair.
+	pathTemplates []DirPair
+	pairTemplate  *DirPair
+
+	ownershipWarned bool
+}
+
+func (r *syncRun) fail(path string, err error) {
+	r.failed++
+	r.countFailure()
+	r.lastErr = err
+	if len(r.errors) < maxResultErrors {
+		r.errors = append(r.errors, err)
+	}
+	r.events().OnError(path, err)
+	r.traceError(path, err)
+	if isAccessDenied(err) {
+		r.deny(path)
+	}
+}
+
+func (r *syncRun) err() error {
+	if r.failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d errors, last error: %w", r.failed, r.lastErr)
+}
+
+func (r *syncRun) force() bool {
+	return r.syncer.Force || r.config.Force
+}
+
+func (r *syncRun) dryRun() bool {
+	return r.syncer.DryRun || r.config.DryRun
+}
+
+// shouldTransfer compares a source file with its destination counterpart,
+// which is nil when the destination does not exist yet.
+func (r *syncRun) shouldTransfer(path, dstPath string, srcInfo, dstInfo os.FileInfo) bool {
+	r.reason = ""
+	srcSide, dstSide := "remote", "locally"
+	switch r.config.direction() {
+	case "push":
+		srcSide, dstSide = "local", "remotely"
+	case "relay":
+		srcSide, dstSide = "source", "on the destination"
+	}
+
+	if dstInfo == nil {
+		return r.transferBecause(path, "missing %s", dstSide)
+	}
+	if r.config.ZeroBytePolicy == "skip-if-destination-nonempty" && srcInfo.Size() == 0 && dstInfo.Size() > 0 && !r.resized(path) {
+		r.debugf("%s: skip (empty, would overwrite %d bytes %s)", path, dstInfo.Size(), dstSide)
+		return false
+	}
+	if r.force() {
+		return r.transferBecause(path, "forced")
+	}
+	switch r.config.conflictPolicy() {
+	case "always":
+		return r.transferBecause(path, "conflictPolicy always")
+	case "never":
+		r.debugf("%s: skip (exists %s, no overwrite)", path, dstSide)
+		return false
+	case "larger":
+		if srcInfo.Size() > dstInfo.Size() {
+			return r.transferBecause(path, "%s larger: source %d bytes, destination %d bytes", srcSide, srcInfo.Size(), dstInfo.Size())
+		}
+		r.debugf("%s: skip (destination not smaller: source %d bytes, destination %d bytes)", path, srcInfo.Size(), dstInfo.Size())
+		return false
+	}
+
+	mode := r.compareMode()
+	if mode == "checksum" {
+		return r.checksumsDiffer(path, dstPath)
+	}
+	if mode != "modtime" && !r.resized(path) && srcInfo.Size() != dstInfo.Size() {
+		return r.transferBecause(path, "size differs: source %d bytes, destination %d bytes", srcInfo.Size(), dstInfo.Size())
+	}
+	if r.config.UseRemoteHash {
+		if differs, ok := r.remoteHashDiffers(path, dstPath); ok {
+			return differs
+		}
+	}
+	if mode == "size" {
+		r.debugf("%s: skip (same size: %d bytes)", path, srcInfo.Size())
+		return false
+	}
+	srcTime := srcInfo.ModTime().Format(time.RFC3339)
+	dstTime := dstInfo.ModTime().Format(time.RFC3339)
+	if srcInfo.ModTime().After(dstInfo.ModTime()) {
+		return r.transferBecause(path, "%s newer: source %s, destination %s", srcSide, srcTime, dstTime)
+	}
+	r.debugf("%s: skip (up to date: source %s, destination %s)", path, srcTime, dstTime)
+	return false
+}
+
+// transferBecause logs why path is transferred, and keeps the reason for
+// the audit log.
+func (r *syncRun) transferBecause(path, format string, args ...any) bool {
+	r.reason = fmt.Sprintf(format, args...)
+	r.debugf("%s: transfer (%s)", path, r.reason)
+	return true
+}
+
+// compareMode is the config's compareMode, degraded to "size" when the
+// remote side cannot tell modification times, or to OnClockSkew when its
+// clock is too far off.
+func (r *syncRun) compareMode() string {
+	mode := r.config.compareMode()
+	if r.clockSkewMode != "" && mode != "checksum" {
+		return r.clockSkewMode
+	}
+	if c, ok := clientAs[modTimeClient](r.client); ok && !c.SupportsModTime() && mode != "checksum" {
+		return "size"
+	}
+	return mode
+}
+
+// checksumsDiffer compares the SHA-256 of both copies of a file. A copy
+// that cannot be hashed counts as different.
+func (r *syncRun) checksumsDiffer(srcPath, dstPath string) bool {
+	localPath, remotePath := dstPath, srcPath
+	if r.config.direction() == "push" {
+		localPath, remotePath = srcPath, dstPath
+	}
+	localSum, err := r.localSHA256(localPath)
+	if err != nil {
+		r.warnln("Failed to hash", localPath, ", transferring:", err)
+		r.reason = "local copy cannot be hashed"
+		return true
+	}
+	remoteSum, err := r.remoteSHA256(remotePath)
+	if err != nil {
+		r.warnln("Failed to hash", remotePath, ", transferring:", err)
+		r.reason = "remote copy cannot be hashed"
+		return true
+	}
+	if localSum != remoteSum {
+		return r.transferBecause(srcPath, "checksum differs")
+	}
+	r.debugf("%s: skip (same checksum)", srcPath)
+	return false
+}
+
+// fileContext returns the context for transferring a single file, bounded
+// by FileTimeout when one is configured.
+func (r *syncRun) fileContext() (context.Context, context.CancelFunc) {
+	if r.config.FileTimeout <= 0 {
+		return context.WithCancel(r.ctx)
+	}
+	return context.WithTimeout(r.ctx, time.Duration(r.config.FileTimeout)*time.Second)
+}
+
+func (r *syncRun) syncData(localDir, remoteDir string) error {
+	if r.config.archiveMode() != "" {
+		return r.syncArchive(localDir, remoteDir)
+	}
+	r.root = remoteDir
+	if r.config.direction() == "push" {
+		r.root = localDir
+	}
+	if r.config.direction() == "pull" {
+		return r.traverse(r.pullData, localDir, remoteDir, "Failed to download directory", true)
+	} else if r.config.direction() == "push" {
+		return r.traverse(r.pushData, localDir, remoteDir, "Failed to upload directory", true)
+	} else if r.config.direction() == "relay" {
+		return r.traverse(r.relayData, localDir, remoteDir, "Failed to copy directory", false)
+	} else {
+		err := fmt.Errorf("invalid action: %s", r.config.Action)
+		r.fail("", err)
+		return err
+	}
+}
+
+// depthExceeded reports whether a subdirectory at depth, counted from the
+// synced root at depth 0, lies beyond MaxDepth and must not be entered.
+func (r *syncRun) depthExceeded(dir string, depth int) bool {
+	if r.config.MaxDepth <= 0 || depth <= r.config.MaxDepth {
+		return false
+	}
+	r.warnln("Skipping directory", dir, ": deeper than maxDepth", r.config.MaxDepth)
+	return true
+}
+
+func (r *syncRun) pullData(localDir, remoteDir string, depth int) error {
+	if depth == 0 {
+		defer r.listTree(remoteDir)()
+		defer r.startLister(remoteDir)()
+	}
+	mark := r.startDir()
+	var remoteFiles []os.FileInfo
+	err := r.retryOnDisconnect(func() (err error) {
+		remoteFiles, err = r.readRemoteDir(remoteDir)
+		return err
+	})
+	if err != nil && depth > 0 && r.vanishedFrom(remoteDir, true, err) {
+		r.endDirSpan(remoteDir, mark)
+		return nil
+	}
+	if err != nil {
+		r.fail(remoteDir, err)
+		r.endDirSpan(remoteDir, mark)
+		return err
+	}
+	defer r.completeDir(remoteDir, mark)
+	defer r.loadIgnoreRules(remoteDir)()
+
+	manifest := r.openManifest(localDir)
+	defer r.closeManifest(manifest)
+	batch := r.newStateBatch()
+	defer r.commitState(batch)
+	caseNames := r.caseCollisions(localDir, remoteDir, remoteFiles)
+
+	orderEntries(r, remoteFiles)
+	for i, file := range remoteFiles {
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+		if r.limitReached() {
+			deferEntries(r, remoteFiles[i:])
+			return nil
+		}
+		if file.Name() == manifestName {
+			continue
+		}
+		remoteFilePath := remoteJoin(remoteDir, file.Name())
+		localFilePath := filepath.Join(localDir, r.plainName(file.Name(), file.IsDir()))
+		if name, ok := caseNames[file.Name()]; ok {
+			if name == "" {
+				continue
+			}
+			localFilePath = filepath.Join(localDir, name)
+		}
+		if r.hidden(remoteFilePath, file.Name()) || r.ignored(remoteFilePath, file.IsDir()) || !r.within(remoteFilePath, file.IsDir()) {
+			continue
+		}
+
+		if file.IsDir() {
+			if r.depthExceeded(remoteFilePath, depth+1) {
+				continue
+			}
+			ok, err := r.createDestDir(remoteFilePath, localFilePath, func() error {
+				return r.mkdirLocal(localFilePath)
+			})
+			if !ok {
+				if err != nil && r.config.AbortOnError {
+					return err
+				}
+				continue
+			}
+			if r.breadthFirst() {
+				r.queueDir(localFilePath, remoteFilePath, depth+1)
+				continue
+			}
+			if err := r.pullData(localFilePath, remoteFilePath, depth+1); err != nil {
+				r.errorln("Failed to download directory", remoteFilePath, ":", err)
+				if r.config.AbortOnError {
+					return err
+				}
+				continue
+			}
+			r.removeEmptyRemoteDir(remoteFilePath)
+		} else {
+			if r.excluded(remoteFilePath, file) || r.offPlan(remoteFilePath, file, false) {
+				continue
+			}
+			key := r.stateKey(remoteFilePath)
+			if r.stateUnchanged(key, file) {
+				r.debugf("%s: skip (unchanged since last run)", remoteFilePath)
+				r.skip(remoteFilePath, "unchanged since last run")
+				continue
+			}
+
+			remoteFileInfo := file
+			var err error
+			if !r.listed(key, file) {
+				err = r.retryOnDisconnect(func() (err error) {
+					remoteFileInfo, err = r.client.Stat(remoteFilePath)
+					return err
+				})
+			}
+			if err != nil {
+				if r.vanishedFrom(remoteFilePath, true, err) {
+					continue
+				}
+				r.errorln("Failed to stat remote file", remoteFilePath, ":", err)
+				r.fail(remoteFilePath, err)
+				if r.config.AbortOnError {
+					return err
+				}
+				continue
+			}
+
+			localFileInfo, err := os.Stat(localFilePath)
+			if err != nil && !os.IsNotExist(err) {
+				r.errorln("Failed to stat local file", localFilePath, ":", err)
+				r.fail(localFilePath, err)
+				if r.config.AbortOnError {
+					return err
+				}
+				continue
+			}
+			if localFileInfo != nil && localFileInfo.IsDir() {
+				ok, err := r.resolveTypeMismatch(remoteFilePath, localFilePath, localFileInfo)
+				if !ok {
+					if err != nil && r.config.AbortOnError {
+						return err
+					}
+					continue
+				}
+				localFileInfo = nil
+			}
+			transfer := r.shouldTransfer(remoteFilePath, localFilePath, remoteFileInfo, localFileInfo)
+			if !transfer && localFileInfo != nil && r.config.conflictPolicy() != "never" {
+				transfer = r.manifestChanged(manifest, file.Name(), localFileInfo, remoteFileInfo)
+			}
+			if !transfer {
+				r.skip(remoteFilePath, "up to date")
+			}
+			if transfer && r.dryRun() {
+				r.planTransfer("download", remoteFilePath, localFilePath, remoteFileInfo)
+				continue
+			}
+			if transfer {
+				if err := r.checkFreeSpace(localDir, remoteFileInfo.Size()); err != nil {
+					r.errorln("Skipping", remoteFilePath, ":", err)
+					r.fail(remoteFilePath, err)
+					if r.config.AbortOnLowSpace {
+						r.errorln("Aborting the sync")
+						r.abort(err)
+						return err
+					}
+					if r.config.AbortOnError {
+						return err
+					}
+					continue
+				}
+				release, claimed := r.claimTransfer(remoteFilePath, localFilePath)
+				if !claimed {
+					continue
+				}
+				ctx, cancel := r.fileContext()
+				err := r.retryOnDisconnect(func() error {
+					return r.downloadFile(ctx, localFilePath, remoteFilePath, r.transferOptions())
+				})
+				cancel()
+				if err == nil {
+					err = r.postProcess(localFilePath, remoteFilePath)
+				}
+				release()
+				r.audit("download", localFilePath, remoteFilePath, remoteFileInfo.Size(), err)
+				if err != nil {
+					if r.vanishedFrom(remoteFilePath, true, err) {
+						continue
+					}
+					r.errorln("Failed to download file", remoteFilePath, ":", err)
+					r.fail(remoteFilePath, err)
+					if r.config.AbortOnError {
+						return err
+					}
+					continue
+				}
+				r.countFile()
+				r.recordManifest(manifest, file.Name())
+				r.preserveOwnership(localFilePath, remoteFileInfo)
+				r.preserveXattrs(remoteFilePath, localFilePath)
+				r.dedup(localFilePath)
+				if r.config.moves() {
+					if err := r.removeSource(localFilePath, remoteFilePath); err != nil {
+						r.fail(remoteFilePath, err)
+						if r.config.AbortOnError {
+							return err
+						}
+					}
+					continue
+				}
+			}
+			batch.add(key, file)
+		}
+	}
+
+	return nil
+}
+
+func (r *syncRun) pushData(localDir, remoteDir string, depth int) error {
+	mark := r.startDir()
+	localFiles, err := os.ReadDir(localDir)
+	if err != nil && depth > 0 && r.vanishedFrom(localDir, false, err) {
+		r.endDirSpan(localDir, mark)
+		return nil
+	}
+	if err != nil {
+		r.fail(localDir, err)
+		r.endDirSpan(localDir, mark)
+		return err
+	}
+	defer r.completeDir(localDir, mark)
+	defer r.loadIgnoreRules(localDir)()
+
+	manifest := r.openManifest(localDir)
+	defer r.closeManifest(manifest)
+	batch := r.newStateBatch()
+	defer r.commitState(batch)
+
+	orderEntries(r, localFiles)
+	for i, file := range localFiles {
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+		if r.limitReached() {
+			deferEntries(r, localFiles[i:])
+			return nil
+		}
+		if file.Name() == manifestName {
+			continue
+		}
+		localFilePath := filepath.Join(localDir, file.Name())
+		remoteFilePath := remoteJoin(remoteDir, r.remoteName(file.Name(), file.IsDir()))
+		if r.hidden(localFilePath, file.Name()) || r.ignored(localFilePath, file.IsDir()) || !r.within(localFilePath, file.IsDir()) {
+			continue
+		}
+
+		if file.IsDir() {
+			if r.depthExceeded(localFilePath, depth+1) {
+				continue
+			}
+			ok, err := r.createDestDir(localFilePath, remoteFilePath, func() error {
+				return r.mkdirRemote(r.client, remoteFilePath)
+			})
+			if !ok {
+				if err != nil && r.config.AbortOnError {
+					return err
+				}
+				continue
+			}
+			if r.breadthFirst() {
+				r.queueDir(localFilePath, remoteFilePath, depth+1)
+				continue
+			}
+			if err := r.pushData(localFilePath, remoteFilePath, depth+1); err != nil {
+				r.errorln("Failed to upload directory", localFilePath, ":", err)
+				if r.config.AbortOnError {
+					return err
+				}
+				continue
+			}
+			r.removeEmptyLocalDir(localFilePath)
+		} else {
+			localFileInfo, err := os.Stat(localFilePath)
+			if err != nil {
+				if r.vanishedFrom(localFilePath, false, err) {
+					continue
+				}
+				r.errorln("Failed to stat local file", localFilePath, ":", err)
+				r.fail(localFilePath, err)
+				if r.config.AbortOnError {
+					return err
+				}
+				continue
+			}
+			if r.excluded(localFilePath, localFileInfo) || r.unsettled(localFilePath, localFileInfo) || r.offPlan(localFilePath, localFileInfo, false) {
+				continue
+			}
+			key := r.stateKey(localFilePath)
+			if r.stateUnchanged(key, localFileInfo) {
+				r.debugf("%s: skip (unchanged since last run)", localFilePath)
+				r.skip(localFilePath, "unchanged since last run")
+				continue
+			}
+
+			var remoteFileInfo os.FileInfo
+			err = r.retryOnDisconnect(func() (err error) {
+				remoteFileInfo, err = r.client.Stat(remoteFilePath)
+				return err
+			})
+			if err != nil && !os.IsNotExist(err) {
+				r.errorln("Failed to stat remote file", remoteFilePath, ":", err)
+				r.fail(remoteFilePath, err)
+				if r.config.AbortOnError {
+					return err
+				}
+				continue
+			}
+			if remoteFileInfo != nil && remoteFileInfo.IsDir() {
+				ok, err := r.resolveTypeMismatch(localFilePath, remoteFilePath, remoteFileInfo)
+				if !ok {
+					if err != nil && r.config.AbortOnError {
+						return err
+					}
+					continue
+				}
+				remoteFileInfo = nil
+			}
+			transfer := r.shouldTransfer(localFilePath, remoteFilePath, localFileInfo, remoteFileInfo)
+			if !transfer && remoteFileInfo != nil && r.config.conflictPolicy() != "never" {
+				transfer = r.manifestChanged(manifest, file.Name(), localFileInfo, remoteFileInfo)
+			}
+			if !transfer {
+				r.skip(localFilePath, "up to date")
+			}
+			if transfer && r.dryRun() {
+				r.planTransfer("upload", localFilePath, remoteFilePath, localFileInfo)
+				continue
+			}
+			if transfer {
+				release, claimed := r.claimTransfer(localFilePath, remoteFilePath)
+				if !claimed {
+					continue
+				}
+				ctx, cancel := r.fileContext()
+				err := r.retryOnDisconnect(func() error {
+					return r.uploadFile(ctx, localFilePath, remoteFilePath, r.transferOptions())
+				})
+				cancel()
+				release()
+				r.audit("upload", localFilePath, remoteFilePath, localFileInfo.Size(), err)
+				if err != nil {
+					if r.config.SkipLocked && isFileLocked(err) {
+						r.warnln("Skipping", localFilePath, ": file in use, will retry next run")
+						r.skip(localFilePath, "file in use")
+						continue
+					}
+					if r.vanishedFrom(localFilePath, false, err) {
+						continue
+					}
+					r.errorln("Failed to upload file", localFilePath, ":", err)
+					r.fail(localFilePath, err)
+					if r.config.AbortOnError {
+						return err
+					}
+					continue
+				}
+				r.countFile()
+				r.preserveXattrs(localFilePath, remoteFilePath)
+				if r.config.moves() {
+					if err := r.removeSource(localFilePath, remoteFilePath); err != nil {
+						r.fail(localFilePath, err)
+						if r.config.AbortOnError {
+							return err
+						}
+					}
+					continue
+				}
+				r.recordManifest(manifest, file.Name())
+			}
+			batch.add(key, localFileInfo)
+		}
+	}
+
+	return nil
+}
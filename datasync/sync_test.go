@@ -0,0 +1,299 @@
+package datasync_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"data_sync/datasync"
+	"data_sync/datasync/datasynctest"
+)
+
+var (
+	remoteTime  = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	olderTime   = remoteTime.Add(-time.Hour)
+	newerTime   = remoteTime.Add(time.Hour)
+	errInjected = errors.New("injected failure")
+)
+
+// localFile is a file the local directory holds before the sync.
+type localFile struct {
+	name    string
+	data    string
+	modTime time.Time
+}
+
+// writeLocal creates files in a new local directory and returns it.
+func writeLocal(t *testing.T, files ...localFile) string {
+	t.Helper()
+	localDir := t.TempDir()
+	for _, f := range files {
+		name := filepath.Join(localDir, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(f.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, f.modTime, f.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return localDir
+}
+
+// pull syncs /data of remote into a new local directory holding files,
+// and returns the result and the local directory.
+func pull(t *testing.T, remote *datasynctest.MemClient, files ...localFile) (datasync.Result, string) {
+	t.Helper()
+	localDir := writeLocal(t, files...)
+	return pullInto(remote, localDir), localDir
+}
+
+// pullInto syncs /data of remote into localDir.
+func pullInto(remote *datasynctest.MemClient, localDir string) datasync.Result {
+	return syncMem(remote, "pull", localDir)
+}
+
+// push syncs a new local directory holding files to /data of remote,
+// creating /data first, and returns the result and the local directory.
+func push(t *testing.T, remote *datasynctest.MemClient, files ...localFile) (datasync.Result, string) {
+	t.Helper()
+	localDir := writeLocal(t, files...)
+	if err := remote.MkdirAll("/data"); err != nil {
+		t.Fatal(err)
+	}
+	return syncMem(remote, "push", localDir), localDir
+}
+
+// syncMem runs a sync of action between localDir and /data of remote.
+func syncMem(remote *datasynctest.MemClient, action, localDir string) datasync.Result {
+	syncer := &datasync.Syncer{Connect: func(context.Context, datasync.Config) (datasync.Client, error) {
+		return remote, nil
+	}}
+	config := datasync.Config{Name: "test", SSHHost: "memory", Action: action, LocalDir: localDir, RemoteDir: "/data"}
+	result, _ := syncer.Sync(context.Background(), config)
+	return result
+}
+
+func readLocal(t *testing.T, localDir, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(localDir, filepath.FromSlash(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPullComparesModTimes(t *testing.T) {
+	tests := []struct {
+		name        string
+		local       []localFile
+		files       int
+		skipped     int
+		wantContent string
+	}{
+		{name: "missing", files: 1, wantContent: "remote"},
+		{name: "same modtime and size", local: []localFile{{"a.txt", "local!", remoteTime}}, skipped: 1, wantContent: "local!"},
+		{name: "newer modtime", local: []localFile{{"a.txt", "local!", newerTime}}, skipped: 1, wantContent: "local!"},
+		{name: "older modtime", local: []localFile{{"a.txt", "local!", olderTime}}, files: 1, wantContent: "remote"},
+		{name: "different size", local: []localFile{{"a.txt", "local", remoteTime}}, files: 1, wantContent: "remote"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := datasynctest.NewMemClient()
+			remote.WriteFile("/data/a.txt", []byte("remote"), remoteTime)
+			result, localDir := pull(t, remote, tt.local...)
+			if result.Files != tt.files || result.Skipped != tt.skipped || result.Failed != 0 {
+				t.Errorf("got %d transferred, %d skipped, %d failed, want %d, %d, 0: %v",
+					result.Files, result.Skipped, result.Failed, tt.files, tt.skipped, result.Errors)
+			}
+			if got := readLocal(t, localDir, "a.txt"); got != tt.wantContent {
+				t.Errorf("local a.txt holds %q, want %q", got, tt.wantContent)
+			}
+		})
+	}
+}
+
+func TestPullSkipsWhatItTransferred(t *testing.T) {
+	remote := datasynctest.NewMemClient()
+	remote.WriteFile("/data/a.txt", []byte("remote"), remoteTime)
+	remote.WriteFile("/data/sub/b.txt", []byte("b"), remoteTime)
+	result, localDir := pull(t, remote)
+	if result.Files != 2 {
+		t.Fatalf("first sync transferred %d, want 2", result.Files)
+	}
+	result = pullInto(remote, localDir)
+	if result.Files != 0 || result.Skipped != 2 {
+		t.Errorf("second sync transferred %d and skipped %d, want 0 and 2", result.Files, result.Skipped)
+	}
+
+	// A remote file changed since is transferred again.
+	remote.WriteFile("/data/a.txt", []byte("changed"), time.Now().Add(time.Hour))
+	result = pullInto(remote, localDir)
+	if result.Files != 1 || result.Skipped != 1 {
+		t.Errorf("third sync transferred %d and skipped %d, want 1 and 1", result.Files, result.Skipped)
+	}
+	if got := readLocal(t, localDir, "a.txt"); got != "changed" {
+		t.Errorf("local a.txt holds %q, want %q", got, "changed")
+	}
+}
+
+func TestPullRecursesIntoDirectories(t *testing.T) {
+	remote := datasynctest.NewMemClient()
+	names := []string{"top.txt", "a/one.txt", "a/b/two.txt", "a/b/c/three.txt", "d/four.txt"}
+	for _, name := range names {
+		remote.WriteFile("/data/"+name, []byte(name), remoteTime)
+	}
+	result, localDir := pull(t, remote)
+	if result.Files != len(names) || result.Failed != 0 {
+		t.Fatalf("got %d transferred, %d failed, want %d, 0: %v", result.Files, result.Failed, len(names), result.Errors)
+	}
+	for _, name := range names {
+		if got := readLocal(t, localDir, name); got != name {
+			t.Errorf("local %s holds %q, want %q", name, got, name)
+		}
+	}
+	if result.Bytes != int64(len("top.txta/one.txta/b/two.txta/b/c/three.txtd/four.txt")) {
+		t.Errorf("got %d bytes", result.Bytes)
+	}
+}
+
+func TestPullCountsFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		op     string
+		path   string
+		files  int
+		failed int
+	}{
+		{name: "unreadable directory", op: "ReadDir", path: "/data/sub", files: 2, failed: 1},
+		{name: "unreadable root", op: "ReadDir", path: "/data", files: 0, failed: 1},
+		{name: "unreadable file", op: "Open", path: "/data/sub/b.txt", files: 2, failed: 1},
+		{name: "unstatable file", op: "Stat", path: "/data/a.txt", files: 2, failed: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := datasynctest.NewMemClient()
+			remote.WriteFile("/data/a.txt", []byte("a"), remoteTime)
+			remote.WriteFile("/data/c.txt", []byte("c"), remoteTime)
+			remote.WriteFile("/data/sub/b.txt", []byte("b"), remoteTime)
+			remote.Fail(tt.op, tt.path, errInjected)
+			result, _ := pull(t, remote)
+			if result.Files != tt.files || result.Failed != tt.failed {
+				t.Errorf("got %d transferred, %d failed, want %d, %d", result.Files, result.Failed, tt.files, tt.failed)
+			}
+			if !errors.Is(result.LastErr, errInjected) {
+				t.Errorf("LastErr is %v, want the injected failure", result.LastErr)
+			}
+		})
+	}
+}
+
+func readRemote(t *testing.T, remote *datasynctest.MemClient, name string) string {
+	t.Helper()
+	data, ok := remote.ReadFile(name)
+	if !ok {
+		t.Fatalf("remote has no %s", name)
+	}
+	return string(data)
+}
+
+func TestPushComparesModTimes(t *testing.T) {
+	tests := []struct {
+		name        string
+		remote      bool
+		local       localFile
+		files       int
+		skipped     int
+		wantContent string
+	}{
+		{name: "missing", local: localFile{"a.txt", "local!", remoteTime}, files: 1, wantContent: "local!"},
+		{name: "same modtime and size", remote: true, local: localFile{"a.txt", "local!", remoteTime}, skipped: 1, wantContent: "remote"},
+		{name: "newer modtime", remote: true, local: localFile{"a.txt", "local!", newerTime}, files: 1, wantContent: "local!"},
+		{name: "older modtime", remote: true, local: localFile{"a.txt", "local!", olderTime}, skipped: 1, wantContent: "remote"},
+		{name: "different size", remote: true, local: localFile{"a.txt", "local", remoteTime}, files: 1, wantContent: "local"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := datasynctest.NewMemClient()
+			if tt.remote {
+				remote.WriteFile("/data/a.txt", []byte("remote"), remoteTime)
+			}
+			result, _ := push(t, remote, tt.local)
+			if result.Files != tt.files || result.Skipped != tt.skipped || result.Failed != 0 {
+				t.Errorf("got %d transferred, %d skipped, %d failed, want %d, %d, 0: %v",
+					result.Files, result.Skipped, result.Failed, tt.files, tt.skipped, result.Errors)
+			}
+			if got := readRemote(t, remote, "/data/a.txt"); got != tt.wantContent {
+				t.Errorf("remote a.txt holds %q, want %q", got, tt.wantContent)
+			}
+		})
+	}
+}
+
+func TestPushRecursesIntoDirectories(t *testing.T) {
+	remote := datasynctest.NewMemClient()
+	names := []string{"top.txt", "a/one.txt", "a/b/two.txt", "a/b/c/three.txt", "d/four.txt"}
+	var files []localFile
+	for _, name := range names {
+		files = append(files, localFile{name, name, remoteTime})
+	}
+	result, localDir := push(t, remote, files...)
+	if result.Files != len(names) || result.Failed != 0 {
+		t.Fatalf("got %d transferred, %d failed, want %d, 0: %v", result.Files, result.Failed, len(names), result.Errors)
+	}
+	for _, name := range names {
+		if got := readRemote(t, remote, "/data/"+name); got != name {
+			t.Errorf("remote %s holds %q, want %q", name, got, name)
+		}
+	}
+
+	// What was uploaded is newer on the remote and left alone next time.
+	result = syncMem(remote, "push", localDir)
+	if result.Files != 0 || result.Skipped != len(names) {
+		t.Errorf("second sync transferred %d and skipped %d, want 0 and %d", result.Files, result.Skipped, len(names))
+	}
+}
+
+func TestPushCountsFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		op     string
+		path   string
+		files  int
+		failed int
+	}{
+		{name: "uncreatable file", op: "Create", path: "/data/sub/b.txt", files: 2, failed: 1},
+		{name: "uncreatable directory", op: "MkdirAll", path: "/data/sub", files: 2, failed: 1},
+		{name: "unstatable file", op: "Stat", path: "/data/a.txt", files: 2, failed: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := datasynctest.NewMemClient()
+			remote.Fail(tt.op, tt.path, errInjected)
+			result, _ := push(t, remote,
+				localFile{"a.txt", "a", remoteTime},
+				localFile{"c.txt", "c", remoteTime},
+				localFile{"sub/b.txt", "b", remoteTime})
+			if result.Files != tt.files || result.Failed != tt.failed {
+				t.Errorf("got %d transferred, %d failed, want %d, %d", result.Files, result.Failed, tt.files, tt.failed)
+			}
+			if !errors.Is(result.LastErr, errInjected) {
+				t.Errorf("LastErr is %v, want the injected failure", result.LastErr)
+			}
+		})
+	}
+}
+
+func TestMemClientCloses(t *testing.T) {
+	remote := datasynctest.NewMemClient()
+	remote.WriteFile("/data/a.txt", []byte("a"), remoteTime)
+	pull(t, remote)
+	if !remote.Closed() {
+		t.Error("the sync did not close its client")
+	}
+}
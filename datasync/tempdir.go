@@ -0,0 +1,96 @@
+package datasync
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// tempPrefix starts the names of the in-progress downloads in TempDir, so
+// stale ones can be told from other files there.
+const tempPrefix = "datasync-"
+
+// createPartFile creates the file a download of localFilePath is written
+// to until it completes: in TempDir when set, otherwise next to the
+// destination.
+func (r *syncRun) createPartFile(localFilePath string) (*os.File, error) {
+	if r.config.TempDir == "" {
+		return os.Create(localFilePath + ".part")
+	}
+	r.syncer.prepareTempDir(r.config.TempDir, r.dirMode(), r.logger)
+	return os.CreateTemp(r.config.TempDir, tempPrefix+filepath.Base(localFilePath)+"-*.part")
+}
+
+// prepareTempDir creates dir and removes the downloads interrupted there by
+// earlier runs, the first time a sync of this Syncer uses it. Holding the
+// lock while doing so keeps other syncs from starting downloads there
+// meanwhile.
+func (s *Syncer) prepareTempDir(dir string, mode os.FileMode, logger *log.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.preparedTempDirs[dir] {
+		return
+	}
+	if s.preparedTempDirs == nil {
+		s.preparedTempDirs = make(map[string]bool)
+	}
+	s.preparedTempDirs[dir] = true
+	if err := os.MkdirAll(dir, mode); err != nil {
+		logger.Println("Failed to create tempDir", dir, ":", err)
+		return
+	}
+
+	stale, _ := filepath.Glob(filepath.Join(dir, tempPrefix+"*.part"))
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			logger.Println("Failed to remove stale temp file", path, ":", err)
+			continue
+		}
+		logger.Println("Removed stale temp file", path)
+	}
+}
+
+// moveFile renames src to dst. When they are on different filesystems it
+// copies src next to dst first, so dst never holds a partial file, skipping
+// its zero blocks if sparse is set.
+func moveFile(src, dst string, sparse bool) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	tmp := dst + ".part"
+	if err := copyLocalFile(src, tmp, sparse); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyLocalFile(src, dst string, sparse bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if !sparse {
+		_, err = io.Copy(out, in)
+	} else {
+		w := newSparseWriter(out)
+		if _, err = io.Copy(w, in); err == nil {
+			err = w.finish()
+		}
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,167 @@
+package datasync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// BandwidthWindow limits transfers that start between From and To, given as
+// "15:04" in the local time zone. A window whose To is before its From
+// wraps past midnight.
+type BandwidthWindow struct {
+	From           string `json:"from"`
+	To             string `json:"to"`
+	MaxBytesPerSec int64  `json:"maxBytesPerSec"`
+}
+
+func (w BandwidthWindow) validate() error {
+	from, err := time.Parse("15:04", w.From)
+	if err != nil {
+		return fmt.Errorf("invalid from %q: want HH:MM", w.From)
+	}
+	to, err := time.Parse("15:04", w.To)
+	if err != nil {
+		return fmt.Errorf("invalid to %q: want HH:MM", w.To)
+	}
+	if from.Equal(to) {
+		return fmt.Errorf("from and to are both %s", w.From)
+	}
+	return nil
+}
+
+// contains reports whether the time of day of t lies in the window.
+func (w BandwidthWindow) contains(t time.Time) bool {
+	from, err1 := time.Parse("15:04", w.From)
+	to, err2 := time.Parse("15:04", w.To)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	start := from.Hour()*60 + from.Minute()
+	end := to.Hour()*60 + to.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// bandwidthLimit returns the bytes-per-second limit for a transfer starting
+// at now: that of the first matching schedule window, else MaxBytesPerSec.
+func (r *syncRun) bandwidthLimit(now time.Time) int64 {
+	for _, window := range r.config.BandwidthSchedule {
+		if window.contains(now) {
+			return window.MaxBytesPerSec
+		}
+	}
+	return r.config.MaxBytesPerSec
+}
+
+// transferOptions returns the copy options for a file transfer starting
+// now.
+func (r *syncRun) transferOptions() copyOptions {
+	opts := r.copyOptions()
+	opts.maxBytesPerSec = r.bandwidthLimit(time.Now())
+	opts.shared = r.syncer.sharedBandwidth()
+	return opts
+}
+
+// sharedBandwidth returns the limiter all transfers share to stay below
+// MaxBytesPerSec, or nil if it is unlimited.
+func (s *Syncer) sharedBandwidth() *rateLimiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bandwidth == nil && s.MaxBytesPerSec > 0 {
+		s.bandwidth = &rateLimiter{limit: s.MaxBytesPerSec}
+	}
+	return s.bandwidth
+}
+
+// throttledReader delays reads so that on average no more than limit bytes
+// per second pass through it.
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	limit int64
+	start time.Time
+	n     int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Read at most a second's worth at a time, so the rate stays smooth
+	// with large copy buffers.
+	if int64(len(p)) > t.limit {
+		p = p[:t.limit]
+	}
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+
+	due := t.start.Add(time.Duration(float64(t.n) / float64(t.limit) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// rateLimiter hands out a budget of limit bytes per second among any number
+// of concurrent transfers.
+type rateLimiter struct {
+	limit int64
+
+	mu sync.Mutex
+	// next is when the bytes handed out so far are paid for.
+	next time.Time
+}
+
+// wait accounts for n bytes and blocks until the rate allows them.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		// Unused budget is not saved up for later bursts.
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.limit) * float64(time.Second)))
+	wait := l.next.Sub(now)
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sharedThrottledReader delays reads to keep all readers of the limiter
+// below its combined limit.
+type sharedThrottledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (t *sharedThrottledReader) Read(p []byte) (int, error) {
+	// Small reads keep the transfers sharing the limit taking turns.
+	if max := min(t.limiter.limit, 64*1024); int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := t.r.Read(p)
+	if werr := t.limiter.wait(t.ctx, n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
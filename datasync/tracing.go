@@ -0,0 +1,299 @@
+package datasync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// With TracingEndpoint every sync run is exported as an OpenTelemetry
+// trace over OTLP/HTTP in its JSON encoding: a span for the run with a
+// child span for each source directory, itself the parent of its
+// subdirectories, and one for each transferred file. Errors are recorded
+// as exception events on the span of the directory they occurred in.
+// Spans are sent in batches of maxTraceBatch and once the run is done.
+
+// maxTraceBatch is how many finished spans are buffered before they are
+// sent.
+const maxTraceBatch = 512
+
+// traceExportTimeout bounds each request to the tracing endpoint.
+const traceExportTimeout = 10 * time.Second
+
+// OTLP status codes and span kind.
+const (
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+	otlpKindInternal = 1
+)
+
+// tracingServiceName is the service.name the spans are reported under.
+const tracingServiceName = "datasync"
+
+func (c Config) validateTracing() error {
+	if c.TracingEndpoint == "" {
+		return nil
+	}
+	if _, err := tracesURL(c.TracingEndpoint); err != nil {
+		return fmt.Errorf("invalid tracingEndpoint: %w", err)
+	}
+	return nil
+}
+
+// tracesURL returns the URL spans are posted to: endpoint itself when it
+// has a path, else its /v1/traces, as with OTEL_EXPORTER_OTLP_ENDPOINT.
+func tracesURL(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q, must be http or https", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s has no host", u.Redacted())
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u, nil
+}
+
+// tracer collects the spans of one run, including those of the workers of
+// a parallel date range.
+type tracer struct {
+	url string
+	// shown is url without its credentials, for log messages.
+	shown   string
+	traceID string
+	client  *http.Client
+
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+// span is a span in progress. A nil span, as returned without a tracer,
+// records nothing.
+type span struct {
+	otlpSpan
+	start time.Time
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Events       []otlpEvent    `json:"events,omitempty"`
+	Status       otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	Time       string         `json:"timeUnixNano"`
+	Name       string         `json:"name"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue holds one of the value types; int64 values are strings in the
+// JSON encoding.
+type otlpValue struct {
+	String *string `json:"stringValue,omitempty"`
+	Int    *string `json:"intValue,omitempty"`
+}
+
+func stringAttr(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{String: &value}}
+}
+
+func intAttr(key string, value int64) otlpKeyValue {
+	s := strconv.FormatInt(value, 10)
+	return otlpKeyValue{Key: key, Value: otlpValue{Int: &s}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func randomID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// newTracer returns the tracer of a run of config, or nil without a
+// TracingEndpoint.
+func newTracer(config Config) *tracer {
+	if config.TracingEndpoint == "" {
+		return nil
+	}
+	// validateTracing has checked the endpoint.
+	u, _ := tracesURL(config.TracingEndpoint)
+	return &tracer{url: u.String(), shown: u.Redacted(), traceID: randomID(16), client: &http.Client{Timeout: traceExportTimeout}}
+}
+
+// startSpan starts a span named name as a child of the current one.
+func (r *syncRun) startSpan(name string) *span {
+	if r.tracer == nil {
+		return nil
+	}
+	s := &span{start: time.Now()}
+	s.TraceID = r.tracer.traceID
+	s.SpanID = randomID(8)
+	s.Name = name
+	s.Kind = otlpKindInternal
+	s.Attributes = []otlpKeyValue{stringAttr("datasync.config", r.config.Key())}
+	if r.span != nil {
+		s.ParentSpanID = r.span.SpanID
+	}
+	return s
+}
+
+// endSpan finishes s with the given attributes, failed when err is not nil,
+// and queues it for export.
+func (r *syncRun) endSpan(s *span, err error, attrs ...otlpKeyValue) {
+	r.endSpanAt(s, time.Now(), err, attrs...)
+}
+
+func (r *syncRun) endSpanAt(s *span, end time.Time, err error, attrs ...otlpKeyValue) {
+	if s == nil {
+		return
+	}
+	s.Start, s.End = unixNano(s.start), unixNano(end)
+	result := "ok"
+	s.Status = otlpStatus{Code: otlpStatusOK}
+	if err != nil {
+		result = "error"
+		s.Status = otlpStatus{Code: otlpStatusError, Message: err.Error()}
+	}
+	s.Attributes = append(append(s.Attributes, attrs...), stringAttr("datasync.result", result))
+
+	t := r.tracer
+	t.mu.Lock()
+	t.spans = append(t.spans, s.otlpSpan)
+	var batch []otlpSpan
+	if len(t.spans) >= maxTraceBatch {
+		batch, t.spans = t.spans, nil
+	}
+	t.mu.Unlock()
+	if batch != nil {
+		r.exportSpans(batch)
+	}
+}
+
+// traceError records err, about path, on the current span.
+func (r *syncRun) traceError(path string, err error) {
+	if r.span == nil {
+		return
+	}
+	event := otlpEvent{Time: unixNano(time.Now()), Name: "exception", Attributes: []otlpKeyValue{stringAttr("exception.message", err.Error())}}
+	if path != "" {
+		event.Attributes = append(event.Attributes, stringAttr("datasync.path", path))
+	}
+	// The span of the run is shared by the workers of a date range.
+	r.tracer.mu.Lock()
+	r.span.Events = append(r.span.Events, event)
+	r.tracer.mu.Unlock()
+}
+
+// traceTransfer records a file transferred in elapsed, ending now.
+func (r *syncRun) traceTransfer(path string, bytes int64, elapsed time.Duration) {
+	s := r.startSpan("transfer")
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.start = now.Add(-elapsed)
+	r.endSpanAt(s, now, nil, stringAttr("datasync.path", path), intAttr("datasync.bytes", bytes),
+		stringAttr("datasync.direction", r.config.direction()))
+}
+
+// endDirSpan ends the span of dir, started with mark, and makes its parent
+// current again.
+func (r *syncRun) endDirSpan(dir string, mark dirMark) {
+	if mark.span == nil {
+		return
+	}
+	now := r.stats()
+	var err error
+	if failed := now.Failed - mark.stats.Failed; failed > 0 {
+		err = fmt.Errorf("%d errors", failed)
+	}
+	r.endSpan(mark.span, err, stringAttr("datasync.path", dir),
+		intAttr("datasync.files", int64(now.Files-mark.stats.Files)), intAttr("datasync.bytes", now.Bytes-mark.stats.Bytes))
+	r.span = mark.parentSpan
+}
+
+// flushTrace sends the spans still buffered.
+func (r *syncRun) flushTrace() {
+	if r.tracer == nil {
+		return
+	}
+	r.tracer.mu.Lock()
+	batch := r.tracer.spans
+	r.tracer.spans = nil
+	r.tracer.mu.Unlock()
+	if len(batch) > 0 {
+		r.exportSpans(batch)
+	}
+}
+
+// exportSpans posts spans to the tracing endpoint. A failure is only
+// logged, as the trace is not worth failing the sync for.
+func (r *syncRun) exportSpans(spans []otlpSpan) {
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpKeyValue{stringAttr("service.name", tracingServiceName)}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "data_sync/datasync"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err == nil {
+		err = r.tracer.post(body)
+	}
+	if err != nil {
+		r.warnln("Failed to export", len(spans), "trace spans to", r.tracer.shown, ":", err)
+	}
+}
+
+func (t *tracer) post(body []byte) error {
+	// The run's context may be cancelled already, and its spans are still
+	// worth sending.
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
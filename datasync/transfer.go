@@ -0,0 +1,200 @@
+package datasync
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+func (r *syncRun) downloadFile(ctx context.Context, localFilePath, remoteFilePath string, opts copyOptions) error {
+	started := time.Now()
+	remoteFile, err := r.client.Open(remoteFilePath)
+	if err != nil {
+		return err
+	}
+	defer remoteFile.Close()
+	var src io.Reader = remoteFile
+	if r.decrypts(remoteFilePath) {
+		if src, err = r.decryptFrom(remoteFile); err != nil {
+			return fmt.Errorf("unable to decrypt %s: %w", remoteFilePath, err)
+		}
+	}
+	if r.compressedRemote(remoteFilePath) {
+		if src, err = gzip.NewReader(remoteFile); err != nil {
+			return fmt.Errorf("unable to decompress %s: %w", remoteFilePath, err)
+		}
+	}
+
+	// Download to a part file and rename on success, so an interrupted
+	// transfer never leaves a truncated file under the real name.
+	localFile, err := r.createPartFile(localFilePath)
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+	partPath := localFile.Name()
+
+	var dst io.Writer = localFile
+	var sparse *sparseWriter
+	if r.config.PreserveSparse {
+		sparse = newSparseWriter(localFile)
+		dst = sparse
+	}
+	var n int64
+	if file, size, ok := r.chunks(remoteFile, remoteFilePath); ok {
+		r.debugf("%s: downloading in %d ranges", remoteFilePath, r.config.FileChunkConcurrency)
+		n, err = copyChunks(ctx, localFile, file, size, remoteFile, opts, r.config.FileChunkConcurrency)
+	} else {
+		n, err = copyFile(ctx, dst, src, remoteFile, opts)
+		if err == nil && src == io.Reader(remoteFile) {
+			err = r.checkPacketSize(remoteFile, remoteFilePath, n)
+		}
+	}
+	if err == nil && sparse != nil {
+		err = sparse.finish()
+	}
+	if err != nil {
+		localFile.Close()
+		os.Remove(partPath)
+		if errors.Is(err, context.DeadlineExceeded) {
+			r.errorln("Timed out downloading", remoteFilePath, "after", n, "bytes")
+		}
+		return err
+	}
+	if err := localFile.Close(); err != nil {
+		os.Remove(partPath)
+		return err
+	}
+	if err := r.verifyDownload(partPath, remoteFilePath); err != nil {
+		os.Remove(partPath)
+		return err
+	}
+	if r.config.VersionedPull {
+		if err := r.keepVersion(localFilePath); err != nil {
+			os.Remove(partPath)
+			return err
+		}
+	}
+	if err := moveFile(partPath, localFilePath, r.config.PreserveSparse); err != nil {
+		os.Remove(partPath)
+		return err
+	}
+
+	r.transferred(remoteFilePath, n, time.Since(started))
+	r.transferln("Downloaded", remoteFilePath, "to", localFilePath)
+	return nil
+}
+
+func (r *syncRun) uploadFile(ctx context.Context, localFilePath, remoteFilePath string, opts copyOptions) error {
+	if r.config.DeltaTransfer {
+		if done, err := r.uploadDelta(ctx, localFilePath, remoteFilePath); done {
+			return err
+		}
+	}
+
+	started := time.Now()
+	localFile, err := os.Open(localFilePath)
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+
+	remoteFile, err := r.client.Create(remoteFilePath)
+	if err != nil {
+		return err
+	}
+	defer remoteFile.Close()
+	var dst io.Writer = remoteFile
+	var encoder io.WriteCloser
+	switch {
+	case r.config.EncryptUploads:
+		encoder, err = r.encryptTo(remoteFile, localFilePath)
+	case r.config.StoreCompressed:
+		encoder, err = r.compressTo(remoteFile, localFilePath)
+	}
+	if err != nil {
+		remoteFile.Close()
+		r.client.Remove(remoteFilePath)
+		return err
+	}
+	if encoder != nil {
+		dst = encoder
+	}
+
+	n, err := copyFile(ctx, dst, localFile, remoteFile, opts)
+	if err == nil && encoder != nil {
+		err = encoder.Close()
+	}
+	if err != nil {
+		remoteFile.Close()
+		r.client.Remove(remoteFilePath)
+		if errors.Is(err, context.DeadlineExceeded) {
+			r.errorln("Timed out uploading", localFilePath, "after", n, "bytes")
+		}
+		return err
+	}
+
+	if err := remoteFile.Close(); err != nil {
+		r.client.Remove(remoteFilePath)
+		return err
+	}
+	if err := r.verifyUpload(localFilePath, remoteFilePath); err != nil {
+		// Removing the bad copy makes the next run upload the file again.
+		r.client.Remove(remoteFilePath)
+		return err
+	}
+
+	r.transferred(localFilePath, n, time.Since(started))
+	r.transferln("Uploaded", localFilePath, "to", remoteFilePath)
+	if r.config.DeltaTransfer {
+		r.recordBlockSums(localFilePath, remoteFilePath)
+	}
+	return nil
+}
+
+// copyOptions tune copyFile.
+type copyOptions struct {
+	// maxBytesPerSec throttles the copy when positive.
+	maxBytesPerSec int64
+	// shared, when set, throttles the copy along with every other transfer
+	// drawing from it.
+	shared *rateLimiter
+	// bufferSize is the size of the copy buffer used when neither side
+	// copies by itself. Zero means io.Copy's default of 32 KB.
+	bufferSize int
+}
+
+func (r *syncRun) copyOptions() copyOptions {
+	return copyOptions{bufferSize: r.config.BufferSize * 1024}
+}
+
+// copyFile copies src to dst until done or ctx is cancelled. Cancellation
+// closes the remote file, which aborts the in-flight SFTP requests without
+// giving up the pipelined WriteTo/ReadFrom implementations of *sftp.File
+// that io.CopyBuffer picks up, and which ignore the buffer.
+func copyFile(ctx context.Context, dst io.Writer, src io.Reader, remoteFile io.Closer, opts copyOptions) (int64, error) {
+	stop := context.AfterFunc(ctx, func() {
+		remoteFile.Close()
+	})
+	defer stop()
+
+	if opts.maxBytesPerSec > 0 {
+		src = &throttledReader{ctx: ctx, r: src, limit: opts.maxBytesPerSec, start: time.Now()}
+	}
+	if opts.shared != nil {
+		src = &sharedThrottledReader{ctx: ctx, r: src, limiter: opts.shared}
+	}
+	var buf []byte
+	if opts.bufferSize > 0 {
+		buf = make([]byte, opts.bufferSize)
+	}
+	n, err := io.CopyBuffer(dst, src, buf)
+	if ctx.Err() != nil {
+		return n, ctx.Err()
+	}
+	return n, err
+}
@@ -0,0 +1,117 @@
+package datasync
+
+import (
+	"fmt"
+	"sort"
+)
+
+// TraversalOrder "files-first" handles the files of a directory before
+// any of its subdirectories, and "breadth-first" handles a whole level of
+// the tree before the next one down, so the files nearest the top arrive
+// first. Either way the same files are transferred as in the default
+// listing order.
+
+func (c Config) validateTraversalOrder() error {
+	switch c.TraversalOrder {
+	case "", "default":
+		return nil
+	case "files-first", "breadth-first":
+	default:
+		return fmt.Errorf("invalid traversalOrder: %s", c.TraversalOrder)
+	}
+	if c.archiveMode() != "" {
+		return fmt.Errorf("traversalOrder is not supported with archiveMode")
+	}
+	return nil
+}
+
+// pendingDir is a subdirectory a breadth-first traversal syncs once the
+// levels above it are done, with the ignore rules and trace span in effect
+// where it was found.
+type pendingDir struct {
+	localDir, remoteDir string
+	depth               int
+	ignores             []ignoreRules
+	span                *span
+}
+
+// IsDir lets deferEntries count the directories left in the queue.
+func (pendingDir) IsDir() bool { return true }
+
+// orderEntries puts the files of a directory listing before its
+// subdirectories for TraversalOrder "files-first".
+func orderEntries[E interface{ IsDir() bool }](r *syncRun, entries []E) {
+	if r.config.TraversalOrder != "files-first" {
+		return
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return !entries[i].IsDir() && entries[j].IsDir() })
+}
+
+func (r *syncRun) breadthFirst() bool {
+	return r.config.TraversalOrder == "breadth-first"
+}
+
+// queueDir puts off syncing the subdirectory localDir and remoteDir at
+// depth until traverse gets to it.
+func (r *syncRun) queueDir(localDir, remoteDir string, depth int) {
+	r.queued = append(r.queued, pendingDir{
+		localDir: localDir, remoteDir: remoteDir, depth: depth,
+		ignores: append([]ignoreRules(nil), r.ignores...),
+		span:    r.span,
+	})
+}
+
+// traverse syncs the tree of a directory pair with syncDir, which is
+// pullData, pushData or relayData, and then for "breadth-first" the
+// directories queued meanwhile, level by level. failure starts the error
+// logged for a subdirectory that failed, and with removeEmpty the source
+// directories that synced are removed once empty, the deepest first, as a
+// depth-first traversal removes them after each.
+func (r *syncRun) traverse(syncDir func(localDir, remoteDir string, depth int) error, localDir, remoteDir, failure string, removeEmpty bool) error {
+	err := syncDir(localDir, remoteDir, 0)
+	if !r.breadthFirst() {
+		return err
+	}
+	ignores, span := r.ignores, r.span
+	defer func() {
+		r.queued = nil
+		r.ignores, r.span = ignores, span
+	}()
+	if err != nil {
+		return err
+	}
+
+	var synced []pendingDir
+	for len(r.queued) > 0 {
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+		if r.limitReached() {
+			deferEntries(r, r.queued)
+			return nil
+		}
+		dir := r.queued[0]
+		r.queued = r.queued[1:]
+		r.ignores, r.span = dir.ignores, dir.span
+		if err := syncDir(dir.localDir, dir.remoteDir, dir.depth); err != nil {
+			src := dir.localDir
+			if r.srcRemote() {
+				src = dir.remoteDir
+			}
+			r.errorln(failure, src, ":", err)
+			if r.config.AbortOnError {
+				return err
+			}
+			continue
+		}
+		synced = append(synced, dir)
+	}
+	for i := len(synced) - 1; removeEmpty && i >= 0; i-- {
+		if r.srcRemote() {
+			r.removeEmptyRemoteDir(synced[i].remoteDir)
+		} else {
+			r.removeEmptyLocalDir(synced[i].localDir)
+		}
+	}
+	return nil
+}
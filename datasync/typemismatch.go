@@ -0,0 +1,128 @@
+package datasync
+
+import (
+	"fmt"
+	"os"
+)
+
+// A destination entry can be a file where the source has a directory of
+// the same name, or the other way round. TypeMismatchPolicy decides what
+// a sync does about it: "error", the default, fails the source entry with
+// a message naming both sides, "skip" leaves it out with a warning, and
+// "replace" removes the destination entry, with everything below it for a
+// directory, so that the source entry is synced in its place.
+
+func (c Config) typeMismatchPolicy() string {
+	if c.TypeMismatchPolicy == "" {
+		return "error"
+	}
+	return c.TypeMismatchPolicy
+}
+
+// destClient is the Client of the side files are synced to, and destSide
+// what the log messages call it.
+func (r *syncRun) destClient() Client {
+	switch r.config.direction() {
+	case "pull":
+		return localClient{}
+	case "relay":
+		return r.dest
+	}
+	return r.client
+}
+
+func (r *syncRun) destSide() string {
+	switch r.config.direction() {
+	case "pull":
+		return "local"
+	case "relay":
+		return "destination"
+	}
+	return "remote"
+}
+
+func kindOf(info os.FileInfo) string {
+	if info.IsDir() {
+		return "directory"
+	}
+	return "file"
+}
+
+// resolveTypeMismatch handles dst, the destination of src, being what
+// dstInfo describes and not of the type of src. It reports whether src is
+// to be synced, dst having been removed or, in a dry run, being due to be.
+// A failure is logged, counted and returned.
+func (r *syncRun) resolveTypeMismatch(src, dst string, dstInfo os.FileInfo) (bool, error) {
+	want := "directory"
+	if dstInfo.IsDir() {
+		want = "file"
+	}
+	switch r.config.typeMismatchPolicy() {
+	case "skip":
+		r.warnln("Skipping", src, ":", dst, "is a", kindOf(dstInfo), "but the source is a", want)
+		r.skip(src, "type mismatch")
+		return false, nil
+	case "replace":
+		// Like removals by retention, the replaced entry is planned by a
+		// dry run, and left alone by Apply unless its plan has it.
+		planned := dstInfo
+		if dstInfo.IsDir() {
+			planned = nil
+		}
+		if r.dryRun() {
+			r.infoln("Would replace", kindOf(dstInfo), dst, "with a", want)
+			r.planRemoval(dst, "type mismatch", planned)
+			return true, nil
+		}
+		if r.offPlan(dst, planned, true) {
+			return false, nil
+		}
+		r.warnln("Replacing", kindOf(dstInfo), dst, "with a", want, "as", src, "is one")
+		var err error
+		if dstInfo.IsDir() {
+			err = removeRemoteAll(r.destClient(), dst)
+		} else {
+			err = r.destClient().Remove(dst)
+		}
+		if err != nil {
+			r.errorln("Failed to remove", dst, ":", err)
+			r.fail(dst, err)
+			return false, err
+		}
+		return true, nil
+	}
+	err := fmt.Errorf("%s is a %s but the source is a %s (typeMismatchPolicy error)", dst, kindOf(dstInfo), want)
+	r.errorln("Failed to sync", src, ":", err)
+	r.fail(src, err)
+	return false, err
+}
+
+// createDestDir creates dst, the destination of the source directory src,
+// with mkdir, and reports whether src is to be synced into it. A file in
+// the way is handled by resolveTypeMismatch, which a dry run only checks
+// for, not descending into the directory it would replace. Other failures
+// are logged, counted and returned.
+func (r *syncRun) createDestDir(src, dst string, mkdir func() error) (bool, error) {
+	if r.dryRun() {
+		if info, err := r.destClient().Stat(dst); err == nil && !info.IsDir() {
+			_, err := r.resolveTypeMismatch(src, dst, info)
+			return false, err
+		}
+		return true, nil
+	}
+	err := r.retryOnDisconnect(mkdir)
+	if err == nil {
+		return true, nil
+	}
+	if info, statErr := r.destClient().Stat(dst); statErr == nil && !info.IsDir() {
+		if ok, err := r.resolveTypeMismatch(src, dst, info); !ok {
+			return false, err
+		}
+		if err = r.retryOnDisconnect(mkdir); err == nil {
+			return true, nil
+		}
+	}
+	r.errorln("Failed to create", r.destSide(), "directory", dst, ":", err)
+	r.fail(dst, err)
+	return false, err
+}
@@ -0,0 +1,71 @@
+package datasync_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"data_sync/datasync"
+	"data_sync/datasync/datasynctest"
+)
+
+// TestApplyReplacesOnlyPlannedEntries pushes a file over a remote directory
+// of the same name with typeMismatchPolicy replace, through a plan.
+func TestApplyReplacesOnlyPlannedEntries(t *testing.T) {
+	tests := []struct {
+		name        string
+		keepRemoval bool
+		replaced    bool
+	}{
+		{name: "removal planned", keepRemoval: true, replaced: true},
+		{name: "removal left out", keepRemoval: false, replaced: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(localDir, "a"), []byte("file"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			remote := datasynctest.NewMemClient()
+			remote.WriteFile("/data/a/inside.txt", []byte("kept?"), remoteTime)
+			connect := func(context.Context, datasync.Config) (datasync.Client, error) {
+				return remote, nil
+			}
+			syncer := &datasync.Syncer{Connect: connect}
+			config := datasync.Config{Name: "test", SSHHost: "memory", Action: "push", LocalDir: localDir, RemoteDir: "/data", TypeMismatchPolicy: "replace"}
+
+			dry := &datasync.Syncer{Connect: connect, DryRun: true}
+			plan, err := dry.Sync(context.Background(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ops []datasync.PlannedOp
+			var removal bool
+			for _, op := range plan.Planned {
+				if op.Action == "remove" {
+					removal = op.Source == "/data/a" && op.Reason == "type mismatch"
+					if !tt.keepRemoval {
+						continue
+					}
+				}
+				ops = append(ops, op)
+			}
+			if !removal {
+				t.Fatalf("the dry run planned %+v, want the removal of /data/a", plan.Planned)
+			}
+
+			if _, err := syncer.Apply(context.Background(), config, ops); err != nil {
+				t.Fatal(err)
+			}
+			_, kept := remote.ReadFile("/data/a/inside.txt")
+			data, uploaded := remote.ReadFile("/data/a")
+			if tt.replaced && (kept || !uploaded || string(data) != "file") {
+				t.Errorf("the remote directory was not replaced by the file")
+			}
+			if !tt.replaced && (!kept || uploaded) {
+				t.Errorf("the remote directory was replaced without its removal in the plan")
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package datasync
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// On a busy source, files and directories disappear between being listed
+// and being transferred. Like rsync, a sync treats those as vanished rather
+// than failed: each is logged, counted in Result.Vanished and left out.
+// Files that appear in the meantime are picked up by the next run.
+
+// vanishedFrom reports whether err, from reading the source path, means that
+// it is gone, and if so counts it as vanished. The source is looked up again,
+// on the remote side when remote is true, so that errors about a missing
+// destination still fail the file.
+func (r *syncRun) vanishedFrom(path string, remote bool, err error) bool {
+	if !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	if remote {
+		_, err = r.client.Stat(path)
+	} else {
+		_, err = os.Stat(path)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	r.infoln("Skipping", path, ": vanished from the source during the sync")
+	r.vanished++
+	r.events().OnFileSkipped(path, "vanished")
+	return true
+}
@@ -0,0 +1,120 @@
+package datasync
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// With VerifyAfterPush every transferred file is stat'ed again once its
+// transfer reported success, and the transfer fails unless both copies have
+// the same size, and with VerifyChecksum the same SHA-256. This catches
+// servers that accept a write and then drop it, e.g. over quota. Encrypted
+// copies differ in size from the plain ones, so their sizes are not
+// compared.
+
+func (c Config) validateVerify() error {
+	if c.VerifyChecksum && !c.VerifyAfterPush {
+		return fmt.Errorf("verifyChecksum requires verifyAfterPush")
+	}
+	if c.VerifyAfterPush && c.direction() == "relay" {
+		return fmt.Errorf("verifyAfterPush is not supported for action relay")
+	}
+	if c.VerifyChecksum && (c.EncryptUploads || c.DecryptionKeyPath != "") {
+		return fmt.Errorf("verifyChecksum cannot compare encrypted files")
+	}
+	return nil
+}
+
+// Verify compares the source and destination directories of a pull or
+// push config as Diff does, except that a file on both sides differs only
+// when the copies differ in size, or with checksum in SHA-256, whatever
+// compareMode and conflictPolicy say. The sizes of encrypted or compressed
+// copies are not compared.
+func (s *Syncer) Verify(ctx context.Context, config Config, checksum bool) ([]PairDiff, error) {
+	if checksum && (config.EncryptUploads || config.DecryptionKeyPath != "") {
+		return nil, fmt.Errorf("verify cannot compare the checksums of encrypted files")
+	}
+	return s.compareTrees(ctx, config, "verify", func(r *syncRun, srcPath, destPath string, srcInfo, destInfo os.FileInfo) bool {
+		return r.copiesDiffer(srcPath, destPath, srcInfo, destInfo, checksum)
+	})
+}
+
+// copiesDiffer reports whether the destination copy of a file differs from
+// the source, setting r.reason to how.
+func (r *syncRun) copiesDiffer(srcPath, destPath string, srcInfo, destInfo os.FileInfo, checksum bool) bool {
+	r.reason = ""
+	if !r.resized(srcPath) && srcInfo.Size() != destInfo.Size() {
+		r.reason = fmt.Sprintf("size differs: source %d bytes, destination %d bytes", srcInfo.Size(), destInfo.Size())
+		return true
+	}
+	if !checksum {
+		return false
+	}
+	localPath, remotePath := destPath, srcPath
+	if r.config.direction() == "push" {
+		localPath, remotePath = srcPath, destPath
+	}
+	localSum, err := fileSHA256(localPath)
+	if err != nil {
+		r.reason = fmt.Sprintf("local copy cannot be hashed: %v", err)
+		return true
+	}
+	remoteSum, err := r.hashRemoteContent(remotePath)
+	if err != nil {
+		r.reason = fmt.Sprintf("remote copy cannot be hashed: %v", err)
+		return true
+	}
+	if localSum != remoteSum {
+		r.reason = "checksum differs"
+		return true
+	}
+	return false
+}
+
+// verifyUpload checks the remote copy of a file just uploaded.
+func (r *syncRun) verifyUpload(localFilePath, remoteFilePath string) error {
+	if !r.config.VerifyAfterPush {
+		return nil
+	}
+	return r.verifyCopy(localFilePath, remoteFilePath, !r.resized(localFilePath))
+}
+
+// verifyDownload checks the part file a download of remoteFilePath was
+// just written to.
+func (r *syncRun) verifyDownload(partPath, remoteFilePath string) error {
+	if !r.config.VerifyAfterPush {
+		return nil
+	}
+	return r.verifyCopy(partPath, remoteFilePath, !r.resized(remoteFilePath))
+}
+
+func (r *syncRun) verifyCopy(localFilePath, remoteFilePath string, compareSize bool) error {
+	localInfo, err := os.Stat(localFilePath)
+	if err != nil {
+		return fmt.Errorf("unable to verify local copy: %w", err)
+	}
+	remoteInfo, err := r.client.Stat(remoteFilePath)
+	if err != nil {
+		return fmt.Errorf("unable to verify remote copy: %w", err)
+	}
+	if compareSize && localInfo.Size() != remoteInfo.Size() {
+		return fmt.Errorf("verification failed: %s is %d bytes locally and %d bytes on the server",
+			remoteFilePath, localInfo.Size(), remoteInfo.Size())
+	}
+	if !r.config.VerifyChecksum {
+		return nil
+	}
+	localSum, err := fileSHA256(localFilePath)
+	if err != nil {
+		return fmt.Errorf("unable to verify local copy: %w", err)
+	}
+	remoteSum, err := r.hashRemoteContent(remoteFilePath)
+	if err != nil {
+		return fmt.Errorf("unable to verify remote copy: %w", err)
+	}
+	if localSum != remoteSum {
+		return fmt.Errorf("verification failed: the SHA-256 of %s differs from the server's", remoteFilePath)
+	}
+	return nil
+}
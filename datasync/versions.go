@@ -0,0 +1,122 @@
+package datasync
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// With VersionedPull, a pull that replaces a local file keeps the replaced
+// one next to it as name.YYYYMMDDHHMMSS.ext, stamped with its modification
+// time, so the local directory holds a history of each file. MaxVersions
+// removes the oldest versions of a file beyond that many.
+
+// versionLayout is the timestamp in the names of kept versions.
+const versionLayout = "20060102150405"
+
+func (c Config) validateVersions() error {
+	if c.MaxVersions < 0 {
+		return fmt.Errorf("maxVersions must not be negative")
+	}
+	if !c.VersionedPull {
+		if c.MaxVersions > 0 {
+			return fmt.Errorf("maxVersions requires versionedPull")
+		}
+		return nil
+	}
+	if c.direction() != "pull" || c.archiveMode() != "" {
+		return fmt.Errorf("versionedPull requires action pull or move-pull without archiveMode")
+	}
+	if c.NoClobber {
+		return fmt.Errorf("versionedPull conflicts with noClobber, which never replaces local files")
+	}
+	return nil
+}
+
+// versionName splits the name of path into the parts before and after the
+// timestamp of its versions: "report" and ".csv" for report.csv.
+func versionName(path string) (prefix, ext string) {
+	name := filepath.Base(path)
+	ext = filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + ".", ext
+}
+
+// keepVersion keeps the local file at path, about to be replaced by a
+// download, as a version of it. The file is linked, or copied where links
+// are not supported, so that it stays in place should the download fail.
+func (r *syncRun) keepVersion(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	prefix, ext := versionName(path)
+	version := filepath.Join(filepath.Dir(path), prefix+info.ModTime().Format(versionLayout)+ext)
+	if _, err := os.Lstat(version); err == nil {
+		// A version with the same modification time is kept already.
+		r.debugf("%s: version %s exists already", path, filepath.Base(version))
+		return nil
+	}
+	if err := os.Link(path, version); err != nil {
+		if err := copyLocalFile(path, version, r.config.PreserveSparse); err != nil {
+			os.Remove(version)
+			return fmt.Errorf("unable to keep the previous version of %s: %w", path, err)
+		}
+		os.Chtimes(version, info.ModTime(), info.ModTime())
+	}
+	r.infoln("Kept previous version of", path, "as", filepath.Base(version))
+	r.pruneVersions(path)
+	return nil
+}
+
+// pruneVersions removes the oldest versions of path beyond MaxVersions.
+func (r *syncRun) pruneVersions(path string) {
+	if r.config.MaxVersions == 0 {
+		return
+	}
+	dir := filepath.Dir(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		r.warnln("Failed to list the versions of", path, ":", err)
+		return
+	}
+	prefix, ext := versionName(path)
+	var versions []string
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(name, prefix)
+		if stamp, ok = strings.CutSuffix(stamp, ext); ok && entry.Type().IsRegular() && isVersionStamp(stamp) {
+			versions = append(versions, name)
+		}
+	}
+	// The timestamps sort like the names.
+	sort.Strings(versions)
+	for _, name := range versions[:max(len(versions)-r.config.MaxVersions, 0)] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			r.warnln("Failed to remove old version", filepath.Join(dir, name), ":", err)
+			continue
+		}
+		r.infoln("Removed old version", filepath.Join(dir, name), "beyond maxVersions", r.config.MaxVersions)
+	}
+}
+
+func isVersionStamp(s string) bool {
+	if len(s) != len(versionLayout) {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package datasync
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// dirLister lists a remote tree ahead of pullData with up to
+// WalkConcurrency ReadDir calls in flight. pullData still visits the
+// directories one by one, in the usual order, and takes each listing from
+// the lister once it arrives, so only the round trips overlap.
+type dirLister struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	client   Client
+	maxDepth int
+	// visits reports whether a subdirectory is walked at all.
+	visits func(dir string) bool
+	slots  chan struct{}
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	listings map[string]*listing
+}
+
+type listing struct {
+	done  chan struct{}
+	infos []os.FileInfo
+	err   error
+}
+
+func (r *syncRun) walkConcurrency() int {
+	switch r.config.protocol() {
+	case "ftp", "ftps":
+		// One FTP connection runs a single command at a time.
+		return 1
+	}
+	return r.config.WalkConcurrency
+}
+
+// startLister starts listing the tree below remoteDir, unless concurrent
+// listing is off, and returns the function stopping it.
+func (r *syncRun) startLister(remoteDir string) func() {
+	if r.walkConcurrency() <= 1 || r.lister != nil || r.tree != nil {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(r.ctx)
+	l := &dirLister{
+		ctx:      ctx,
+		cancel:   cancel,
+		client:   r.client,
+		maxDepth: r.config.MaxDepth,
+		visits: func(dir string) bool {
+			return r.inOnly(dir, true)
+		},
+		slots:    make(chan struct{}, r.walkConcurrency()),
+		listings: make(map[string]*listing),
+	}
+	r.lister = l
+	l.list(remoteDir, 0)
+	return func() {
+		r.lister = nil
+		l.stop()
+	}
+}
+
+// readRemoteDir lists a remote directory, from the tree of RecursiveList
+// or through the lister when one runs.
+func (r *syncRun) readRemoteDir(dir string) ([]os.FileInfo, error) {
+	if entry, ok := r.takeTreeDir(dir); ok {
+		return entry.infos, entry.err
+	}
+	if r.lister != nil {
+		if infos, err, ok := r.lister.take(dir); ok {
+			return infos, err
+		}
+	}
+	return r.client.ReadDir(dir)
+}
+
+func (l *dirLister) list(dir string, depth int) {
+	entry := &listing{done: make(chan struct{})}
+	l.mu.Lock()
+	l.listings[dir] = entry
+	l.mu.Unlock()
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		defer close(entry.done)
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.ctx.Done():
+			entry.err = l.ctx.Err()
+			return
+		}
+		entry.infos, entry.err = l.client.ReadDir(dir)
+		<-l.slots
+		if entry.err != nil || (l.maxDepth > 0 && depth+1 > l.maxDepth) {
+			return
+		}
+		for _, info := range entry.infos {
+			if sub := remoteJoin(dir, info.Name()); info.IsDir() && l.visits(sub) {
+				l.list(sub, depth+1)
+			}
+		}
+	}()
+}
+
+// take waits for the listing of dir and hands it over. ok is false when
+// the lister was not asked to list dir.
+func (l *dirLister) take(dir string) (infos []os.FileInfo, err error, ok bool) {
+	l.mu.Lock()
+	entry, ok := l.listings[dir]
+	delete(l.listings, dir)
+	l.mu.Unlock()
+	if !ok {
+		return nil, nil, false
+	}
+	<-entry.done
+	return entry.infos, entry.err, true
+}
+
+func (l *dirLister) stop() {
+	l.cancel()
+	l.wg.Wait()
+}
@@ -0,0 +1,62 @@
+package datasync
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+)
+
+// WatchLocal asks the service to push local files shortly after they change
+// instead of waiting for the schedule, which keeps running full syncs as a
+// safety net. The watching itself is up to the caller, which hands the
+// settled paths to SyncFiles.
+
+func (c Config) validateWatch() error {
+	if c.WatchDelay < 0 {
+		return fmt.Errorf("watchDelay must not be negative")
+	}
+	if !c.WatchLocal {
+		return nil
+	}
+	if c.direction() != "push" {
+		return fmt.Errorf("watchLocal requires action push or move-push")
+	}
+	if c.archiveMode() != "" {
+		return fmt.Errorf("watchLocal is not supported with archiveMode")
+	}
+	return nil
+}
+
+// SyncFiles pushes only the given local files and directories, each with
+// everything inside it, as a Sync limited to them by Only would. Paths
+// outside the config's local directories are ignored. Retention and
+// SourceRetention are left to the full syncs.
+func (s *Syncer) SyncFiles(ctx context.Context, config Config, paths []string) (Result, error) {
+	if config.direction() != "push" {
+		return Result{}, fmt.Errorf("SyncFiles requires action push or move-push")
+	}
+	changed := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if abs, err := filepath.Abs(path); err == nil {
+			changed = append(changed, abs)
+		}
+	}
+	return s.sync(ctx, config, "", "", changed, nil)
+}
+
+// selectChanged sets only to the changed paths below the current pair and
+// reports whether there are any.
+func (r *syncRun) selectChanged() bool {
+	r.only = r.only[:0]
+	localDir, err := filepath.Abs(r.config.LocalDir)
+	if err != nil {
+		return false
+	}
+	for _, path := range r.changed {
+		rel, err := filepath.Rel(localDir, path)
+		if err == nil && rel != "." && filepath.IsLocal(rel) {
+			r.only = append(r.only, rel)
+		}
+	}
+	return len(r.only) > 0
+}
@@ -0,0 +1,18 @@
+package datasync
+
+// preserveXattrs copies the extended attributes of the source file src to
+// its copy dst. Only protocol local can, since SFTP does not carry them.
+// Where the platform or filesystem has none, that is only logged at debug
+// level.
+func (r *syncRun) preserveXattrs(src, dst string) {
+	if !r.config.PreserveXattrs {
+		return
+	}
+	if err := copyXattrs(src, dst); err != nil {
+		if isXattrUnsupported(err) {
+			r.debugf("%s: extended attributes not copied: %v", src, err)
+			return
+		}
+		r.warnln("Failed to copy the extended attributes of", src, ":", err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package datasync
+
+import "errors"
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+func copyXattrs(src, dst string) error {
+	return errXattrUnsupported
+}
+
+func isXattrUnsupported(err error) bool {
+	return errors.Is(err, errXattrUnsupported)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"data_sync/datasync"
+)
+
+// Exit codes of the one-shot sync, the date range sync and the test
+// command. The flag package exits with exitUsage on its own.
+const (
+	exitOK         = 0
+	exitError      = 1
+	exitUsage      = 2
+	exitConfig     = 3
+	exitConnection = 4
+	exitFailed     = 5
+)
+
+// exitRank orders the exit codes by which one a run with several failing
+// configs reports.
+var exitRank = map[int]int{
+	exitOK:         0,
+	exitFailed:     1,
+	exitConnection: 2,
+	exitConfig:     3,
+	exitUsage:      4,
+	exitError:      5,
+}
+
+// worseExit returns whichever of the exit codes a and b takes precedence.
+func worseExit(a, b int) int {
+	if exitRank[b] > exitRank[a] {
+		return b
+	}
+	return a
+}
+
+// syncExitCode returns the exit code for a sync that ended with result
+// and err.
+func syncExitCode(result datasync.Result, err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var connErr *datasync.ConnectError
+	if errors.As(err, &connErr) {
+		return exitConnection
+	}
+	for _, err := range result.Errors {
+		if errors.As(err, &connErr) {
+			return exitConnection
+		}
+	}
+	return exitFailed
+}
+
+// fatal logs v and exits with code.
+func fatal(code int, v ...any) {
+	log.Print(v...)
+	os.Exit(code)
+}
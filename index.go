@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"data_sync/datasync"
+)
+
+// indexFile is the JSON form of the index command.
+type indexFile struct {
+	Created time.Time     `json:"created"`
+	Configs []configIndex `json:"configs"`
+}
+
+type configIndex struct {
+	Config string               `json:"config"`
+	Pairs  []datasync.PairIndex `json:"pairs"`
+	Files  int                  `json:"files"`
+	Bytes  int64                `json:"bytes"`
+	Error  string               `json:"error,omitempty"`
+}
+
+// indexConfigs writes the remote files of the configs named names, or all
+// of them, to output, or to w when it is empty, as JSON or CSV.
+func indexConfigs(ctx context.Context, w io.Writer, names []string, format, output string) int {
+	if format != "json" && format != "csv" {
+		log.Println("Invalid -format", format, ": must be json or csv")
+		return exitUsage
+	}
+	selected, err := selectConfigs(names)
+	if err != nil {
+		log.Println(err)
+		return exitConfig
+	}
+
+	index := indexFile{Created: time.Now(), Configs: []configIndex{}}
+	exitCode := exitOK
+	for _, config := range selected {
+		if ctx.Err() != nil {
+			log.Println("Index interrupted")
+			return exitError
+		}
+		if config.Disabled() && len(names) == 0 {
+			log.Println("Skipping disabled config", config.Key())
+			continue
+		}
+		pairs, err := syncer.Index(ctx, config)
+		entry := configIndex{Config: config.Key(), Pairs: pairs}
+		if err != nil {
+			log.Println(red(fmt.Sprint("Index failed for ", config.Key(), " : ", err)))
+			entry.Error = err.Error()
+			exitCode = worseExit(exitCode, syncExitCode(datasync.Result{}, err))
+		}
+		if entry.Pairs == nil {
+			entry.Pairs = []datasync.PairIndex{}
+		}
+		for _, pair := range entry.Pairs {
+			entry.Files += len(pair.Files)
+			entry.Bytes += pair.Bytes
+		}
+		log.Printf("Indexed %s: %d files, %d bytes", config.Key(), entry.Files, entry.Bytes)
+		index.Configs = append(index.Configs, entry)
+	}
+
+	var buf bytes.Buffer
+	if format == "csv" {
+		err = index.writeCSV(&buf)
+	} else {
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(index)
+	}
+	if err == nil && output != "" {
+		err = os.WriteFile(output, buf.Bytes(), 0644)
+	} else if err == nil {
+		_, err = w.Write(buf.Bytes())
+	}
+	if err != nil {
+		log.Println("Failed to write the index:", err)
+		return exitError
+	}
+	if output != "" {
+		log.Println("Wrote the index to", output)
+	}
+	return exitCode
+}
+
+// writeCSV writes one line per file, after a header line.
+func (index indexFile) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"config", "remoteDir", "path", "remotePath", "size", "modTime"})
+	for _, config := range index.Configs {
+		for _, pair := range config.Pairs {
+			for _, file := range pair.Files {
+				cw.Write([]string{config.Config, pair.RemoteDir, file.Path, pair.RemotePath(file),
+					strconv.FormatInt(file.Size, 10), file.ModTime.UTC().Format(time.RFC3339)})
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
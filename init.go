@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"data_sync/datasync"
+
+	"github.com/robfig/cron/v3"
+	"golang.org/x/term"
+)
+
+// initConfig is the part of a config the init wizard asks for. Fields left
+// empty are not written, so the file stays as short as a hand-written one.
+type initConfig struct {
+	Name           string `json:"name,omitempty"`
+	SSHHost        string `json:"sshHost"`
+	SSHPort        int    `json:"sshPort"`
+	User           string `json:"user"`
+	Password       string `json:"password,omitempty"`
+	PrivateKeyPath string `json:"privateKeyPath,omitempty"`
+	LocalDir       string `json:"localDir"`
+	RemoteDir      string `json:"remoteDir"`
+	Action         string `json:"action"`
+	Cron           string `json:"cron"`
+}
+
+func (c initConfig) config() datasync.Config {
+	return datasync.Config{
+		Name:           c.Name,
+		SSHHost:        c.SSHHost,
+		SSHPort:        c.SSHPort,
+		User:           c.User,
+		Password:       c.Password,
+		PrivateKeyPath: c.PrivateKeyPath,
+		LocalDir:       c.LocalDir,
+		RemoteDir:      c.RemoteDir,
+		Action:         c.Action,
+		Cron:           c.Cron,
+	}
+}
+
+// connectionTestTimeout bounds the optional connection test of the wizard.
+const connectionTestTimeout = 30 * time.Second
+
+// runInit asks for one or more configs on stdin and writes them to path.
+func runInit(path string, args []string) error {
+	initCmd := flag.NewFlagSet("init", flag.ExitOnError)
+	force := initCmd.Bool("force", false, "Overwrite an existing config file")
+	initCmd.Parse(args)
+	if _, err := os.Stat(path); err == nil && !*force {
+		return fmt.Errorf("config file %s already exists, pass -force to overwrite it", path)
+	}
+
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	fmt.Fprintf(p.out, "Creating %s. Press Enter to accept the value in brackets.\n", path)
+	var cfgs []initConfig
+	for {
+		fmt.Fprintf(p.out, "\nConfig %d\n", len(cfgs)+1)
+		config, err := p.askConfig()
+		if err != nil {
+			return err
+		}
+		cfgs = append(cfgs, config)
+		another, err := p.confirm("Add another config?", false)
+		if err != nil {
+			return err
+		}
+		if !another {
+			break
+		}
+	}
+
+	if err := writeInitConfig(path, cfgs); err != nil {
+		return err
+	}
+	fmt.Fprintln(p.out, "\nWrote", path)
+	return nil
+}
+
+// writeInitConfig writes cfgs to path through a temporary file, which is
+// loaded like the real config first so that a file failing to load is
+// never left behind.
+func writeInitConfig(path string, cfgs []initConfig) error {
+	data, err := json.MarshalIndent(struct {
+		Configs []initConfig `json:"configs"`
+	}{cfgs}, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	// CreateTemp makes the file readable by its owner only, which suits a
+	// file holding passwords.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if _, err := loadConfig(tmp.Name()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// askConfig asks for a single config, and repeats the questions until the
+// config validates and, when tested, connects or is kept anyway.
+func (p *prompter) askConfig() (initConfig, error) {
+	for {
+		config, err := p.askFields()
+		if err != nil {
+			return initConfig{}, err
+		}
+		if err := config.config().Validate(); err != nil {
+			fmt.Fprintln(p.out, "Invalid config:", err)
+			continue
+		}
+
+		test, err := p.confirm("Test the connection now?", true)
+		if err != nil {
+			return initConfig{}, err
+		}
+		if !test {
+			return config, nil
+		}
+		fmt.Fprintf(p.out, "Connecting to %s:%d...\n", config.SSHHost, config.SSHPort)
+		ctx, cancel := context.WithTimeout(context.Background(), connectionTestTimeout)
+		err = (&datasync.Syncer{}).CheckConnection(ctx, config.config())
+		cancel()
+		if err == nil {
+			fmt.Fprintln(p.out, "Connection OK")
+			return config, nil
+		}
+		fmt.Fprintln(p.out, "Connection failed:", err)
+		keep, err := p.confirm("Keep this config anyway?", false)
+		if err != nil {
+			return initConfig{}, err
+		}
+		if keep {
+			return config, nil
+		}
+	}
+}
+
+func (p *prompter) askFields() (initConfig, error) {
+	var c initConfig
+	var err error
+	ask := func(dst *string, question, def string, check func(string) error) {
+		if err == nil {
+			*dst, err = p.ask(question, def, check)
+		}
+	}
+
+	ask(&c.Name, "Name (optional)", "", nil)
+	ask(&c.SSHHost, "SFTP host", "", checkHost)
+	var port string
+	ask(&port, "SSH port", "22", checkPort)
+	c.SSHPort, _ = strconv.Atoi(port)
+	ask(&c.User, "User", "", required)
+
+	var auth string
+	ask(&auth, "Authentication (password or key)", "password", oneOf("password", "key"))
+	if err != nil {
+		return c, err
+	}
+	if auth == "password" {
+		if c.Password, err = p.askPassword("Password"); err != nil {
+			return c, err
+		}
+	} else {
+		ask(&c.PrivateKeyPath, "Private key file", "~/.ssh/id_ed25519", checkFile)
+		if err == nil {
+			c.PrivateKeyPath, err = absPath(c.PrivateKeyPath)
+		}
+	}
+
+	ask(&c.Action, "Action (pull, push, move-pull or move-push)", "pull", oneOf("pull", "push", "move-pull", "move-push"))
+	ask(&c.RemoteDir, "Remote directory", "", required)
+	ask(&c.LocalDir, "Local directory", "", required)
+	if err == nil {
+		c.LocalDir, err = absPath(c.LocalDir)
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := p.offerMkdir(c.LocalDir); err != nil {
+		return c, err
+	}
+	ask(&c.Cron, "Cron schedule", defaultCron, checkCron)
+	return c, err
+}
+
+// offerMkdir offers to create a missing local directory.
+func (p *prompter) offerMkdir(dir string) error {
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return nil
+	}
+	create, err := p.confirm(fmt.Sprintf("%s does not exist. Create it?", dir), true)
+	if err != nil || !create {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		fmt.Fprintln(p.out, "Failed to create directory:", err)
+	}
+	return nil
+}
+
+// prompter asks questions on a terminal or any other input.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask asks question until check accepts the answer. An empty answer means
+// def.
+func (p *prompter) ask(question, def string, check func(string) error) (string, error) {
+	for {
+		if def != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+		answer, err := p.readLine()
+		if err != nil {
+			return "", err
+		}
+		if answer == "" {
+			answer = def
+		}
+		if check == nil {
+			return answer, nil
+		}
+		if err := check(answer); err != nil {
+			fmt.Fprintln(p.out, " ", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+// askPassword asks for a password without echoing it when stdin is a
+// terminal.
+func (p *prompter) askPassword(question string) (string, error) {
+	for {
+		fmt.Fprintf(p.out, "%s: ", question)
+		var password string
+		var err error
+		if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+			var raw []byte
+			raw, err = term.ReadPassword(fd)
+			fmt.Fprintln(p.out)
+			password = string(raw)
+		} else {
+			password, err = p.readLine()
+		}
+		if err != nil {
+			return "", err
+		}
+		if password != "" {
+			return password, nil
+		}
+		fmt.Fprintln(p.out, "  a password is required")
+	}
+}
+
+func (p *prompter) confirm(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	yesNo := oneOf("y", "yes", "n", "no")
+	answer, err := p.ask(question+" ("+hint+")", "", func(answer string) error {
+		if answer == "" {
+			return nil
+		}
+		return yesNo(strings.ToLower(answer))
+	})
+	if err != nil {
+		return false, err
+	}
+	if answer == "" {
+		return def, nil
+	}
+	return strings.HasPrefix(strings.ToLower(answer), "y"), nil
+}
+
+func (p *prompter) readLine() (string, error) {
+	line, err := p.in.ReadString('\n')
+	if errors.Is(err, io.EOF) && line != "" {
+		err = nil
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", errors.New("input ended before the config was complete")
+		}
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func required(answer string) error {
+	if answer == "" {
+		return errors.New("a value is required")
+	}
+	return nil
+}
+
+func oneOf(choices ...string) func(string) error {
+	return func(answer string) error {
+		for _, choice := range choices {
+			if answer == choice {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected one of %s", strings.Join(choices, ", "))
+	}
+}
+
+func checkHost(answer string) error {
+	if answer == "" || strings.ContainsAny(answer, " /") {
+		return errors.New("expected a host name or IP address")
+	}
+	return nil
+}
+
+func checkPort(answer string) error {
+	if port, err := strconv.Atoi(answer); err != nil || port < 1 || port > 65535 {
+		return errors.New("expected a port between 1 and 65535")
+	}
+	return nil
+}
+
+// absPath makes a path typed at the prompt absolute, so the config does not
+// depend on the directory the wizard ran in.
+func absPath(answer string) (string, error) {
+	path, err := resolvePath(answer, ".")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(path)
+}
+
+func checkFile(answer string) error {
+	path, err := absPath(answer)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
+
+func checkCron(answer string) error {
+	_, err := cron.ParseStandard(answer)
+	return err
+}
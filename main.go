@@ -1,336 +1,742 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"data_sync/datasync"
+
+	"github.com/fsnotify/fsnotify"
 	"github.com/kardianos/service"
-	"github.com/pkg/sftp"
 	"github.com/robfig/cron/v3"
-	"golang.org/x/crypto/ssh"
 )
 
-type Config struct {
-	SSHHost   string `json:"sshHost"`
-	SSHPort   int    `json:"sshPort"`
-	User      string `json:"user"`
-	Password  string `json:"password"`
-	LocalDir  string `json:"localDir"`
-	RemoteDir string `json:"remoteDir"`
-	Cron      string `json:"cron"`
-	Action    string `json:"action"`
+type program struct {
+	configPath string
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	mu   sync.Mutex
+	cron *cron.Cron
+	api  *apiServer
+
+	// reloadMu keeps a file change and a SIGHUP from reloading at once.
+	reloadMu sync.Mutex
+
+	// stopWatches ends the watchLocal watches of the current configuration.
+	stopWatches context.CancelFunc
+	watches     sync.WaitGroup
+
+	// scheduled counts the scheduled syncs running by config key, and
+	// triggered holds the keys with a sync started by SIGUSR1 or the API
+	// running, which triggers waits for.
+	scheduled map[string]int
+	triggered map[string]bool
+	triggers  sync.WaitGroup
+
+	logs *asyncLog
 }
 
-type program struct{}
+// Settings holds the options that apply to the whole process rather than
+// to a single config.
+type Settings struct {
+	APIAddr  string `json:"apiAddr"`
+	APIToken string `json:"apiToken"`
+
+	MaxConnectionsPerHost int `json:"maxConnectionsPerHost"`
+	MaxConcurrentDials    int `json:"maxConcurrentDials"`
+
+	// NewSessionsPerSecond limits the rate of new SSH connections.
+	NewSessionsPerSecond float64 `json:"newSessionsPerSecond"`
 
-var configs []Config
+	// GlobalMaxBytesPerSec caps the combined rate of all transfers.
+	GlobalMaxBytesPerSec int64 `json:"globalMaxBytesPerSec"`
+
+	// MaxDateRangeDays limits the dates of a date range sync without
+	// -allowLongRange.
+	MaxDateRangeDays int `json:"maxDateRangeDays"`
+
+	// LogBufferLines is how many log lines the service queues for a slow
+	// log output before dropping them.
+	LogBufferLines int `json:"logBufferLines"`
+
+	// BaseDir is the directory relative localDirs are resolved against.
+	// It defaults to the directory of the config file.
+	BaseDir string `json:"baseDir"`
+
+	// DefaultCron is the schedule of configs that set no cron.
+	DefaultCron string `json:"defaultCron"`
+	CronFormat  string `json:"cronFormat"`
+
+	// AllowedRemoteRoots, when set, lists the remote directories below
+	// which configs may sync.
+	AllowedRemoteRoots []string `json:"allowedRemoteRoots"`
+}
+
+const defaultCron = "@every 30m"
+
+// configFile is the object form of the config file. A plain array of
+// configs is still accepted and means default settings.
+type configFile struct {
+	Settings
+	Defaults datasync.Config   `json:"defaults"`
+	Configs  []datasync.Config `json:"configs"`
+}
+
+var configs []datasync.Config
+
+var settings Settings
+
+var debugLogging bool
+
+// shutdownTimeout bounds how long Stop waits for running syncs to wind down
+// after their transfers have been cancelled.
+const shutdownTimeout = 30 * time.Second
 
 func (p *program) Start(s service.Service) error {
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.logs = startAsyncLog(settings.LogBufferLines)
 	go p.run()
 	return nil
 }
 
 func (p *program) Stop(s service.Service) error {
+	defer p.logs.Close()
+	p.cancel()
+	p.stopAPI()
+
+	p.mu.Lock()
+	c := p.cron
+	p.mu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		if c != nil {
+			<-c.Stop().Done()
+		}
+		p.watches.Wait()
+		p.triggers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		log.Println("All running syncs stopped")
+	case <-time.After(shutdownTimeout):
+		log.Println("Timed out waiting for running syncs to stop")
+	}
 	return nil
 }
 
-func loadConfig(configPath string) error {
-	file, err := os.ReadFile(configPath)
+func loadConfig(configPath string) (*configFile, error) {
+	var loaded *configFile
+	var err error
+	if info, statErr := os.Stat(configPath); configPath != stdinConfig && statErr == nil && info.IsDir() {
+		loaded, err = readConfigDir(configPath)
+	} else {
+		loaded, err = readConfigFile(configPath)
+	}
 	if err != nil {
-		return fmt.Errorf("unable to read config file: %w", err)
+		return nil, err
 	}
 
-	err = json.Unmarshal(file, &configs)
-	if err != nil {
-		return fmt.Errorf("unable to parse config JSON: %w", err)
+	if loaded.GlobalMaxBytesPerSec < 0 {
+		return nil, fmt.Errorf("globalMaxBytesPerSec must not be negative")
+	}
+	if loaded.NewSessionsPerSecond < 0 {
+		return nil, fmt.Errorf("newSessionsPerSecond must not be negative")
+	}
+	if loaded.MaxDateRangeDays < 0 {
+		return nil, fmt.Errorf("maxDateRangeDays must not be negative")
+	}
+	if loaded.LogBufferLines < 0 {
+		return nil, fmt.Errorf("logBufferLines must not be negative")
+	}
+	if loaded.APIAddr != "" && loaded.APIToken == "" {
+		return nil, fmt.Errorf("apiToken is required when apiAddr is set")
+	}
+	if _, err := cronParser(loaded.CronFormat); err != nil {
+		return nil, err
+	}
+	if err := validateConfigs(loaded.Configs, loaded.CronFormat); err != nil {
+		return nil, err
+	}
+	for i, config := range loaded.Configs {
+		if err := datasync.CheckRemoteRoots(config, loaded.AllowedRemoteRoots); err != nil {
+			return nil, fmt.Errorf("config %d (%s): %w", i, config.Key(), err)
+		}
 	}
 
-	return nil
+	return loaded, nil
 }
 
-func (p *program) run() {
-	log.Println("Configs read successfully")
-	log.Println("Starting sync service")
-	log.Println("Syncing every 30 minutes")
-
-	c := cron.New()
-
-	var wg sync.WaitGroup
-	for _, config := range configs {
-		wg.Add(1)
-		go func(cfg Config) {
-			defer wg.Done()
-			c.AddFunc(cfg.Cron, func() {
-				log.Println("Syncing folder: ", cfg.RemoteDir)
-				syncFolder(cfg, "", "")
-			})
-		}(config)
+// readConfigFile reads a single config file, or stdin for stdinConfig, with
+// its defaults applied and its credentials and local directories resolved.
+func readConfigFile(configPath string) (*configFile, error) {
+	var file []byte
+	var err error
+	configDir := filepath.Dir(configPath)
+	if configPath == stdinConfig {
+		file, err = io.ReadAll(os.Stdin)
+		if err == nil {
+			// Relative paths are taken as relative to the working directory.
+			configDir, err = os.Getwd()
+		}
+	} else {
+		file, err = os.ReadFile(configPath)
 	}
-	c.Start()
-	wg.Wait()
-}
-
-func createSSHConfig(user string, password string) *ssh.ClientConfig {
-	return &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
 	}
-}
 
-func connectToSSHServer(host string, port int, config *ssh.ClientConfig) (*ssh.Client, error) {
-	addr := fmt.Sprintf("%s:%d", host, port)
-	conn, err := ssh.Dial("tcp", addr, config)
+	loaded := &configFile{}
+	if trimmed := bytes.TrimSpace(file); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(file, &loaded.Configs)
+	} else {
+		err = json.Unmarshal(file, loaded)
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to parse config JSON: %w", err)
 	}
-	return conn, nil
-}
 
-func createNewClinet(conn *ssh.Client) (*sftp.Client, error) {
-	client, err := sftp.NewClient(conn)
-	if err != nil {
-		return nil, err
+	if loaded.DefaultCron == "" {
+		loaded.DefaultCron = defaultCron
+	}
+	for i := range loaded.Configs {
+		applyDefaults(&loaded.Configs[i], loaded.Defaults)
+		if loaded.Configs[i].Cron == "" {
+			loaded.Configs[i].Cron = loaded.DefaultCron
+		}
 	}
-	return client, nil
-}
 
-func generateDateSlice(startDate, endDate string) ([]string, error) {
-	var dateSlice []string
-	start, err := time.Parse("2006-01-02", startDate)
-	if err != nil {
+	if err := resolveCredentials(loaded.Configs); err != nil {
 		return nil, err
 	}
-	end, err := time.Parse("2006-01-02", endDate)
+
+	baseDir, err := resolvePath(loaded.BaseDir, configDir)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to resolve baseDir: %w", err)
 	}
-	for !start.After(end) {
-		dateSlice = append(dateSlice, start.Format("2006-01-02"))
-		start = start.AddDate(0, 0, 1)
+	if err := resolveLocalDirs(loaded.Configs, baseDir); err != nil {
+		return nil, fmt.Errorf("unable to resolve localDir: %w", err)
 	}
-	return dateSlice, nil
+	return loaded, nil
 }
 
-func syncData(client *sftp.Client, localDir, remoteDir, action string) error {
-	if action == "pull" {
-		return pullData(client, localDir, remoteDir)
-	} else if action == "push" {
-		return pushData(client, localDir, remoteDir)
-	} else {
-		return fmt.Errorf("invalid action: %s", action)
+// applyDefaults fills every field config leaves at its zero value from
+// defaults, except the name, which identifies a single config.
+func applyDefaults(config *datasync.Config, defaults datasync.Config) {
+	dst := reflect.ValueOf(config).Elem()
+	src := reflect.ValueOf(defaults)
+	for i := 0; i < dst.NumField(); i++ {
+		if dst.Type().Field(i).Name == "Name" {
+			continue
+		}
+		if field := dst.Field(i); field.IsZero() {
+			field.Set(src.Field(i))
+		}
 	}
 }
 
-func pullData(client *sftp.Client, localDir, remoteDir string) error {
-	remoteFiles, err := client.ReadDir(remoteDir)
-	if err != nil {
-		return err
+func validateConfigs(cfgs []datasync.Config, cronFormat string) error {
+	for i, config := range cfgs {
+		if err := config.Validate(); err != nil {
+			return fmt.Errorf("config %d (%s): %w", i, config.Key(), err)
+		}
+		if _, err := parseCron(cronFormat, config.Cron); err != nil {
+			if cronFormat != cronFormatWithSeconds && len(strings.Fields(config.Cron)) == 6 {
+				err = fmt.Errorf("%w (a seconds field needs cronFormat %s)", err, cronFormatWithSeconds)
+			}
+			return fmt.Errorf("config %d (%s): invalid cron %q: %w", i, config.Key(), config.Cron, err)
+		}
 	}
+	return nil
+}
 
-	for _, file := range remoteFiles {
-		remoteFilePath := filepath.Join(remoteDir, file.Name())
-		localFilePath := filepath.Join(localDir, file.Name())
+// run starts the schedules, the config watcher and the API, and returns
+// once the service is stopped.
+func (p *program) run() {
+	log.Println("Configs read successfully")
+	log.Println("Starting sync service")
 
-		if file.IsDir() {
-			if err := os.MkdirAll(localFilePath, os.ModePerm); err != nil {
-				log.Println("Failed to create local directory", localFilePath, ":", err)
-				continue
+	p.startCron(configs, settings.CronFormat)
+	p.startWatches(configs)
+	go p.watchConfig()
+	go p.watchSignals()
+
+	if settings.APIAddr != "" {
+		p.startAPI(settings)
+	}
+
+	<-p.ctx.Done()
+	log.Println("Stopping sync service")
+}
+
+// startCron schedules cfgs on a new cron and replaces the current one.
+// Stopping a cron only prevents new runs, so syncs already in progress on
+// the old schedule finish normally.
+func (p *program) startCron(cfgs []datasync.Config, cronFormat string) {
+	parser, _ := cronParser(cronFormat)
+	c := cron.New(cron.WithParser(parser))
+
+	now := time.Now()
+	for _, cfg := range cfgs {
+		if cfg.Disabled() {
+			log.Println("Skipping disabled config", cfg.Key())
+			continue
+		}
+		id, err := c.AddFunc(cfg.Cron, func() {
+			if !p.waitJitter(cfg) {
+				return
 			}
-			if err := pullData(client, localFilePath, remoteFilePath); err != nil {
-				log.Println("Failed to download directory", remoteFilePath, ":", err)
-				continue
+			if !p.beginSync(cfg.Key(), false) {
+				log.Println("Skipping the scheduled sync of", cfg.Key(), ": the sync triggered by SIGUSR1 or the API is still running")
+				return
 			}
+			defer p.endSync(cfg.Key(), false)
+			log.Println("Syncing folder: ", remoteDirs(cfg))
+			syncFolder(p.ctx, cfg, "", "")
+		})
+		if err != nil {
+			log.Printf("Failed to schedule %s with cron %q: %v", cfg.Key(), cfg.Cron, err)
+			continue
+		}
+		next := c.Entry(id).Schedule.Next(now)
+		if jitter := time.Duration(cfg.ScheduleJitter); jitter > 0 {
+			log.Printf("Scheduled %s with cron %q, next run at %s plus up to %s", cfg.Key(), cfg.Cron, next.Format(time.DateTime), jitter)
 		} else {
-			remoteFileInfo, err := client.Stat(remoteFilePath)
-			if err != nil {
-				log.Println("Failed to stat remote file", remoteFilePath, ":", err)
-				continue
-			}
-
-			localFileInfo, err := os.Stat(localFilePath)
-			if os.IsNotExist(err) || remoteFileInfo.ModTime().After(localFileInfo.ModTime()) {
-				if err := downloadFile(client, localFilePath, remoteFilePath); err != nil {
-					log.Println("Failed to download file", remoteFilePath, ":", err)
-				}
-			}
+			log.Printf("Scheduled %s with cron %q, next run at %s", cfg.Key(), cfg.Cron, next.Format(time.DateTime))
 		}
 	}
 
-	return nil
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ctx.Err() != nil {
+		return
+	}
+	if p.cron != nil {
+		p.cron.Stop()
+	}
+	c.Start()
+	p.cron = c
 }
 
-func pushData(client *sftp.Client, localDir, remoteDir string) error {
-	localFiles, err := os.ReadDir(localDir)
+// waitJitter delays a scheduled run of cfg by a random part of its
+// scheduleJitter, and reports false if the service stopped meanwhile.
+func (p *program) waitJitter(cfg datasync.Config) bool {
+	jitter := time.Duration(cfg.ScheduleJitter)
+	if jitter <= 0 {
+		return true
+	}
+	delay := rand.N(jitter)
+	if debugLogging || cfg.LogLevel == "debug" {
+		log.Printf("Delaying the run of %s by %s", cfg.Key(), delay.Round(time.Millisecond))
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+func (p *program) watchConfig() {
+	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		return err
+		log.Println("Failed to watch config file:", err)
+		return
 	}
+	defer watcher.Close()
 
-	for _, file := range localFiles {
-		localFilePath := filepath.Join(localDir, file.Name())
-		remoteFilePath := filepath.Join(remoteDir, file.Name())
+	if p.configPath == stdinConfig {
+		return
+	}
+	// Editors often replace the file instead of writing it in place, so
+	// watch the directory and filter on the file name.
+	dir := filepath.Dir(p.configPath)
+	if info, err := os.Stat(p.configPath); err == nil && info.IsDir() {
+		dir = p.configPath
+	}
+	if err := watcher.Add(dir); err != nil {
+		log.Println("Failed to watch config file:", err)
+		return
+	}
 
-		if file.IsDir() {
-			if err := client.MkdirAll(remoteFilePath); err != nil {
-				log.Println("Failed to create remote directory", remoteFilePath, ":", err)
-				continue
+	var reload *time.Timer
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
 			}
-			if err := pushData(client, localFilePath, remoteFilePath); err != nil {
-				log.Println("Failed to upload directory", localFilePath, ":", err)
+			if !isConfigEvent(p.configPath, event.Name) || !event.Has(fsnotify.Write) &&
+				!event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) && !event.Has(fsnotify.Remove) {
 				continue
 			}
-		} else {
-			localFileInfo, err := os.Stat(localFilePath)
-			if err != nil {
-				log.Println("Failed to stat local file", localFilePath, ":", err)
-				continue
+			if reload != nil {
+				reload.Stop()
 			}
-
-			remoteFileInfo, err := client.Stat(remoteFilePath)
-			if os.IsNotExist(err) || localFileInfo.ModTime().After(remoteFileInfo.ModTime()) {
-				if err := uploadFile(client, localFilePath, remoteFilePath); err != nil {
-					log.Println("Failed to upload file", localFilePath, ":", err)
-				}
+			reload = time.AfterFunc(500*time.Millisecond, p.reloadConfig)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
 			}
+			log.Println("Config watcher error:", err)
 		}
 	}
-
-	return nil
 }
 
-func downloadFile(client *sftp.Client, localFilePath, remoteFilePath string) error {
-	remoteFile, err := client.Open(remoteFilePath)
-	if err != nil {
-		return err
+// watchSignals reloads the configuration on SIGHUP, for systems where the
+// file watcher is unreliable, and syncs every config on SIGUSR1. Windows
+// sends neither.
+func (p *program) watchSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	usr1 := make(chan os.Signal, 1)
+	notifyTrigger(usr1)
+	defer signal.Stop(usr1)
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-hup:
+			log.Println("Received SIGHUP, reloading configuration")
+			p.reloadConfig()
+		case <-usr1:
+			p.syncNow()
+		}
 	}
-	defer remoteFile.Close()
+}
 
-	localFile, err := os.Create(localFilePath)
+func (p *program) reloadConfig() {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	if p.configPath == stdinConfig {
+		log.Println("Not reloading the configuration: it was read from stdin")
+		return
+	}
+	loaded, err := loadConfig(p.configPath)
 	if err != nil {
-		return err
+		log.Println("Failed to reload configuration, keeping the current one:", err)
+		return
 	}
-	defer localFile.Close()
 
-	if _, err := remoteFile.WriteTo(localFile); err != nil {
-		return err
+	p.startCron(loaded.Configs, loaded.CronFormat)
+	p.startWatches(loaded.Configs)
+	p.mu.Lock()
+	configs, settings.CronFormat = loaded.Configs, loaded.CronFormat
+	p.mu.Unlock()
+	log.Println("Configuration reloaded,", len(loaded.Configs), "configs scheduled")
+}
+
+var syncer = &datasync.Syncer{}
+
+func syncFolder(ctx context.Context, config datasync.Config, startDate, endDate string) (datasync.Result, error) {
+	var result datasync.Result
+	var err error
+	if startDate != "" && endDate != "" {
+		result, err = syncer.SyncRange(ctx, config, startDate, endDate)
+	} else {
+		result, err = syncer.Sync(ctx, config)
+	}
+	logDenied(config, result)
+	logPerformance(config, result)
+	if syncer.DryRun || config.DryRun {
+		return result, err
 	}
+	if err := recordSyncState(config, result); err != nil {
+		log.Println("Failed to record sync state:", err)
+	}
+	return result, err
+}
 
-	log.Println("Downloaded", remoteFilePath, "to", localFilePath)
-	return nil
+// selectConfigs returns the configs with the given names, in the order of
+// the config file, or all of them if names is empty. It fails when a name
+// matches no config.
+func selectConfigs(names []string) ([]datasync.Config, error) {
+	if len(names) == 0 {
+		return configs, nil
+	}
+	var selected []datasync.Config
+	for _, config := range configs {
+		if slices.Contains(names, config.Name) {
+			selected = append(selected, config)
+		}
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(selected, func(c datasync.Config) bool { return c.Name == name }) {
+			return nil, fmt.Errorf("no config named %s", name)
+		}
+	}
+	return selected, nil
 }
 
-func uploadFile(client *sftp.Client, localFilePath, remoteFilePath string) error {
-	localFile, err := os.Open(localFilePath)
+func syncOnce(ctx context.Context, names []string, report *syncReport) int {
+	selected, err := selectConfigs(names)
 	if err != nil {
-		return err
+		log.Println(err)
+		return exitConfig
 	}
-	defer localFile.Close()
 
-	remoteFile, err := client.Create(remoteFilePath)
-	if err != nil {
-		return err
+	exitCode := exitOK
+	for _, config := range selected {
+		if ctx.Err() != nil {
+			log.Println("Sync interrupted")
+			return exitError
+		}
+		if config.Disabled() {
+			log.Println("Skipping disabled config", config.Key())
+			continue
+		}
+		log.Println("Syncing folder: ", remoteDirs(config))
+		result, err := syncFolder(ctx, config, "", "")
+		report.add(config, result)
+		if err != nil {
+			log.Println(red(fmt.Sprint("Sync failed for ", config.Key(), " : ", err)))
+			exitCode = worseExit(exitCode, syncExitCode(result, err))
+		}
 	}
-	defer remoteFile.Close()
+	log.Println("Syncing completed")
+	return exitCode
+}
 
-	if _, err := localFile.WriteTo(remoteFile); err != nil {
-		return err
+// restartOptions configures the service manager to restart the service
+// when it fails. Only Windows supports a delay: systemd waits its fixed
+// RestartSec, and launchd restarts at once.
+func restartOptions(delay time.Duration) service.KeyValue {
+	return service.KeyValue{
+		// Windows
+		"OnFailure":              "restart",
+		"OnFailureDelayDuration": delay.String(),
+		// systemd
+		"Restart": "on-failure",
+		// launchd
+		"KeepAlive": true,
 	}
+}
+
+// nameList is a flag naming a config, which may be given several times.
+type nameList []string
+
+func (l *nameList) String() string { return strings.Join(*l, ",") }
 
-	log.Println("Uploaded", localFilePath, "to", remoteFilePath)
+func (l *nameList) Set(name string) error {
+	if name == "" {
+		return fmt.Errorf("config name must not be empty")
+	}
+	*l = append(*l, name)
 	return nil
 }
 
-func syncFolder(config Config, startDate, endDate string) {
-	configSSH := createSSHConfig(config.User, config.Password)
-	conn, err := connectToSSHServer(config.SSHHost, config.SSHPort, configSSH)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	defer conn.Close()
-	client, err := createNewClinet(conn)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	defer client.Close()
+// pathList is a flag that may be given several times.
+type pathList []string
 
-	if startDate != "" && endDate != "" {
-		dates, err := generateDateSlice(startDate, endDate)
-		if err != nil {
-			log.Println("Failed to generate date slice:", err)
-			return
-		}
+func (l *pathList) String() string { return strings.Join(*l, ",") }
 
-		for _, date := range dates {
-			remoteDir := filepath.Join(config.RemoteDir, date)
-			localDir := filepath.Join(config.LocalDir, date)
-			action := config.Action
-			log.Println("Syncing Date:", date)
-			if err := syncData(client, localDir, remoteDir, action); err != nil {
-				log.Println("Failed to sync folder:", err)
-			}
-		}
-	} else {
-		remoteDir := config.RemoteDir
-		localDir := config.LocalDir
-		action := config.Action
-		if err := syncData(client, localDir, remoteDir, action); err != nil {
-			log.Println("Failed to sync folder:", err)
-		}
+func (l *pathList) Set(path string) error {
+	if !filepath.IsLocal(path) {
+		return fmt.Errorf("%q is not a relative path inside the synced directory", path)
 	}
+	*l = append(*l, path)
+	return nil
 }
 
-func main() {
-	svcConfig := &service.Config{
-		Name:        "DataSyncService",
-		DisplayName: "Data Sync Service",
-		Description: "This service syncs data from remote server to local machine every 30 minutes",
+// sinceFlag is a point in time given as an RFC3339 timestamp, or as a
+// duration before now such as 6h or 2d.
+type sinceFlag struct{ time.Time }
+
+func (f *sinceFlag) String() string {
+	if f.IsZero() {
+		return ""
 	}
+	return f.Format(time.RFC3339)
+}
 
-	prg := &program{}
-	s, err := service.New(prg, svcConfig)
-	if err != nil {
-		log.Fatal(err)
+func (f *sinceFlag) Set(s string) error {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		f.Time = t
+		return nil
 	}
+	d, err := datasync.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("%q is neither an RFC3339 timestamp nor a positive duration", s)
+	}
+	f.Time = time.Now().Add(-time.Duration(d))
+	return nil
+}
+
+func main() {
+	svcConfig := &service.Config{}
 
 	startDate := flag.String("startDate", "", "Start date for data sync")
 	endDate := flag.String("endDate", "", "End date for data sync")
+	inclusiveEnd := flag.Bool("inclusiveEnd", true, "Include the end date in the synced range")
+	step := flag.Int("step", 1, "Sync only every step-th date between startDate and endDate")
+	failFast := flag.Bool("failFast", false, "Stop a date range sync at the first date or config that fails")
+	dateConcurrency := flag.Int("dateConcurrency", 1, "Sync up to this many dates between startDate and endDate at once, each over its own connection")
+	flag.BoolVar(&debugLogging, "v", false, "Log the transfer decision for every file")
+	flag.BoolVar(&debugLogging, "debug", false, "Same as -v")
+	force := flag.Bool("force", false, "Transfer every file, ignoring timestamps and the state DB")
+	allowLongRange := flag.Bool("allowLongRange", false, "Sync a date range holding more dates than maxDateRangeDays")
+	dryRun := flag.Bool("dryRun", false, "Log what would be transferred or deleted without changing anything")
+	planPath := flag.String("planFile", "", "With -dryRun, write what would be transferred or deleted to this JSON file for apply")
+	jsonOutput := flag.Bool("jsonOutput", false, "Print a JSON summary of the sync or date range sync to stdout")
+	progress := flag.Bool("progress", false, "Log a summary line for every synced directory, or show the overall progress of a date range")
+	var only pathList
+	flag.Var(&only, "only", "Sync only this path relative to the synced directories, and what is inside it; may be repeated")
+	var since sinceFlag
+	flag.Var(&since, "since", "Sync only files modified after this RFC3339 timestamp, or this long ago, e.g. 6h")
+	colorMode := flag.String("color", "auto", "Color the log output: auto (only on a terminal), always or never")
+	configFlag := flag.String("config", "", "Path of the config file, overriding $DATASYNC_CONFIG and configs.json next to the executable")
+	var configNames nameList
+	flag.Var(&configNames, "configName", "Name of a config to sync, test, compare or show the status of; may be repeated")
 	flag.Parse()
+	if *step <= 0 {
+		fatal(exitUsage, "Invalid -step ", *step, ": must be at least 1")
+	}
+	if *dateConcurrency <= 0 {
+		fatal(exitUsage, "Invalid -dateConcurrency ", *dateConcurrency, ": must be at least 1")
+	}
+	if *planPath != "" && !*dryRun {
+		fatal(exitUsage, "-planFile requires -dryRun")
+	}
+	color, err := colorEnabled(*colorMode)
+	if err != nil {
+		fatal(exitUsage, err)
+	}
+	useColor = color
 
 	// Load configuration at service start
 	exePath, err := os.Executable()
 	if err != nil {
 		log.Fatal("Failed to get executable path: ", err)
 	}
-	exeDir := filepath.Dir(exePath)
-	configPath := filepath.Join(exeDir, "configs.json")
-	if err := loadConfig(configPath); err != nil {
-		log.Fatal("Failed to load configuration: ", err)
+	if flag.Arg(0) == "init" {
+		// There is no config to load yet.
+		configPath, _, err := configFileName(*configFlag, filepath.Dir(exePath))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if configPath == stdinConfig {
+			fatal(exitUsage, "init needs the path of a config file to create, not -config -")
+		}
+		if err := runInit(configPath, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	configPath, overridden, err := configFilePath(*configFlag, filepath.Dir(exePath))
+	if err != nil {
+		fatal(exitConfig, err)
+	}
+	if configPath == stdinConfig && flag.Arg(0) == "install" {
+		fatal(exitUsage, "The service cannot read its config from stdin, install it with the path of a config file")
+	}
+	if overridden {
+		// The service must find the same file without the flag or the
+		// environment of this shell.
+		svcConfig.Arguments = []string{"-config", configPath}
+	}
+	stateDir := dataDir(configPath, filepath.Dir(exePath))
+	names, err := loadServiceNames(stateDir)
+	if err != nil {
+		fatal(exitConfig, err)
+	}
+	names.apply(svcConfig)
+	loaded, err := loadConfig(configPath)
+	if err != nil {
+		fatal(exitConfig, "Failed to load configuration: ", err)
+	}
+	configs, settings = loaded.Configs, loaded.Settings
+	syncer.Debug = debugLogging
+	syncer.DryRun = *dryRun
+	syncer.Force = *force
+	syncer.ExcludeEndDate = !*inclusiveEnd
+	syncer.DateStep = *step
+	syncer.DateConcurrency = *dateConcurrency
+	syncer.FailFast = *failFast
+	syncer.Only = only
+	syncer.Since = since.Time
+	syncer.Color = useColor
+	syncer.MaxConnectionsPerHost = settings.MaxConnectionsPerHost
+	syncer.MaxConcurrentDials = settings.MaxConcurrentDials
+	syncer.NewSessionsPerSecond = settings.NewSessionsPerSecond
+	syncer.MaxBytesPerSec = settings.GlobalMaxBytesPerSec
+	syncer.MaxDateRangeDays = settings.MaxDateRangeDays
+	syncer.AllowLongRange = *allowLongRange
+	syncer.AllowedRemoteRoots = settings.AllowedRemoteRoots
+	if *progress {
+		syncer.Events = consoleEvents{}
 	}
+	statePath = filepath.Join(stateDir, "sync_state.json")
+	syncer.CheckpointDir = filepath.Join(stateDir, "checkpoints")
 
-	if len(os.Args) > 1 {
-		serviceAction := os.Args[1]
+	prg := &program{configPath: configPath}
+	s, err := service.New(prg, svcConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.NArg() > 0 {
+		serviceAction := flag.Arg(0)
 		switch serviceAction {
 		case "install":
+			installCmd := flag.NewFlagSet("install", flag.ExitOnError)
+			restartOnFailure := installCmd.Bool("restartOnFailure", false, "Have the service manager restart the service when it fails")
+			restartDelay := installCmd.Duration("restartDelay", time.Minute, "How long Windows waits before restarting a failed service")
+			installCmd.StringVar(&names.Name, "serviceName", names.Name, "Name the service is registered under")
+			installCmd.StringVar(&names.DisplayName, "displayName", names.DisplayName, "Name the service manager shows for the service")
+			installCmd.StringVar(&names.Description, "description", names.Description, "Description of the service")
+			installCmd.Parse(flag.Args()[1:])
+			if *restartDelay < 0 {
+				log.Fatal("Invalid -restartDelay ", *restartDelay, ": must not be negative")
+			}
+			if err := names.validate(); err != nil {
+				log.Fatal(err)
+			}
+			names.apply(svcConfig)
+			if *restartOnFailure {
+				svcConfig.Option = restartOptions(*restartDelay)
+			}
+			if s, err = service.New(prg, svcConfig); err != nil {
+				log.Fatal(err)
+			}
 			if err := s.Install(); err != nil {
 				log.Fatal(err)
 			}
-			log.Println("Service installed successfully")
+			if err := saveServiceNames(stateDir, names); err != nil {
+				log.Fatal("Service installed, but failed to record its name: ", err)
+			}
+			log.Println("Service", names.Name, "installed successfully")
 			return
 		case "uninstall":
 			if err := s.Uninstall(); err != nil {
 				log.Fatal(err)
 			}
-			log.Println("Service uninstalled successfully")
+			// Forget the name, so the next install starts from the defaults.
+			if err := saveServiceNames(stateDir, defaultServiceNames); err != nil {
+				log.Println("Failed to remove service file:", err)
+			}
+			log.Println("Service", names.Name, "uninstalled successfully")
 			return
 		case "start":
 			if err := s.Start(); err != nil {
@@ -344,17 +750,153 @@ func main() {
 			}
 			log.Println("Service stopped successfully")
 			return
+		case "sync":
+			syncCmd := flag.NewFlagSet("sync", flag.ExitOnError)
+			syncCmd.Var(&configNames, "config", "Name of a config to sync; may be repeated")
+			syncCmd.Parse(flag.Args()[1:])
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			report := &syncReport{Configs: []configReport{}}
+			exitCode := syncOnce(ctx, configNames, report)
+			stop()
+			if *planPath != "" {
+				if err := writePlan(*planPath, report); err != nil {
+					fatal(exitError, "Failed to write the plan: ", err)
+				}
+			}
+			if *jsonOutput {
+				if err := report.write(os.Stdout); err != nil {
+					log.Fatal(err)
+				}
+			}
+			os.Exit(exitCode)
+		case "apply":
+			applyCmd := flag.NewFlagSet("apply", flag.ExitOnError)
+			applyCmd.Parse(flag.Args()[1:])
+			if applyCmd.NArg() != 1 {
+				fatal(exitUsage, "Usage: data_sync apply <plan file>")
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			report := &syncReport{Configs: []configReport{}}
+			exitCode := applyPlan(ctx, applyCmd.Arg(0), report)
+			stop()
+			if *jsonOutput {
+				if err := report.write(os.Stdout); err != nil {
+					log.Fatal(err)
+				}
+			}
+			os.Exit(exitCode)
+		case "test":
+			testCmd := flag.NewFlagSet("test", flag.ExitOnError)
+			testCmd.Var(&configNames, "config", "Name of a config to test; may be repeated")
+			testCmd.Parse(flag.Args()[1:])
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			exitCode := testConnections(ctx, configNames)
+			stop()
+			os.Exit(exitCode)
+		case "diff":
+			diffCmd := flag.NewFlagSet("diff", flag.ExitOnError)
+			diffCmd.Var(&configNames, "config", "Name of a config to compare; may be repeated")
+			diffCmd.Parse(flag.Args()[1:])
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			exitCode := diffConfigs(ctx, os.Stdout, configNames, *jsonOutput)
+			stop()
+			os.Exit(exitCode)
+		case "index":
+			indexCmd := flag.NewFlagSet("index", flag.ExitOnError)
+			indexCmd.Var(&configNames, "config", "Name of a config to index; may be repeated")
+			format := indexCmd.String("format", "json", "Format of the index: json or csv")
+			output := indexCmd.String("output", "", "File to write the index to instead of standard output")
+			indexCmd.Parse(flag.Args()[1:])
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			exitCode := indexConfigs(ctx, os.Stdout, configNames, *format, *output)
+			stop()
+			os.Exit(exitCode)
+		case "verify":
+			verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+			verifyCmd.Var(&configNames, "config", "Name of a config to verify; may be repeated")
+			checksum := verifyCmd.Bool("checksum", false, "Also compare the SHA-256 of files of the same size")
+			verifyCmd.Parse(flag.Args()[1:])
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			exitCode := verifyConfigs(ctx, os.Stdout, configNames, *checksum, *jsonOutput)
+			stop()
+			os.Exit(exitCode)
+		case "list":
+			if err := printConfigs(os.Stdout, configPath); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "validate":
+			printValidation(os.Stdout, configPath)
+			return
+		case "status":
+			statusCmd := flag.NewFlagSet("status", flag.ExitOnError)
+			statusCmd.Var(&configNames, "config", "Name of a config to show; may be repeated")
+			statusCmd.Parse(flag.Args()[1:])
+			selected, err := selectConfigs(configNames)
+			if err != nil {
+				fatal(exitConfig, err)
+			}
+			if err := printStatus(os.Stdout, selected); err != nil {
+				log.Fatal(err)
+			}
+			return
 		}
 	}
 
 	if *startDate != "" && *endDate != "" {
+		selected, err := selectConfigs(configNames)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
 		log.Println("Syncing folders with date range")
-		for _, config := range configs {
-			log.Println("Syncing folder: ", config.RemoteDir)
-			syncFolder(config, *startDate, *endDate)
+		var dates *dateProgress
+		if *progress {
+			dates = startDateProgress()
+			syncer.Events = dates
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		report := &syncReport{Configs: []configReport{}}
+		exitCode := exitOK
+		for _, config := range selected {
+			if ctx.Err() != nil {
+				log.Println("Sync interrupted")
+				exitCode = exitError
+				break
+			}
+			if config.Disabled() {
+				log.Println("Skipping disabled config", config.Key())
+				continue
+			}
+			log.Println("Syncing folder: ", remoteDirs(config))
+			result, err := syncFolder(ctx, config, *startDate, *endDate)
+			report.add(config, result)
+			logDateResults(config, result.Dates)
+			if err != nil {
+				log.Println(red(fmt.Sprint("Sync failed for ", config.Key(), " : ", err)))
+				exitCode = worseExit(exitCode, syncExitCode(result, err))
+				if *failFast {
+					log.Println("Skipping the remaining configs")
+					break
+				}
+			}
+		}
+		if dates != nil {
+			dates.Stop()
 		}
 		log.Println("Syncing completed")
-		return
+		stop()
+		if *planPath != "" {
+			if err := writePlan(*planPath, report); err != nil {
+				fatal(exitError, "Failed to write the plan: ", err)
+			}
+		}
+		if *jsonOutput {
+			if err := report.write(os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+		}
+		os.Exit(exitCode)
 	}
 
 	if err := s.Run(); err != nil {
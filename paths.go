@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"data_sync/datasync"
+)
+
+// resolveLocalDirs makes the local directories of every config absolute:
+// a leading ~ is the user's home directory, and relative paths are taken
+// relative to baseDir. Remote directories, and the destination directory of
+// a relay, are left alone, since the server decides what ~ and relative
+// paths mean there.
+func resolveLocalDirs(cfgs []datasync.Config, baseDir string) error {
+	for i := range cfgs {
+		config := &cfgs[i]
+		if config.TempDir != "" {
+			dir, err := resolvePath(config.TempDir, baseDir)
+			if err != nil {
+				return err
+			}
+			config.TempDir = dir
+		}
+		if config.Action == "relay" {
+			// localDir is on the destination server.
+			continue
+		}
+		if config.LocalDir != "" {
+			dir, err := resolvePath(config.LocalDir, baseDir)
+			if err != nil {
+				return err
+			}
+			config.LocalDir = dir
+		}
+		dirs := make([]string, len(config.LocalDirs))
+		for j, dir := range config.LocalDirs {
+			resolved, err := resolvePath(dir, baseDir)
+			if err != nil {
+				return err
+			}
+			dirs[j] = resolved
+		}
+		if config.LocalDirs != nil {
+			config.LocalDirs = dirs
+		}
+	}
+	return nil
+}
+
+func resolvePath(path, baseDir string) (string, error) {
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, `~\`) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, path[1:]), nil
+	}
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+	return filepath.Join(baseDir, path), nil
+}
+
+// stdinConfig as the config path reads the config from stdin.
+const stdinConfig = "-"
+
+// configFileName returns the absolute path of the config file: flagPath,
+// else $DATASYNC_CONFIG, else configs.json in exeDir, and whether it is not
+// the default. stdinConfig is returned as it is.
+func configFileName(flagPath, exeDir string) (path string, overridden bool, err error) {
+	path = flagPath
+	if path == "" {
+		path = os.Getenv("DATASYNC_CONFIG")
+	}
+	overridden = path != ""
+	if !overridden {
+		path = filepath.Join(exeDir, "configs.json")
+	}
+	if path == stdinConfig {
+		return path, true, nil
+	}
+	path, err = filepath.Abs(path)
+	return path, overridden, err
+}
+
+// dataDir returns the directory holding the sync state, checkpoints and
+// service file of the config at configPath: the directory of the config,
+// or exeDir for a config read from stdin.
+func dataDir(configPath, exeDir string) string {
+	if configPath == stdinConfig {
+		return exeDir
+	}
+	return filepath.Dir(configPath)
+}
+
+// configFilePath returns the config file, or directory of config files, to
+// load, as configFileName does. It fails, naming the path, unless it can be
+// read.
+func configFilePath(flagPath, exeDir string) (path string, overridden bool, err error) {
+	if path, overridden, err = configFileName(flagPath, exeDir); err != nil {
+		return "", false, err
+	}
+	if path == stdinConfig {
+		return path, overridden, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false, fmt.Errorf("config file %s is not readable: %w", path, err)
+	}
+	defer file.Close()
+	return path, overridden, nil
+}
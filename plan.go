@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"data_sync/datasync"
+)
+
+// planFile is what -planFile writes after a dry run and apply carries out.
+type planFile struct {
+	Created time.Time    `json:"created"`
+	Configs []configPlan `json:"configs"`
+}
+
+type configPlan struct {
+	Config     string               `json:"config"`
+	Operations []datasync.PlannedOp `json:"operations"`
+}
+
+// writePlan writes the operations planned by the dry run in report to
+// path, leaving out configs with nothing to do.
+func writePlan(path string, report *syncReport) error {
+	plan := planFile{Created: time.Now(), Configs: []configPlan{}}
+	for _, config := range report.Configs {
+		if len(config.planned) > 0 {
+			plan.Configs = append(plan.Configs, configPlan{config.Config, config.planned})
+		}
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	n := 0
+	for _, config := range plan.Configs {
+		n += len(config.Operations)
+	}
+	log.Println("Wrote", n, "planned operations of", len(plan.Configs), "configs to", path)
+	return nil
+}
+
+// applyPlan carries out the plan file at path. Every config it names must
+// still be configured, or nothing is applied.
+func applyPlan(ctx context.Context, path string, report *syncReport) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Println("Failed to read plan:", err)
+		return exitConfig
+	}
+	var plan planFile
+	if err := json.Unmarshal(data, &plan); err != nil {
+		log.Println("Failed to parse plan", path, ":", err)
+		return exitConfig
+	}
+	byKey := make(map[string]datasync.Config)
+	for _, config := range configs {
+		byKey[config.Key()] = config
+	}
+	for _, entry := range plan.Configs {
+		if _, ok := byKey[entry.Config]; !ok {
+			log.Println(fmt.Sprintf("The plan names config %s, which is not configured", entry.Config))
+			return exitConfig
+		}
+	}
+
+	log.Println("Applying the plan made at", plan.Created.Format(time.DateTime))
+	exitCode := exitOK
+	for _, entry := range plan.Configs {
+		if ctx.Err() != nil {
+			log.Println("Apply interrupted")
+			return exitError
+		}
+		config := byKey[entry.Config]
+		log.Println("Applying", len(entry.Operations), "planned operations of", config.Key())
+		result, err := syncer.Apply(ctx, config, entry.Operations)
+		report.add(config, result)
+		logDenied(config, result)
+		if err != nil {
+			log.Println(red(fmt.Sprint("Apply failed for ", config.Key(), " : ", err)))
+			exitCode = worseExit(exitCode, syncExitCode(result, err))
+		}
+	}
+	log.Println("Applying completed")
+	return exitCode
+}
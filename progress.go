@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"data_sync/datasync"
+	"golang.org/x/term"
+)
+
+// With -progress a date range shows how far it got over all its dates:
+// how many are done out of the range, which are being synced and the files
+// handled in them so far. On a terminal this is a status line kept below
+// the log lines and updated in place, else it is logged every
+// progressLogInterval.
+
+// progressRedrawInterval is how often the status line is updated.
+const progressRedrawInterval = 250 * time.Millisecond
+
+// progressLogInterval is how often the progress is logged when standard
+// error is not a terminal.
+const progressLogInterval = 30 * time.Second
+
+type dateProgress struct {
+	datasync.NopEvents
+
+	mu     sync.Mutex
+	config string
+	total  int
+	done   int
+	// current holds the dates being synced, in the order they started, and
+	// files and bytes what was handled in them so far.
+	current []string
+	files   int
+	bytes   int64
+	changed bool
+
+	// out is the log output. On a terminal the status line is drawn on it,
+	// and drawn records whether it is there now.
+	out      io.Writer
+	terminal bool
+	drawn    bool
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// startDateProgress returns the Events showing the progress of a date
+// range, to be stopped once the range is done. On a terminal it takes over
+// the standard logger's output, so it must be started before the range.
+func startDateProgress() *dateProgress {
+	p := &dateProgress{out: log.Writer(), stop: make(chan struct{}), stopped: make(chan struct{})}
+	p.terminal = p.out == io.Writer(os.Stderr) && term.IsTerminal(int(os.Stderr.Fd())) && enableVirtualTerminal(os.Stderr)
+	if p.terminal {
+		log.SetOutput(p)
+	}
+	go p.run()
+	return p
+}
+
+func (p *dateProgress) OnRangeStart(config string, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.config, p.total, p.done = config, total, 0
+	p.current, p.files, p.bytes = nil, 0, 0
+	p.changed = true
+}
+
+func (p *dateProgress) OnDateStart(date string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = append(p.current, date)
+	p.changed = true
+}
+
+func (p *dateProgress) OnDateComplete(date string, stats datasync.DirStats, resumed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if i := slices.Index(p.current, date); i >= 0 {
+		p.current = slices.Delete(p.current, i, i+1)
+	}
+	p.files -= stats.Files + stats.Skipped + stats.Failed
+	p.bytes -= stats.Bytes
+	if len(p.current) == 0 {
+		p.files, p.bytes = 0, 0
+	}
+	p.changed = true
+}
+
+func (p *dateProgress) OnFileTransferred(path string, bytes int64, direction string) {
+	p.count(bytes)
+}
+
+func (p *dateProgress) OnFileSkipped(path, reason string) {
+	p.count(0)
+}
+
+func (p *dateProgress) OnError(path string, err error) {
+	p.count(0)
+}
+
+// count adds a file handled in the dates being synced, leaving out those
+// of retention and the like, which run after the dates.
+func (p *dateProgress) count(bytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.current) == 0 {
+		return
+	}
+	p.files++
+	p.bytes += bytes
+	p.changed = true
+}
+
+// status describes the progress, or is empty before a range started.
+func (p *dateProgress) status() string {
+	if p.total == 0 {
+		return ""
+	}
+	s := fmt.Sprintf("%s: %d/%d dates done (%d%%)", p.config, p.done, p.total, p.done*100/p.total)
+	if len(p.current) > 0 {
+		s += fmt.Sprintf(", syncing %s: %d files, %d bytes", strings.Join(p.current, ", "), p.files, p.bytes)
+	}
+	return s
+}
+
+// Write writes a log line above the status line.
+func (p *dateProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	n, err := p.out.Write(b)
+	p.draw()
+	return n, err
+}
+
+// clear removes the status line from the terminal.
+func (p *dateProgress) clear() {
+	if p.drawn {
+		io.WriteString(p.out, "\r\x1b[K")
+		p.drawn = false
+	}
+}
+
+// draw writes the status line, cut to the width of the terminal so that it
+// does not wrap, and leaves the cursor at its end.
+func (p *dateProgress) draw() {
+	line := p.status()
+	if line == "" {
+		return
+	}
+	if width, _, err := term.GetSize(int(os.Stderr.Fd())); err == nil && width > 1 && len(line) >= width {
+		line = line[:width-1]
+	}
+	io.WriteString(p.out, line)
+	p.drawn = true
+}
+
+func (p *dateProgress) run() {
+	defer close(p.stopped)
+	interval := progressLogInterval
+	if p.terminal {
+		interval = progressRedrawInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			switch {
+			case p.terminal && p.changed:
+				p.clear()
+				p.draw()
+			case !p.terminal && p.done < p.total:
+				log.Println("Progress of", p.status())
+			}
+			p.changed = false
+			p.mu.Unlock()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Stop removes the status line and gives the standard logger its output
+// back.
+func (p *dateProgress) Stop() {
+	close(p.stop)
+	<-p.stopped
+	if p.terminal {
+		p.mu.Lock()
+		p.clear()
+		p.mu.Unlock()
+		log.SetOutput(p.out)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kardianos/service"
+)
+
+// serviceNames are the names the service is installed under. install keeps
+// them in service.json next to the config file, so that start, stop,
+// uninstall and the service itself find the same service without the flags.
+type serviceNames struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+	Description string `json:"description"`
+}
+
+var defaultServiceNames = serviceNames{
+	Name:        "DataSyncService",
+	DisplayName: "Data Sync Service",
+	Description: "This service syncs data between remote servers and the local machine on a schedule",
+}
+
+func serviceNamesPath(dir string) string {
+	return filepath.Join(dir, "service.json")
+}
+
+// loadServiceNames returns the names install recorded in dir, or
+// the defaults if the service was installed without overriding them.
+func loadServiceNames(dir string) (serviceNames, error) {
+	names := defaultServiceNames
+	file, err := os.ReadFile(serviceNamesPath(dir))
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+	if err != nil {
+		return names, fmt.Errorf("unable to read service file: %w", err)
+	}
+	if err := json.Unmarshal(file, &names); err != nil {
+		return names, fmt.Errorf("unable to parse service file: %w", err)
+	}
+	return names, names.validate()
+}
+
+func (n serviceNames) validate() error {
+	switch {
+	case n.Name == "":
+		return errors.New("the service name must not be empty")
+	case strings.ContainsAny(n.Name, ` /\`):
+		return fmt.Errorf("invalid service name %q: must not contain spaces or slashes", n.Name)
+	}
+	return nil
+}
+
+func (n serviceNames) apply(svcConfig *service.Config) {
+	svcConfig.Name = n.Name
+	svcConfig.DisplayName = n.DisplayName
+	svcConfig.Description = n.Description
+}
+
+// saveServiceNames records names in dir, or removes the record if
+// they are the defaults.
+func saveServiceNames(dir string, names serviceNames) error {
+	path := serviceNamesPath(dir)
+	if names == defaultServiceNames {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(names, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"data_sync/datasync"
+)
+
+type syncState struct {
+	LastRun   time.Time     `json:"lastRun"`
+	Duration  time.Duration `json:"duration"`
+	Files     int           `json:"files"`
+	Failed    int           `json:"failed"`
+	LastError string        `json:"lastError,omitempty"`
+}
+
+var (
+	statePath string
+	stateMu   sync.Mutex
+)
+
+func loadState() (map[string]syncState, error) {
+	states := make(map[string]syncState)
+	file, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read state file: %w", err)
+	}
+	if err := json.Unmarshal(file, &states); err != nil {
+		return nil, fmt.Errorf("unable to parse state file: %w", err)
+	}
+	return states, nil
+}
+
+func recordSyncState(config datasync.Config, result datasync.Result) error {
+	if statePath == "" {
+		return nil
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	states, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	state := syncState{
+		LastRun:  result.Started,
+		Duration: result.Duration,
+		Files:    result.Files,
+		Failed:   result.Failed,
+	}
+	if result.LastErr != nil {
+		state.LastError = result.LastErr.Error()
+	}
+	states[config.Key()] = state
+
+	data, err := json.MarshalIndent(states, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, statePath)
+}
+
+func printStatus(w io.Writer, selected []datasync.Config) error {
+	states, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONFIG\tLAST RUN\tDURATION\tFILES\tSTATUS")
+	for _, config := range selected {
+		state, ok := states[config.Key()]
+		if !ok {
+			fmt.Fprintf(tw, "%s\tnever\t-\t-\t-\n", config.Key())
+			continue
+		}
+		status := "ok"
+		if state.LastError != "" {
+			status = fmt.Sprintf("failed (%d errors): %s", state.Failed, state.LastError)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", config.Key(), state.LastRun.Format(time.DateTime),
+			state.Duration.Round(time.Second), state.Files, status)
+	}
+	return tw.Flush()
+}
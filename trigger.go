@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Sending the service SIGUSR1 syncs every enabled config at once, outside
+// its schedule, for hosts where the API cannot be reached. A config whose
+// scheduled sync is still running is left to it, and a scheduled run that
+// comes due during the triggered sync of its config is skipped. Syncs
+// started through the API are triggered ones too.
+
+// beginSync records a sync of the config key starting, triggered by
+// SIGUSR1 or the API or else by its schedule, and reports false when it
+// would overlap one already running: a triggered sync with any other, a
+// scheduled one with a triggered one.
+func (p *program) beginSync(key string, triggered bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.triggered[key] || triggered && p.scheduled[key] > 0 {
+		return false
+	}
+	if triggered {
+		if p.triggered == nil {
+			p.triggered = make(map[string]bool)
+		}
+		p.triggered[key] = true
+	} else {
+		if p.scheduled == nil {
+			p.scheduled = make(map[string]int)
+		}
+		p.scheduled[key]++
+	}
+	return true
+}
+
+func (p *program) endSync(key string, triggered bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if triggered {
+		delete(p.triggered, key)
+	} else if p.scheduled[key]--; p.scheduled[key] == 0 {
+		delete(p.scheduled, key)
+	}
+}
+
+// syncNow starts a sync of every enabled config, as on SIGUSR1.
+func (p *program) syncNow() {
+	p.mu.Lock()
+	cfgs := configs
+	p.mu.Unlock()
+
+	log.Println("Received SIGUSR1, syncing every enabled config now")
+	for _, cfg := range cfgs {
+		if cfg.Disabled() {
+			continue
+		}
+		key := cfg.Key()
+		if !p.beginSync(key, true) {
+			log.Println("Not syncing", key, "on SIGUSR1: a sync of it is already running")
+			continue
+		}
+		p.triggers.Add(1)
+		go func() {
+			defer p.triggers.Done()
+			defer p.endSync(key, true)
+			log.Println("Triggered sync of", key, "started, syncing folder: ", remoteDirs(cfg))
+			start := time.Now()
+			if _, err := syncFolder(p.ctx, cfg, "", ""); err != nil {
+				log.Printf("Triggered sync of %s failed after %s: %v", key, time.Since(start).Round(time.Millisecond), err)
+				return
+			}
+			log.Printf("Triggered sync of %s finished in %s", key, time.Since(start).Round(time.Millisecond))
+		}()
+	}
+}
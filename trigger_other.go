@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyTrigger relays SIGUSR1 to c.
+func notifyTrigger(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// notifyTrigger relays nothing, as Windows has no SIGUSR1.
+func notifyTrigger(c chan<- os.Signal) {}
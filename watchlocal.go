@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"data_sync/datasync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// defaultWatchDelay is how long a file must go without changes before a
+// config with watchLocal and no watchDelay pushes it.
+const defaultWatchDelay = 2 * time.Second
+
+// startWatches watches the local directories of every config with
+// watchLocal, replacing the watches of a previous configuration.
+func (p *program) startWatches(cfgs []datasync.Config) {
+	ctx, cancel := context.WithCancel(p.ctx)
+	p.mu.Lock()
+	if p.stopWatches != nil {
+		p.stopWatches()
+	}
+	p.stopWatches = cancel
+	p.mu.Unlock()
+
+	for _, cfg := range cfgs {
+		if !cfg.WatchLocal || cfg.Disabled() {
+			continue
+		}
+		p.watches.Add(1)
+		go func() {
+			defer p.watches.Done()
+			p.watchLocal(ctx, cfg)
+		}()
+	}
+}
+
+// watchLocal pushes the files below cfg's local directories once they
+// settle, until ctx is done. Changes are collected per path, and every path
+// that has not changed for the watch delay is pushed in one sync, so a
+// burst of events leads to a single push. Changes made during a push are
+// pushed after it.
+func (p *program) watchLocal(ctx context.Context, cfg datasync.Config) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println("Failed to watch the local directories of", cfg.Key(), ":", err)
+		return
+	}
+	defer watcher.Close()
+	// Validation has rejected date variables in the paths of watched
+	// configs, so they resolve the same on every day.
+	resolved, err := cfg.ResolvePaths(time.Now())
+	if err != nil {
+		log.Println("Failed to watch the local directories of", cfg.Key(), ":", err)
+		return
+	}
+	for _, pair := range resolved.DirPairs() {
+		addWatches(watcher, pair.LocalDir)
+	}
+	log.Println("Watching the local directories of", cfg.Key(), "for changes")
+
+	delay := time.Duration(cfg.WatchDelay)
+	if delay <= 0 {
+		delay = defaultWatchDelay
+	}
+	// The push would defer files that are younger than stabilizeDelay.
+	delay = max(delay, time.Duration(cfg.StabilizeDelay))
+	pending := make(map[string]time.Time)
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	armed := false
+	var pushing chan struct{}
+	var queued []string
+	for {
+		select {
+		case <-ctx.Done():
+			if pushing != nil {
+				<-pushing
+			}
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if strings.HasPrefix(filepath.Base(event.Name), ".datasync-") ||
+				!event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			// Files created in a new directory before it is watched are
+			// pushed with the directory.
+			if info, err := os.Lstat(event.Name); err == nil && info.IsDir() && event.Has(fsnotify.Create) {
+				addWatches(watcher, event.Name)
+			}
+			pending[event.Name] = time.Now()
+			if !armed {
+				timer.Reset(delay)
+				armed = true
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("Local watcher error for", cfg.Key(), ":", err)
+		case <-timer.C:
+			armed = false
+			now := time.Now()
+			var next time.Duration
+			for path, changed := range pending {
+				if wait := delay - now.Sub(changed); wait > 0 {
+					if next == 0 || wait < next {
+						next = wait
+					}
+					continue
+				}
+				queued = append(queued, path)
+				delete(pending, path)
+			}
+			if next > 0 {
+				timer.Reset(next)
+				armed = true
+			}
+		case <-pushing:
+			pushing = nil
+		}
+		if pushing == nil && len(queued) > 0 {
+			pushing = make(chan struct{})
+			go p.pushChanged(ctx, cfg, queued, pushing)
+			queued = nil
+		}
+	}
+}
+
+// pushChanged pushes paths and closes done.
+func (p *program) pushChanged(ctx context.Context, cfg datasync.Config, paths []string, done chan struct{}) {
+	defer close(done)
+	paths = withoutNested(paths)
+	if debugLogging || cfg.LogLevel == "debug" {
+		log.Println("Pushing changed files of", cfg.Key(), ":", strings.Join(paths, ", "))
+	}
+	result, err := syncer.SyncFiles(ctx, cfg, paths)
+	logDenied(cfg, result)
+	if err != nil && ctx.Err() == nil {
+		log.Println(red(fmt.Sprint("Push of changed files failed for ", cfg.Key(), " : ", err)))
+	}
+}
+
+// withoutNested sorts paths and drops those inside another one, which
+// pushes them anyway.
+func withoutNested(paths []string) []string {
+	sort.Strings(paths)
+	var kept []string
+next:
+	for _, path := range paths {
+		for _, dir := range kept {
+			if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+				continue next
+			}
+		}
+		kept = append(kept, path)
+	}
+	return kept
+}
+
+// addWatches watches dir and every directory below it.
+func addWatches(watcher *fsnotify.Watcher, dir string) {
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			log.Println("Failed to watch", path, ":", err)
+			if entry != nil && entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if err := watcher.Add(path); err != nil {
+			log.Println("Failed to watch", path, ":", err)
+		}
+		return nil
+	})
+}